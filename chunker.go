@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"math/bits"
+)
+
+/*
+The chunker splits content into content-defined chunks with FastCDC. A rolling gear hash
+runs over the bytes and a chunk ends wherever the top bits of the hash are all zero, so
+the boundaries depend on the content around them and not on offsets: inserting a few
+bytes at the front of a file only changes the chunks around the insertion, every later
+chunk comes out the same and is stored only once. To keep chunk sizes close to the
+average, a stricter mask is used before the average size and a looser one after it.
+*/
+
+// ChunkerOpts are the chunk sizes in bytes, zero fields take the defaults
+type ChunkerOpts struct {
+	MinSize int // no chunk is cut before this many bytes, except the last one
+	AvgSize int // the size chunks are normalised towards, rounded down to a power of two
+	MaxSize int // chunks are cut here when the content offers no boundary
+}
+
+const (
+	defaultMinChunkSize = 16 * 1024
+	defaultAvgChunkSize = 64 * 1024
+	defaultMaxChunkSize = 256 * 1024
+)
+
+// gear maps every byte to a random 64 bit value, it must never change or chunk boundaries move
+var gear = func() [256]uint64 {
+	var table [256]uint64
+	state := uint64(0x6e696d6275736673) // "nimbusfs"
+	for i := range table {
+		// splitmix64
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// fastCDC holds the options with their masks worked out
+type fastCDC struct {
+	ChunkerOpts
+	maskS uint64 // before AvgSize, one bit more than the average asks for
+	maskL uint64 // after AvgSize, one bit less
+}
+
+func newFastCDC(opts ChunkerOpts) (*fastCDC, error) {
+	if opts.MinSize <= 0 {
+		opts.MinSize = defaultMinChunkSize
+	}
+	if opts.AvgSize <= 0 {
+		opts.AvgSize = defaultAvgChunkSize
+	}
+	if opts.MaxSize <= 0 {
+		opts.MaxSize = defaultMaxChunkSize
+	}
+	if !(opts.MinSize < opts.AvgSize && opts.AvgSize < opts.MaxSize) {
+		return nil, fmt.Errorf("chunk sizes must grow from min to avg to max, got %d, %d, %d", opts.MinSize, opts.AvgSize, opts.MaxSize)
+	}
+
+	// the top bits of the gear hash cover the widest window, so the masks take those
+	avgBits := bits.Len(uint(opts.AvgSize)) - 1
+	return &fastCDC{
+		ChunkerOpts: opts,
+		maskS:       ^uint64(0) << (64 - (avgBits + 1)),
+		maskL:       ^uint64(0) << (64 - (avgBits - 1)),
+	}, nil
+}
+
+// cut returns the length of the first chunk of data. It only looks at the first MaxSize bytes,
+// so the boundaries come out the same however the content is handed to the chunker.
+func (c *fastCDC) cut(data []byte) int {
+	n := len(data)
+	if n <= c.MinSize {
+		return n
+	}
+	if n > c.MaxSize {
+		n = c.MaxSize
+	}
+
+	normal := min(c.AvgSize, n)
+
+	var hash uint64
+	i := c.MinSize
+	for ; i < normal; i++ {
+		hash = (hash << 1) + gear[data[i]]
+		if hash&c.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		hash = (hash << 1) + gear[data[i]]
+		if hash&c.maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// chunkWriter cuts everything written to it into chunks and hands them to emit. Close emits
+// what is left. The slice emit gets is only valid until it returns.
+type chunkWriter struct {
+	cdc  *fastCDC
+	buf  []byte
+	emit func(chunk []byte) error
+}
+
+func newChunkWriter(opts ChunkerOpts, emit func(chunk []byte) error) (*chunkWriter, error) {
+	cdc, err := newFastCDC(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &chunkWriter{
+		cdc:  cdc,
+		buf:  make([]byte, 0, 2*cdc.MaxSize),
+		emit: emit,
+	}, nil
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+
+	// only cut once a whole MaxSize window is buffered, a shorter tail may still grow
+	off := 0
+	for len(w.buf)-off >= w.cdc.MaxSize {
+		n := w.cdc.cut(w.buf[off:])
+		if err := w.emit(w.buf[off : off+n]); err != nil {
+			return 0, err
+		}
+		off += n
+	}
+	w.buf = append(w.buf[:0], w.buf[off:]...)
+
+	return len(p), nil
+}
+
+func (w *chunkWriter) Close() error {
+	for len(w.buf) > 0 {
+		n := w.cdc.cut(w.buf)
+		if err := w.emit(w.buf[:n]); err != nil {
+			return err
+		}
+		w.buf = w.buf[n:]
+	}
+	return nil
+}
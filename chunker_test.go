@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/sha256"
+	"math/rand"
+	"slices"
+	"testing"
+)
+
+func chunkAll(t *testing.T, data []byte, writeSize int) [][32]byte {
+	var sums [][32]byte
+	w, err := newChunkWriter(ChunkerOpts{}, func(chunk []byte) error {
+		if len(chunk) > defaultMaxChunkSize {
+			t.Errorf("chunk of %d bytes is above the max", len(chunk))
+		}
+		sums = append(sums, sha256.Sum256(chunk))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for off := 0; off < len(data); off += writeSize {
+		w.Write(data[off:min(off+writeSize, len(data))])
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return sums
+}
+
+func TestChunkerBoundariesIgnoreWriteSizes(t *testing.T) {
+	data := make([]byte, 3<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	whole := chunkAll(t, data, len(data))
+	for _, size := range []int{1000, 64 * 1024, 300 * 1024} {
+		if got := chunkAll(t, data, size); !slices.Equal(got, whole) {
+			t.Fatalf("writes of %d bytes cut %d chunks, one write cut %d different ones", size, len(got), len(whole))
+		}
+	}
+
+	// 3MiB at a 64KiB average should be somewhere around 48 chunks
+	if len(whole) < 20 || len(whole) > 100 {
+		t.Errorf("%d chunks for 3MiB", len(whole))
+	}
+}
+
+func TestChunkerSurvivesInsertions(t *testing.T) {
+	data := make([]byte, 2<<20)
+	rand.New(rand.NewSource(2)).Read(data)
+	edited := append([]byte("a few bytes in front"), data...)
+
+	before := make(map[[32]byte]bool)
+	for _, sum := range chunkAll(t, data, len(data)) {
+		before[sum] = true
+	}
+
+	after := chunkAll(t, edited, len(edited))
+	shared := 0
+	for _, sum := range after {
+		if before[sum] {
+			shared++
+		}
+	}
+
+	// only the chunk holding the insertion should change
+	if shared < len(after)-2 {
+		t.Errorf("only %d of %d chunks survived an insertion at the front", shared, len(after))
+	}
+}
+
+func TestChunkerRejectsBadSizes(t *testing.T) {
+	if _, err := newFastCDC(ChunkerOpts{MinSize: 64 * 1024, AvgSize: 16 * 1024}); err == nil {
+		t.Error("expected an error for a min size above the average")
+	}
+}
@@ -1,5 +1,4 @@
 // Description: This file contains the encryption and decryption functions
-// Description: This file contains the encryption and decryption functions
 package main
 
 import (
@@ -7,8 +6,12 @@ import (
 	"crypto/cipher"
 	"crypto/md5"
 	"crypto/rand"
+	"encoding/binary"
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
+	"math"
 )
 
 func generateID() string {
@@ -62,7 +65,7 @@ func copyDecrypt(key []byte, src io.Reader, dst io.Writer) (int, error) {
 	// Read the IV from the given io.Reader which, in our case should be the
 	// the block.BlockSize() bytes we read.
 	iv := make([]byte, block.BlockSize())
-	if _, err := src.Read(iv); err != nil {
+	if _, err := io.ReadFull(src, iv); err != nil {
 		return 0, err
 	}
 
@@ -89,3 +92,272 @@ func copyEncrypt(key []byte, src io.Reader, dst io.Writer) (int, error) {
 	stream := cipher.NewCTR(block, iv)
 	return copyStream(stream, block.BlockSize(), src, dst)
 }
+
+// ---------------------- Authenticated Chunked Encryption ---------------------- //
+
+/*
+copyEncrypt/copyDecrypt use plain CTR mode, so a flipped bit decrypts to silent garbage.
+copySeal writes the authenticated format instead, which splits the plaintext into chunks
+and seals every chunk with AES-GCM:
+
+	header: magic "NMBE" (4) | version (1) | chunk size (4) | nonce prefix (7)
+	chunk:  ciphertext of up to chunk size bytes | GCM tag (16)
+
+The nonce of a chunk is the random prefix, the chunk counter (4) and a final flag (1),
+and every chunk authenticates the header as additional data. Reordered, dropped or
+modified chunks fail to open, and since only the last chunk is sealed as final a
+truncated or extended stream fails too. The header is as long as the CTR IV. Which
+format an object is in comes from its Metadata.Encryption, not from the bytes, so a
+sealed object with a damaged header fails to open instead of decrypting as CTR.
+*/
+
+const (
+	sealMagic        = "NMBE"
+	sealVersion      = 1
+	sealHeaderSize   = 16
+	sealNoncePrefix  = 7
+	sealTagSize      = 16 // the GCM tag after every chunk
+	sealChunkSize    = 64 * 1024
+	maxSealChunkSize = 16 << 20
+)
+
+var errSealedCorrupt = errors.New("sealed data failed authentication")
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(prefix []byte, counter uint32, final bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[sealNoncePrefix:], counter)
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// copySeal encrypts src into dst in the chunked AES-GCM format and returns the bytes written
+func copySeal(key []byte, src io.Reader, dst io.Writer) (int, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return 0, err
+	}
+
+	header := make([]byte, sealHeaderSize)
+	copy(header, sealMagic)
+	header[4] = sealVersion
+	binary.BigEndian.PutUint32(header[5:9], sealChunkSize)
+	if _, err := io.ReadFull(rand.Reader, header[9:]); err != nil {
+		return 0, err
+	}
+
+	nw, err := dst.Write(header)
+	if err != nil {
+		return nw, err
+	}
+
+	// one byte of lookahead tells us whether a full chunk is also the last one
+	var (
+		buf  = make([]byte, sealChunkSize+1)
+		out  = make([]byte, 0, sealChunkSize+aead.Overhead())
+		have = 0
+	)
+	for counter := uint32(0); ; counter++ {
+		n, err := io.ReadFull(src, buf[have:])
+		have += n
+
+		final := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !final {
+			return nw, err
+		}
+
+		plain := buf[:min(have, sealChunkSize)]
+		out = aead.Seal(out[:0], chunkNonce(header[9:], counter, final), plain, header)
+		nn, err := dst.Write(out)
+		nw += nn
+		if err != nil {
+			return nw, err
+		}
+
+		if final {
+			return nw, nil
+		}
+		if counter == math.MaxUint32 {
+			return nw, errors.New("sealed data exceeds the chunk counter")
+		}
+
+		buf[0] = buf[sealChunkSize]
+		have = 1
+	}
+}
+
+// sealedSize is how many bytes copySeal writes for n bytes of plaintext
+func sealedSize(n int64) int64 {
+	chunks := (n + sealChunkSize - 1) / sealChunkSize
+	if chunks == 0 {
+		chunks = 1 // empty input still gets a final chunk
+	}
+	return sealHeaderSize + n + chunks*sealTagSize
+}
+
+// copyOpen decrypts src into dst and returns the plaintext bytes written. format is the
+// Metadata.Encryption of the object, EncryptionSealed for the chunked AES-GCM format and
+// anything else for the legacy CTR format of copyEncrypt, from before formats were recorded.
+func copyOpen(key []byte, format string, src io.Reader, dst io.Writer) (int, error) {
+	if format != EncryptionSealed {
+		n, err := copyDecrypt(key, src, dst)
+		return max(n-aes.BlockSize, 0), err
+	}
+
+	header := make([]byte, sealHeaderSize)
+	if _, err := io.ReadFull(src, header); err != nil {
+		return 0, err
+	}
+	if string(header[:4]) != sealMagic || header[4] != sealVersion {
+		return 0, fmt.Errorf("%w: not a sealed header", errSealedCorrupt)
+	}
+
+	chunkSize := int(binary.BigEndian.Uint32(header[5:9]))
+	if chunkSize == 0 || chunkSize > maxSealChunkSize {
+		return 0, fmt.Errorf("sealed data with a chunk size of %d", chunkSize)
+	}
+
+	aead, err := newGCM(key)
+	if err != nil {
+		return 0, err
+	}
+
+	var (
+		sealedChunk = chunkSize + aead.Overhead()
+		buf         = make([]byte, sealedChunk+1)
+		out         = make([]byte, 0, chunkSize)
+		have        = 0
+		nw          = 0
+	)
+	for counter := uint32(0); ; counter++ {
+		n, err := io.ReadFull(src, buf[have:])
+		have += n
+
+		final := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !final {
+			return nw, err
+		}
+
+		sealed := buf[:min(have, sealedChunk)]
+		if len(sealed) < aead.Overhead() {
+			return nw, fmt.Errorf("%w: chunk %d is cut short", errSealedCorrupt, counter)
+		}
+
+		out, err = aead.Open(out[:0], chunkNonce(header[9:], counter, final), sealed, header)
+		if err != nil {
+			// a chunk that was modified, moved, or sealed as final when it isn't the last (or the other way round)
+			return nw, fmt.Errorf("%w: chunk %d", errSealedCorrupt, counter)
+		}
+
+		nn, err := dst.Write(out)
+		nw += nn
+		if err != nil {
+			return nw, err
+		}
+
+		if final {
+			return nw, nil
+		}
+
+		buf[0] = buf[sealedChunk]
+		have = 1
+	}
+}
+
+// ---------------------- Decrypting a Range ---------------------- //
+
+/*
+Every chunk of the sealed format opens on its own, given the header and its counter, so a
+range of the plaintext only needs the chunks it falls in. sealedRange says which bytes of
+the sealed stream those are and copyOpenRange opens them. Whether a chunk is the last one
+comes from the size of the whole sealed object, since the range usually ends before it.
+*/
+
+var errNotSeekable = errors.New("not in a format that opens from the middle")
+
+// sealedRange is where the chunks holding plaintext [offset, offset+length) start in what
+// copySeal writes, how many bytes they take (-1 for the rest) and the counter of the first
+func sealedRange(offset int64, length int64) (int64, int64, uint32) {
+	const sealedChunk = sealChunkSize + sealTagSize
+
+	first := offset / sealChunkSize
+	start := sealHeaderSize + first*sealedChunk
+	if length < 0 {
+		return start, -1, uint32(first)
+	}
+	last := max(offset+length-1, offset) / sealChunkSize
+	return start, (last - first + 1) * sealedChunk, uint32(first)
+}
+
+// openedSize is how much plaintext the sealed object of size n holds, the reverse of sealedSize
+func openedSize(n int64) int64 {
+	n -= sealHeaderSize
+	chunks := (n + sealChunkSize + sealTagSize - 1) / (sealChunkSize + sealTagSize)
+	return max(n-chunks*sealTagSize, 0)
+}
+
+// seekable tells whether a sealed object with this header opens with copyOpenRange
+func seekable(header []byte) bool {
+	return len(header) == sealHeaderSize && string(header[:4]) == sealMagic && header[4] == sealVersion &&
+		binary.BigEndian.Uint32(header[5:9]) == sealChunkSize
+}
+
+// copyOpenRange opens the chunks src holds, from the counter first on, of a sealed object of
+// total bytes whose header is given. The header has to name the chunk size sealedRange uses.
+func copyOpenRange(key []byte, header []byte, first uint32, total int64, src io.Reader, dst io.Writer) (int, error) {
+	if !seekable(header) {
+		return 0, errNotSeekable
+	}
+	if total < sealHeaderSize+sealTagSize {
+		return 0, fmt.Errorf("%w: %d bytes can't hold a chunk", errSealedCorrupt, total)
+	}
+
+	aead, err := newGCM(key)
+	if err != nil {
+		return 0, err
+	}
+
+	var (
+		last = uint32((total - sealHeaderSize - 1) / (sealChunkSize + sealTagSize))
+		buf  = make([]byte, sealChunkSize+aead.Overhead())
+		out  = make([]byte, 0, sealChunkSize)
+		nw   = 0
+	)
+	for counter := first; counter <= last; counter++ {
+		n, err := io.ReadFull(src, buf)
+		if err == io.EOF {
+			return nw, nil // the range ends before the object does
+		}
+		if err == io.ErrUnexpectedEOF && counter != last {
+			return nw, fmt.Errorf("%w: chunk %d is cut short", errSealedCorrupt, counter)
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return nw, err
+		}
+
+		out, err = aead.Open(out[:0], chunkNonce(header[9:], counter, counter == last), buf[:n], header)
+		if err != nil {
+			return nw, fmt.Errorf("%w: chunk %d", errSealedCorrupt, counter)
+		}
+
+		nn, err := dst.Write(out)
+		nw += nn
+		if err != nil {
+			return nw, err
+		}
+		if counter == last {
+			break // counter++ would wrap at math.MaxUint32
+		}
+	}
+	return nw, nil
+}
@@ -2,7 +2,10 @@ package main
 
 import (
 	"bytes"
+	"crypto/rand"
+	"errors"
 	"fmt"
+	"io"
 	"testing"
 )
 
@@ -34,3 +37,87 @@ func TestCopyEncryptDecrypt(t *testing.T) {
 	}
 }
 
+func TestCopySealOpen(t *testing.T) {
+	key := newEncryptionKey()
+
+	// empty, short, exactly one chunk and several chunks with a partial tail
+	for _, size := range []int{0, 11, sealChunkSize, 3*sealChunkSize + 100} {
+		payload := make([]byte, size)
+		rand.Read(payload)
+
+		sealed := new(bytes.Buffer)
+		if _, err := copySeal(key, bytes.NewReader(payload), sealed); err != nil {
+			t.Fatal(err)
+		}
+
+		if int64(sealed.Len()) != sealedSize(int64(size)) {
+			t.Errorf("size %d: sealed to %d bytes, sealedSize says %d", size, sealed.Len(), sealedSize(int64(size)))
+		}
+
+		out := new(bytes.Buffer)
+		n, err := copyOpen(key, EncryptionSealed, sealed, out)
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if n != size || !bytes.Equal(out.Bytes(), payload) {
+			t.Errorf("size %d: got back %d bytes that don't match", size, n)
+		}
+	}
+}
+
+func TestCopyOpenDetectsTampering(t *testing.T) {
+	key := newEncryptionKey()
+	payload := make([]byte, 2*sealChunkSize+10)
+	rand.Read(payload)
+
+	sealed := new(bytes.Buffer)
+	if _, err := copySeal(key, bytes.NewReader(payload), sealed); err != nil {
+		t.Fatal(err)
+	}
+	chunk := sealChunkSize + sealTagSize
+
+	tests := map[string][]byte{
+		"flipped bit":        flipBit(sealed.Bytes(), sealHeaderSize+5),
+		"dropped last chunk": sealed.Bytes()[:sealHeaderSize+2*chunk],
+		"cut mid chunk":      sealed.Bytes()[:sealHeaderSize+chunk+100],
+		"appended data":      append(bytes.Clone(sealed.Bytes()), 0),
+		"wrong chunk size":   flipBit(sealed.Bytes(), 7),
+		"wrong magic":        flipBit(sealed.Bytes(), 1),
+		"wrong version":      flipBit(sealed.Bytes(), 4),
+	}
+	for name, data := range tests {
+		if _, err := copyOpen(key, EncryptionSealed, bytes.NewReader(data), io.Discard); err == nil {
+			t.Errorf("%s: opened without an error", name)
+		}
+	}
+
+	// a damaged header isn't taken for the IV of a legacy CTR file
+	if _, err := copyOpen(key, EncryptionSealed, bytes.NewReader(tests["wrong magic"]), io.Discard); !errors.Is(err, errSealedCorrupt) {
+		t.Errorf("wrong magic: got %v, want errSealedCorrupt", err)
+	}
+}
+
+func TestCopyOpenReadsLegacyCTR(t *testing.T) {
+	key := newEncryptionKey()
+	payload := []byte("written before the switch to GCM")
+
+	legacy := new(bytes.Buffer)
+	if _, err := copyEncrypt(key, bytes.NewReader(payload), legacy); err != nil {
+		t.Fatal(err)
+	}
+
+	out := new(bytes.Buffer)
+	n, err := copyOpen(key, EncryptionNone, legacy, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(payload) || out.String() != string(payload) {
+		t.Errorf("got %q (%d bytes)", out.String(), n)
+	}
+}
+
+func flipBit(b []byte, i int) []byte {
+	b = bytes.Clone(b)
+	b[i] ^= 1
+	return b
+}
@@ -2,17 +2,37 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/binary"
 	"encoding/gob"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
+	"reflect"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/MonalBarse/NimbusFS/p2p"
 )
 
+const (
+	defaultRequestTimeout = 5 * time.Second
+	maxStreamHeaderSize   = 1 << 20 // upper bound on the gob header that opens every stream
+)
+
+var (
+	errAckTimeout = errors.New("no ack before the replication deadline")
+	ErrNotFound   = errors.New("file not found")
+	errNoPeers    = errors.New("no peers to ask")
+)
+
 // ----------------------------- Core Structures ----------------------------- //
 
 type FileServer struct {
@@ -20,39 +40,218 @@ type FileServer struct {
 	FileServerOpts
 
 	peerLock sync.Mutex
-	peers    map[string]p2p.Peer
-
-	store  *Store
-	quitCh chan struct{}
+	peers    map[string]p2p.Peer // keyed by the peer's authenticated ID
+	contacts map[string]bool     // the peers only dialed for the DHT, left out of the ring, replication and broadcasts
+	dhtDials map[string]bool     // addresses the DHT is dialing, their peers become contacts
+	ring     hashRing            // the same peers, placed for ReplicationFactor, see ring.go
+	dht      *p2p.DHT            // nil without FileServerOpts.DHT, see fileserver_dht.go
+	members  *p2p.Membership     // nil without FileServerOpts.Membership, see fileserver_membership.go
+	conns    *p2p.ConnManager    // keeps the BootstrapNodes connected, see fileserver_conns.go
+
+	pendingLock sync.Mutex
+	pending     map[uint64]*waiter // Store and Get calls waiting for responses, keyed by Message.RequestID
+	nextReqID   atomic.Uint64
+
+	store       Store
+	scrub       scrubber
+	reap        reaper
+	rebalanceCh chan struct{} // poked when the peers change, see ring.go
+	quitCh      chan struct{}
+	stopOnce    sync.Once
 }
 
 type FileServerOpts struct {
 	ID                string
+	NodeID            string // who this node is, recorded as the Creator of what it stores, defaults to the transport address
 	EncKey            []byte
 	StorageRoot       string
 	PathTransformFunc PathTransformFunc
+	ContentAddressed  bool       // store files under the SHA-256 of their content, see store_cas.go
+	Chunking          bool       // store files as deduplicated content-defined chunks, see store_chunks.go
+	Durability        Durability // what the store syncs before a write counts as done, see store.go
+	Quota             Quota      // limits on what the store takes, from this node and from peers, see store_quota.go
+	Versioning        bool       // keep the versions a Store replaces, see store_versions.go
+	Retention         Retention  // how many old versions, and how old, Versioning keeps
+	Compression       string     // codec to compress files with before they are sealed, see store_compress.go
+	Storage           Store      // optional, e.g. NewMemoryStore, the storage options above only apply to the default LocalStore
 	Transport         p2p.Transport
-	BootstrapNodes    []string
+	BootstrapNodes    []string      // kept connected, redialed with a backoff whenever they aren't
+	RedialBackoff     time.Duration // first wait before redialing a bootstrap node, doubling up to 30s, 500ms by default
+	DHT               bool          // find nodes and the holders of files through a Kademlia DHT, NodeID must be the identity peers authenticate, see fileserver_dht.go
+	Membership        bool          // keep the peers by a SWIM membership view, NodeID as for DHT, see fileserver_membership.go
+	ProbeInterval     time.Duration // time between the probes of Membership, a second by default
+	ReplicationFactor int           // number of peers a file goes to, picked by a consistent-hash ring, 0 means every connected peer, fixed once Start runs, see ring.go
+	ReplicationQuorum int           // number of peer acks Store waits for, 0 means every peer the file goes to
+	RequestTimeout    time.Duration // deadline for Get and Store when the caller's context has none
+	ScrubInterval     time.Duration // time between scrubs of the store, 0 turns the scrubber off, see scrubber.go
+	ScrubRate         int64         // bytes per second a scrub reads at most
+	ReapInterval      time.Duration // time between passes of the reaper, 0 is a minute and negative turns it off, see reaper.go
+	TombstoneTTL      time.Duration // how long what Delete and the reaper buried is kept from coming back, see fileserver_delete.go
 }
 
 // for the message to be sent over the network
 type Message struct {
-	Payload any
+	RequestID uint64 // set by the requester and echoed back in every response to it
+	Payload   any
 }
 
-// store the message in the file
+// store the message in the file, sent as the header of the stream carrying the file. A TTL
+// travels as Meta.Expires, see reaper.go.
 type MessageStoreFile struct {
 	ID   string
 	Key  string
 	Size int64
+	Meta Metadata
+}
+
+// acknowledge a stored replica, Digest is the hex SHA-256 of the bytes the peer wrote
+type MessageStoreAck struct {
+	ID            string
+	Key           string
+	Size          int64
+	Digest        string
+	Err           string // set when the peer failed to write the replica
+	QuotaExceeded bool   // the peer refused the replica for its quota, Err says which
 }
 
 // get the file
 type MessageGetFile struct {
+	ID      string
+	Key     string
+	Version string // the current one when empty, see store_versions.go
+}
+
+// get Length bytes of the file from Offset on, -1 for the rest, see fileserver_range.go
+type MessageGetRange struct {
+	ID     string
+	Key    string
+	Offset int64
+	Length int64
+	Prefix int64 // bytes from the start of the file to send ahead of the range, e.g. the seal header
+}
+
+// delete the file and every version of it up to Version, see fileserver_delete.go
+type MessageDeleteFile struct {
+	ID      string
+	Key     string
+	Version string
+}
+
+// acknowledge a MessageDeleteFile, Err is set when the peer failed to delete its replica
+type MessageDeleteAck struct {
 	ID  string
 	Key string
+	Err string
+}
+
+// a request of the DHT, answered with a MessageDHTResponse, see fileserver_dht.go
+type MessageDHTRequest struct {
+	Req p2p.DHTRequest
+}
+
+type MessageDHTResponse struct {
+	Resp p2p.DHTResponse
+}
+
+// a ping or ping-req of the membership protocol, see fileserver_membership.go
+type MessageSWIM struct {
+	Msg p2p.SWIMMessage
+}
+
+// ask whether the peer holds a file, answered with a MessageHasFileResponse, see ring.go
+type MessageHasFile struct {
+	ID  string
+	Key string
+}
+
+// Digest is the Meta.Digest of the copy the peer holds, empty when it holds none
+type MessageHasFileResponse struct {
+	ID     string
+	Key    string
+	Digest string
+}
+
+// the ack to a MessageSWIM, Err is set when a ping-req got none from its target
+type MessageSWIMAck struct {
+	Msg p2p.SWIMMessage
+	Err string
+}
+
+// answer to a MessageGetFile or MessageGetRange. When the peer has the file it is sent as
+// the header of a stream followed by Size bytes, otherwise as a plain message with Err set.
+type MessageGetFileResponse struct {
+	ID     string
+	Key    string
+	Size   int64
+	Offset int64 // where the range starts, after the Prefix bytes
+	Total  int64 // the size of the whole file, set for ranges
+	Meta   Metadata
+	Err    string
+}
+
+// response is handed by the message handlers to the Store or Get call waiting on it
+type response struct {
+	from    string
+	stream  io.Closer // the stream the response arrived on, nil for responses sent as plain messages
+	body    io.Reader // the rest of the stream
+	payload any
+}
+
+// discard releases a stream response nobody is going to read
+func (r response) discard() {
+	if r.stream != nil {
+		r.stream.Close()
+	}
+}
+
+type waiter struct {
+	ch    chan response   // buffered for every peer asked, so delivering never blocks the handlers
+	peers map[string]bool // the peers asked that haven't answered yet, nobody else's answer is delivered
+	want  reflect.Type    // the payload type the request is answered with
+}
+
+// ReplicationError is returned by Store when fewer peers than required acknowledged
+// their replica before the deadline. Failures holds the reason for every peer that did not.
+type ReplicationError struct {
+	Key      string
+	Required int
+	Acked    int
+	Failures map[string]error // keyed by peer ID
+}
+
+func (e *ReplicationError) Error() string {
+	addrs := make([]string, 0, len(e.Failures))
+	for addr := range e.Failures {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	reasons := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		reasons = append(reasons, fmt.Sprintf("%s: %v", addr, e.Failures[addr]))
+	}
+
+	return fmt.Sprintf("replication of (%s) got %d/%d acks [%s]", e.Key, e.Acked, e.Required, strings.Join(reasons, "; "))
+}
+
+// Unwrap lets errors.Is look at the failures, e.g. for ErrQuotaExceeded
+func (e *ReplicationError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Failures))
+	for _, err := range e.Failures {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// peerError is an error a peer reported, kind keeps it recognisable to errors.Is
+type peerError struct {
+	msg  string
+	kind error
 }
 
+func (e *peerError) Error() string { return e.msg }
+func (e *peerError) Unwrap() error { return e.kind }
+
 // ------------------------------- xxxxxxx ----------------------------------- //
 
 // ------------- Server Initialization -------------- //
@@ -60,18 +259,77 @@ func NewFileServer(opts FileServerOpts) *FileServer {
 	storeOpts := StoreOpts{
 		Root:              opts.StorageRoot,
 		PathTransformFunc: opts.PathTransformFunc,
+		ContentAddressed:  opts.ContentAddressed,
+		Chunking:          opts.Chunking,
+		Durability:        opts.Durability,
+		Quota:             opts.Quota,
+		Compression:       opts.Compression,
+		Versioning:        opts.Versioning,
+		Retention:         opts.Retention,
 	}
 
 	if len(opts.ID) == 0 {
 		opts.ID = "default"
 	}
 
-	return &FileServer{
+	if opts.RequestTimeout <= 0 {
+		opts.RequestTimeout = defaultRequestTimeout
+	}
+
+	if opts.ScrubRate <= 0 {
+		opts.ScrubRate = defaultScrubRate
+	}
+
+	if opts.ReapInterval == 0 {
+		opts.ReapInterval = defaultReapInterval
+	}
+
+	if opts.TombstoneTTL <= 0 {
+		opts.TombstoneTTL = defaultTombstoneTTL
+	}
+
+	if opts.NodeID == "" && opts.Transport != nil {
+		opts.NodeID = opts.Transport.Addr()
+	}
+
+	store := opts.Storage
+	if store == nil {
+		store = NewLocalStore(storeOpts)
+	}
+
+	s := &FileServer{
 		FileServerOpts: opts,
-		store:          NewStore(storeOpts),
+		store:          store,
 		quitCh:         make(chan struct{}),
+		rebalanceCh:    make(chan struct{}, 1),
 		peers:          make(map[string]p2p.Peer),
+		contacts:       make(map[string]bool),
+		dhtDials:       make(map[string]bool),
+		pending:        make(map[uint64]*waiter),
+	}
+
+	s.conns = p2p.NewConnManager(p2p.ConnManagerOpts{
+		Dial:       func(addr string) error { return s.Transport.Dial(addr) },
+		MinBackoff: opts.RedialBackoff,
+	})
+
+	if opts.DHT {
+		s.dht = p2p.NewDHT(p2p.DHTOpts{
+			Self:    p2p.Contact{ID: opts.NodeID, Addr: opts.Transport.Addr()},
+			Network: s,
+		})
 	}
+
+	if opts.Membership {
+		s.members = p2p.NewMembership(p2p.MembershipOpts{
+			Self:          p2p.Contact{ID: opts.NodeID, Addr: opts.Transport.Addr()},
+			Network:       s,
+			ProbeInterval: opts.ProbeInterval,
+			OnEvent:       s.onMemberEvent,
+		})
+	}
+
+	return s
 }
 
 // ------------------------------- xxxxxxx ----------------------------------- //
@@ -79,12 +337,20 @@ func NewFileServer(opts FileServerOpts) *FileServer {
 // ---------- Methods of FileServer for File Storage and Retrieval ----------- //
 
 /* Index
-1. Get: Get the file from the local disk
-2. Store: Store the file to the local disk
+1. Get: Get the file from the local disk or the network, fetch asks the peers, GetRange a part of it
+2. Store: Store the file to the local disk and replicate it, StoreMeta with metadata
+3. replicate: Stream the encrypted file to every peer and wait for their acks
 */
 
 // 1. Get ---------------------------//
 func (s *FileServer) Get(key string) (io.Reader, error) {
+	return s.GetContext(context.Background(), key)
+}
+
+func (s *FileServer) GetContext(ctx context.Context, key string) (io.Reader, error) {
+	if s.expired(s.ID, key) {
+		return nil, fmt.Errorf("[%s] (%s) expired: %w", s.Transport.Addr(), key, ErrNotFound) // waiting for the reaper
+	}
 	if s.store.Has(s.ID, key) {
 		fmt.Printf("[%s] serving file (%s) from local disk\n", s.Transport.Addr(), key)
 		_, r, err := s.store.Read(s.ID, key)
@@ -93,76 +359,285 @@ func (s *FileServer) Get(key string) (io.Reader, error) {
 
 	fmt.Printf("[%s] don't have file (%s) locally, fetching from network...\n", s.Transport.Addr(), key)
 
-	msg := Message{
-		Payload: MessageGetFile{
-			ID:  s.ID,
-			Key: hashKey(key),
-		},
+	err := s.fetch(ctx, s.ID, hashKey(key), func(from string, body io.Reader, msg MessageGetFileResponse) error {
+		n, err := s.store.WriteDecrypt(s.EncKey, s.ID, key, body, msg.Meta)
+		if err != nil {
+			s.store.Delete(s.ID, key) // don't keep what we decrypted before the data failed to authenticate
+			return err
+		}
+
+		fmt.Printf("[%s] received (%d) bytes over the network from (%s)\n", s.Transport.Addr(), n, from)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("[%s] fetching (%s): %w", s.Transport.Addr(), key, err)
 	}
 
-	if err := s.broadcast(&msg); err != nil {
-		return nil, err
+	_, r, err := s.store.Read(s.ID, key)
+	return r, err
+}
+
+// fetch asks every peer for what they keep under (id, key) and hands the first stream that
+// comes back to keep. When keep fails the next peer's answer gets its turn.
+func (s *FileServer) fetch(ctx context.Context, id string, key string, keep func(from string, body io.Reader, msg MessageGetFileResponse) error) error {
+	return s.ask(ctx, MessageGetFile{ID: id, Key: key}, key, keep)
+}
+
+// ask is fetch for any request the peers answer with a MessageGetFileResponse. The providers
+// the DHT knows of are asked first, then the owners of the file, and the other peers only
+// when none of them could serve it and there is no DHT to tell who else holds it.
+func (s *FileServer) ask(ctx context.Context, req any, key string, keep func(from string, body io.Reader, msg MessageGetFileResponse) error) error {
+	ctx, cancel := s.withDefaultTimeout(ctx)
+	defer cancel()
+
+	id, fileKey := placement(req)
+	providers := s.providers(ctx, id, fileKey)
+	owners, rest := s.splitOwners(id, fileKey)
+	if s.dht != nil {
+		rest = nil
+	}
+	for addr := range providers {
+		delete(owners, addr)
+		delete(rest, addr)
+	}
+	if len(providers)+len(owners)+len(rest) == 0 {
+		return errNoPeers
 	}
 
-	time.Sleep(time.Millisecond * 500)
+	err := ErrNotFound
+	for _, peers := range []map[string]p2p.Peer{providers, owners, rest} {
+		if len(peers) == 0 {
+			continue
+		}
+		if err = s.askPeers(ctx, peers, req, key, keep); !errors.Is(err, ErrNotFound) {
+			return err
+		}
+	}
+	return err
+}
 
-	for _, peer := range s.peers {
+func (s *FileServer) askPeers(ctx context.Context, peers map[string]p2p.Peer, req any, key string, keep func(from string, body io.Reader, msg MessageGetFileResponse) error) error {
+	if len(peers) == 0 {
+		return ErrNotFound
+	}
 
-		var fileSize int64
-		binary.Read(peer, binary.LittleEndian, &fileSize)
+	reqID, w := s.expect(peers, MessageGetFileResponse{})
+	defer s.forget(reqID)
 
-		n, err := s.store.WriteDecrypt(s.EncKey, s.ID, key, io.LimitReader(peer, fileSize))
-		if err != nil {
-			return nil, err
+	msg := Message{
+		RequestID: reqID,
+		Payload:   req,
+	}
+
+	asked := make(map[string]bool)
+	for addr, peer := range peers {
+		if err := s.send(peer, &msg); err != nil {
+			log.Printf("[%s] asking %s for (%s): %v", s.Transport.Addr(), addr, key, err)
+			continue
 		}
+		asked[addr] = true
+	}
 
-		fmt.Printf("[%s] received (%d) bytes over the network from (%s)", s.Transport.Addr(), n, peer.RemoteAddr())
+	// take the first peer that streams the file back, the others are drained by forget
+	for len(asked) > 0 {
+		select {
+		case resp := <-w.ch:
+			if !asked[resp.from] {
+				resp.discard()
+				continue
+			}
+			delete(asked, resp.from)
 
-		peer.Close()
+			v, ok := resp.payload.(MessageGetFileResponse)
+			if !ok {
+				resp.discard()
+				continue
+			}
+			if resp.body == nil {
+				log.Printf("[%s] %s could not serve (%s): %s", s.Transport.Addr(), resp.from, key, v.Err)
+				continue
+			}
+
+			err := keep(resp.from, resp.body, v)
+			resp.discard() // we are done with the stream either way
+			if err != nil {
+				log.Printf("[%s] fetching (%s) from %s: %v", s.Transport.Addr(), key, resp.from, err)
+				continue
+			}
+			return nil
+
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
 
-	_, r, err := s.store.Read(s.ID, key)
-	return r, err
+	return ErrNotFound
+}
+
+// fetchStream is ask for answers that go to the caller as they arrive instead of being kept.
+// open looks at an answer and returns what copies it to w, or why it can't. Once a copy has
+// started its failure is the reader's, when no answer could be opened the last reason is.
+func (s *FileServer) fetchStream(ctx context.Context, req any, key string, open func(body io.Reader, msg MessageGetFileResponse) (func(w io.Writer) (int64, error), error)) (io.Reader, error) {
+	pr, pw := io.Pipe()
+	ready := make(chan error, 1) // nil once the caller can read, otherwise why it can't
+
+	go func() {
+		var (
+			streaming bool
+			refused   error
+		)
+		err := s.ask(ctx, req, key, func(from string, body io.Reader, msg MessageGetFileResponse) error {
+			copyTo, err := open(body, msg)
+			if err != nil {
+				refused = err
+				return err
+			}
+
+			streaming = true
+			ready <- nil
+
+			n, err := copyTo(pw)
+			pw.CloseWithError(err)
+			if err == nil {
+				fmt.Printf("[%s] received (%d) bytes of (%s) over the network from (%s)\n", s.Transport.Addr(), n, key, from)
+			}
+			return nil // the caller has what was written already, the next peer can't take over
+		})
+		if streaming {
+			return
+		}
+
+		if errors.Is(err, ErrNotFound) && refused != nil {
+			err = refused
+		}
+		err = fmt.Errorf("[%s] fetching (%s): %w", s.Transport.Addr(), key, err)
+		pw.CloseWithError(err)
+		ready <- err
+	}()
+
+	if err := <-ready; err != nil {
+		return nil, err
+	}
+	return pr, nil
 }
 
 // 2. Store ---------------------------//
 func (s *FileServer) Store(key string, r io.Reader) error {
-	var (
-		fileBuffer = new(bytes.Buffer)
-		tee        = io.TeeReader(r, fileBuffer)
-	)
+	return s.StoreContext(context.Background(), key, r)
+}
+
+func (s *FileServer) StoreContext(ctx context.Context, key string, r io.Reader) error {
+	return s.StoreMeta(ctx, key, r, Metadata{})
+}
 
-	size, err := s.store.Write(s.ID, key, tee)
+// StoreMeta stores the file with meta, the store fills in what meta leaves out and every
+// replica gets the result
+func (s *FileServer) StoreMeta(ctx context.Context, key string, r io.Reader, meta Metadata) error {
+	if meta.Creator == "" {
+		meta.Creator = s.NodeID
+	}
+
+	info, err := s.store.PutMeta(s.ID, key, r, meta)
 	if err != nil {
 		return err
 	}
 
-	msg := Message{
-		Payload: MessageStoreFile{
-			ID:   s.ID,
-			Key:  hashKey(key),
-			Size: size + 16,
-		},
+	fmt.Printf("[%s] written (%d) bytes to disk as (%s)\n", s.Transport.Addr(), info.Size, info.CID)
+
+	return s.replicateObject(ctx, info, s.replicaPeers(s.ID, hashKey(info.Key)))
+}
+
+// 3. replicate ---------------------------//
+// replicate streams what body writes to peers, e.g. every peer the file goes to. body runs
+// once per peer, and since every run seals with a fresh nonce, each peer acks the digest of
+// the bytes it was sent.
+func (s *FileServer) replicate(ctx context.Context, peers map[string]p2p.Peer, msg MessageStoreFile, body func(w io.Writer) error) error {
+	if len(peers) == 0 {
+		return nil
 	}
 
-	if err := s.broadcast(&msg); err != nil {
-		return err
+	required := s.ReplicationQuorum
+	if required <= 0 || required > len(peers) {
+		required = len(peers)
 	}
 
-	time.Sleep(time.Millisecond * 5)
+	reqID, w := s.expect(peers, MessageStoreAck{})
+	defer s.forget(reqID)
+
+	var (
+		acked    = 0
+		failures = make(map[string]error)
+		digests  = make(map[string]string) // peers we streamed to and have not heard back from, with the digest of what they got
+	)
+
+	for addr, peer := range peers {
+		var (
+			hasher = sha256.New()
+			pr, pw = io.Pipe()
+		)
+		go func() {
+			pw.CloseWithError(body(io.MultiWriter(pw, hasher)))
+		}()
+
+		err := s.sendStream(peer, &Message{RequestID: reqID, Payload: msg}, pr)
+		pr.CloseWithError(err) // stops body if the stream failed half way
+		if err != nil {
+			failures[addr] = err
+			continue
+		}
 
-	peers := []io.Writer{}
-	for _, peer := range s.peers {
-		peers = append(peers, peer)
+		// sendStream read up to the EOF body sent after its last write, so the hash is complete
+		digests[addr] = hex.EncodeToString(hasher.Sum(nil))
 	}
-	mw := io.MultiWriter(peers...)
-	mw.Write([]byte{p2p.IncomingStream})
-	n, err := copyEncrypt(s.EncKey, fileBuffer, mw)
-	if err != nil {
-		return err
+
+	for acked < required && len(digests) > 0 {
+		select {
+		case resp := <-w.ch:
+			digest, ok := digests[resp.from]
+			if !ok {
+				continue
+			}
+			delete(digests, resp.from)
+
+			ack, ok := resp.payload.(MessageStoreAck)
+			switch {
+			case !ok:
+				failures[resp.from] = fmt.Errorf("peer answered with %T instead of an ack", resp.payload)
+				resp.discard()
+			case ack.QuotaExceeded:
+				failures[resp.from] = &peerError{msg: ack.Err, kind: ErrQuotaExceeded}
+			case ack.Err != "":
+				failures[resp.from] = errors.New(ack.Err)
+			case ack.Size != msg.Size:
+				failures[resp.from] = fmt.Errorf("peer wrote %d of %d bytes", ack.Size, msg.Size)
+			case ack.Digest != digest:
+				failures[resp.from] = fmt.Errorf("digest mismatch: want %s got %s", digest, ack.Digest)
+			default:
+				acked++
+			}
+
+		case <-ctx.Done():
+			for addr := range digests {
+				if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+					failures[addr] = errAckTimeout
+				} else {
+					failures[addr] = ctx.Err()
+				}
+			}
+			digests = nil
+		}
 	}
 
-	fmt.Printf("[%s] received and written (%d) bytes to disk\n", s.Transport.Addr(), n)
+	fmt.Printf("[%s] replicated (%s) to %d/%d peers\n", s.Transport.Addr(), msg.Key, acked, len(peers))
+
+	if acked < required {
+		return &ReplicationError{
+			Key:      msg.Key,
+			Required: required,
+			Acked:    acked,
+			Failures: failures,
+		}
+	}
 
 	return nil
 }
@@ -173,20 +648,17 @@ func (s *FileServer) Store(key string, r io.Reader) error {
 
 /* Index
 1. broadcast: Broadcast the message to all the peers
-2. OnPeer: Handle the incoming peer
+2. OnPeer: Handle the incoming peer, OnPeerLost one that went away
 3. bootstrapNetwork: Bootstrap the network
+4. send: Send a message to a single peer, sendNotFound the answer for a file we don't have
+5. sendStream: Open a stream to a peer with a header message followed by a body
+6. peerList: Snapshot of the connected peers, networkPeers of the ones files go to
 */
 
 // 1. broadcast ---------------------------//
 func (s *FileServer) broadcast(msg *Message) error {
-	buf := new(bytes.Buffer)
-	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
-		return err
-	}
-
-	for _, peer := range s.peers {
-		peer.Send([]byte{p2p.IncomingMessage})
-		if err := peer.Send(buf.Bytes()); err != nil {
+	for _, peer := range s.networkPeers() {
+		if err := s.send(peer, msg); err != nil {
 			return err
 		}
 	}
@@ -199,31 +671,302 @@ func (s *FileServer) OnPeer(p p2p.Peer) error {
 	s.peerLock.Lock()
 	defer s.peerLock.Unlock()
 
-	s.peers[p.RemoteAddr().String()] = p
+	// both sides may dial each other at the same time, one connection per identity is enough
+	if _, ok := s.peers[p.ID()]; ok {
+		return fmt.Errorf("already connected with %s", p.ID())
+	}
 
-	log.Printf("connected with remote %s", p.RemoteAddr())
+	s.peers[p.ID()] = p
+	for _, addr := range p2p.PeerAddrs(p) {
+		s.conns.Connected(addr, p.ID())
+	}
+
+	contact := s.dhtDials[p.DialAddr()]
+	delete(s.dhtDials, p.DialAddr())
+	if contact {
+		s.contacts[p.ID()] = true
+	} else {
+		s.ring.add(p.ID())
+		s.rebalanceSoon()
+	}
+
+	if s.dht != nil {
+		first := len(s.dht.Closest(p2p.NodeIDOf(s.NodeID), 1)) == 0
+		s.dht.Update(p2p.Contact{ID: p.ID(), Addr: p.ListenAddr()})
+		if first {
+			go s.joinDHT()
+		}
+	}
+
+	if s.members != nil && !contact {
+		go s.members.Join(p2p.Contact{ID: p.ID(), Addr: p.ListenAddr()}) // its events take peerLock
+	}
+
+	log.Printf("connected with remote %s (%s)", p.RemoteAddr(), p.ID())
 
 	return nil
 }
 
+// OnPeerLost forgets a peer whose connection went away
+func (s *FileServer) OnPeerLost(p p2p.Peer) {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	if s.peers[p.ID()] != p {
+		return // a connection that lost the race to the one we kept
+	}
+	delete(s.peers, p.ID())
+	delete(s.contacts, p.ID())
+	s.ring.remove(p.ID())
+	s.rebalanceSoon()
+	for _, addr := range p2p.PeerAddrs(p) {
+		s.conns.Disconnected(addr)
+	}
+
+	log.Printf("lost remote %s (%s)", p.RemoteAddr(), p.ID())
+}
+
 // 3. bootstrapNetwork ---------------------------//
+// bootstrapNetwork hands the BootstrapNodes to the connection manager, which dials them
+// until they are connected and again whenever they disconnect
 func (s *FileServer) bootstrapNetwork() error {
 	for _, addr := range s.BootstrapNodes {
 		if len(addr) == 0 {
 			continue
 		}
 
-		go func(addr string) {
-			fmt.Printf("[%s] attempting to connect with remote %s\n", s.Transport.Addr(), addr)
-			if err := s.Transport.Dial(addr); err != nil {
-				log.Println("dial error: ", err)
-			}
-		}(addr)
+		fmt.Printf("[%s] attempting to connect with remote %s\n", s.Transport.Addr(), addr)
+		s.conns.Add(addr)
 	}
 
+	go s.connectionLoop()
+
 	return nil
 }
 
+// 4. send ---------------------------//
+func (s *FileServer) send(peer p2p.Peer, msg *Message) error {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
+		return err
+	}
+
+	return peer.Send(buf.Bytes())
+}
+
+func (s *FileServer) sendNotFound(peer p2p.Peer, reqID uint64, id string, key string) error {
+	notFound := Message{
+		RequestID: reqID,
+		Payload: MessageGetFileResponse{
+			ID:  id,
+			Key: key,
+			Err: ErrNotFound.Error(),
+		},
+	}
+	return s.send(peer, &notFound)
+}
+
+// 5. sendStream ---------------------------//
+// Every stream starts with a length prefixed gob header followed by the raw body. The
+// header tells the receiving side what the stream is for and how many bytes it carries.
+func (s *FileServer) sendStream(peer p2p.Peer, msg *Message, body io.Reader) error {
+	header := new(bytes.Buffer)
+	binary.Write(header, binary.LittleEndian, uint32(0)) // patched below once the size is known
+	if err := gob.NewEncoder(header).Encode(msg); err != nil {
+		return err
+	}
+	binary.LittleEndian.PutUint32(header.Bytes(), uint32(header.Len()-4))
+
+	stream, err := peer.OpenStream()
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	if _, err := stream.Write(header.Bytes()); err != nil {
+		return err
+	}
+
+	_, err = io.Copy(stream, body)
+	return err
+}
+
+func readStreamHeader(r io.Reader) (*Message, error) {
+	var size uint32
+	if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+		return nil, err
+	}
+	if size > maxStreamHeaderSize {
+		return nil, fmt.Errorf("stream header of %d bytes exceeds the %d byte limit", size, maxStreamHeaderSize)
+	}
+
+	header := make([]byte, size)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	var msg Message
+	if err := gob.NewDecoder(bytes.NewReader(header)).Decode(&msg); err != nil {
+		return nil, err
+	}
+
+	return &msg, nil
+}
+
+// resetStream abandons a stream on both sides, so the remote stops writing to it, streams
+// that can't be reset are closed
+func resetStream(stream io.Closer) {
+	if st, ok := stream.(interface{ Reset() error }); ok {
+		st.Reset()
+		return
+	}
+	stream.Close()
+}
+
+// bodyReader reads exactly the Size a stream header announced, a stream that ends early is an
+// error rather than a shorter file, so the store never commits a partial body
+func bodyReader(stream io.Reader, size int64) io.Reader {
+	return &sizedBody{stream: stream, size: size, remaining: size}
+}
+
+type sizedBody struct {
+	stream    io.Reader
+	size      int64
+	remaining int64
+}
+
+func (b *sizedBody) Read(p []byte) (int, error) {
+	if b.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+
+	n, err := b.stream.Read(p)
+	b.remaining -= int64(n)
+
+	if err == io.EOF && b.remaining > 0 {
+		return n, fmt.Errorf("stream ended %d bytes short of the announced %d: %w", b.remaining, b.size, io.ErrUnexpectedEOF)
+	}
+	if err == io.EOF {
+		return n, nil // the body is complete, the next Read reports EOF
+	}
+	return n, err
+}
+
+// 6. peerList ---------------------------//
+func (s *FileServer) peerList() map[string]p2p.Peer {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	peers := make(map[string]p2p.Peer, len(s.peers))
+	for addr, peer := range s.peers {
+		peers[addr] = peer
+	}
+	return peers
+}
+
+// networkPeers leaves out the contacts of the DHT, a lookup connects with them but they don't
+// become part of the network files and broadcasts are sent to
+func (s *FileServer) networkPeers() map[string]p2p.Peer {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	peers := make(map[string]p2p.Peer, len(s.peers))
+	for addr, peer := range s.peers {
+		if !s.contacts[addr] {
+			peers[addr] = peer
+		}
+	}
+	return peers
+}
+
+// ------------------------------- xxxxxxx ----------------------------------- //
+
+// --------- Methods of FileServer for Waiting on Responses from Peers -------- //
+
+/* Index
+1. expect: Allocate a request ID and a waiter for the responses of the peers to it
+2. forget: Remove the waiter once the caller is done and release what it never read
+3. deliver: Hand a response to its waiter, reports false if nobody is waiting for it
+4. withDefaultTimeout: Apply RequestTimeout to contexts without a deadline
+*/
+
+// 1. expect ---------------------------//
+// expect waits for one answer from each of peers, of the type of want
+func (s *FileServer) expect(peers map[string]p2p.Peer, want any) (uint64, *waiter) {
+	reqID := s.nextReqID.Add(1)
+	w := &waiter{
+		ch:    make(chan response, len(peers)),
+		peers: make(map[string]bool, len(peers)),
+		want:  reflect.TypeOf(want),
+	}
+	for id := range peers {
+		w.peers[id] = true
+	}
+
+	s.pendingLock.Lock()
+	s.pending[reqID] = w
+	s.pendingLock.Unlock()
+
+	return reqID, w
+}
+
+// 2. forget ---------------------------//
+func (s *FileServer) forget(reqID uint64) {
+	s.pendingLock.Lock()
+	w, ok := s.pending[reqID]
+	delete(s.pending, reqID)
+	s.pendingLock.Unlock()
+
+	if !ok {
+		return
+	}
+
+	// nothing can be delivered anymore, so whatever is buffered is ours to release
+	for {
+		select {
+		case resp := <-w.ch:
+			resp.discard()
+		default:
+			return
+		}
+	}
+}
+
+// 3. deliver ---------------------------//
+// deliver only hands over the first answer of a peer that was asked, and only when it is of
+// the type the request is answered with, whatever else a peer sends under the ID is dropped
+func (s *FileServer) deliver(reqID uint64, resp response) bool {
+	s.pendingLock.Lock()
+	defer s.pendingLock.Unlock()
+
+	w, ok := s.pending[reqID]
+	if !ok {
+		return false
+	}
+	if !w.peers[resp.from] || reflect.TypeOf(resp.payload) != w.want {
+		return false
+	}
+
+	select {
+	case w.ch <- resp:
+		delete(w.peers, resp.from)
+		return true
+	default:
+		return false
+	}
+}
+
+// 4. withDefaultTimeout ---------------------------//
+func (s *FileServer) withDefaultTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, s.RequestTimeout)
+}
+
 // ------------------------------- xxxxxxx ----------------------------------- //
 
 // ------- Methods of FileServer for Starting and Stopping the Server -------- //
@@ -244,6 +987,20 @@ func (s *FileServer) Start() error {
 
 	s.bootstrapNetwork()
 
+	if s.ScrubInterval > 0 {
+		go s.scrubLoop()
+	}
+
+	if s.ReapInterval > 0 {
+		go s.reapLoop()
+	}
+
+	if s.members != nil {
+		go s.membershipLoop()
+	}
+
+	go s.rebalanceLoop()
+
 	s.loop()
 
 	return nil
@@ -259,9 +1016,15 @@ func (s *FileServer) loop() {
 	for {
 		select {
 		case rpc := <-s.Transport.Consume():
+			if rpc.Stream {
+				go s.handleStream(rpc.From, rpc.Conn)
+				continue
+			}
+
 			var msg Message
 			if err := gob.NewDecoder(bytes.NewReader(rpc.Payload)).Decode(&msg); err != nil {
 				log.Println("decoding error: ", err)
+				continue
 			}
 			if err := s.handleMessage(rpc.From, &msg); err != nil {
 				log.Println("handle message error: ", err)
@@ -275,7 +1038,14 @@ func (s *FileServer) loop() {
 
 // 2. Stop ---------------------------//
 func (s *FileServer) Stop() {
-	close(s.quitCh)
+	s.stopOnce.Do(func() {
+		if s.members != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), s.members.ProbeTimeout)
+			s.members.Leave(ctx)
+			cancel()
+		}
+		close(s.quitCh)
+	})
 }
 
 // ------------------------------- xxxxxxx ----------------------------------- //
@@ -285,73 +1055,210 @@ func (s *FileServer) Stop() {
 /* Index
 1. handleMessage: Handle the incoming message
 2. handleMessageGetFile: Handle the incoming message to get the file
-3. handleMessageStoreFile: Handle the incoming message to store the file
+3. handleMessageStoreFile: Handle the incoming stream to store the file
+4. handleStream: Read the header of an incoming stream and dispatch it
+5. handleMessageGetFileResponse: Hand the incoming file stream to the waiting Get
 */
 
 // 1. handleMessage ---------------------------//
 func (s *FileServer) handleMessage(from string, msg *Message) error {
 	switch v := msg.Payload.(type) {
-	case MessageStoreFile:
-		return s.handleMessageStoreFile(from, v)
 	case MessageGetFile:
-		return s.handleMessageGetFile(from, v)
+		// served in the background so one slow transfer does not hold up every other message
+		go func() {
+			if err := s.handleMessageGetFile(from, msg.RequestID, v); err != nil {
+				log.Println("handle message error: ", err)
+			}
+		}()
+	case MessageGetRange:
+		go func() {
+			if err := s.handleMessageGetRange(from, msg.RequestID, v); err != nil {
+				log.Println("handle message error: ", err)
+			}
+		}()
+	case MessageDHTRequest:
+		go func() {
+			if err := s.handleMessageDHTRequest(from, msg.RequestID, v); err != nil {
+				log.Println("handle message error: ", err)
+			}
+		}()
+	case MessageDHTResponse:
+		s.deliver(msg.RequestID, response{from: from, payload: v})
+	case MessageSWIM:
+		go func() {
+			if err := s.handleMessageSWIM(from, msg.RequestID, v); err != nil {
+				log.Println("handle message error: ", err)
+			}
+		}()
+	case MessageSWIMAck:
+		s.deliver(msg.RequestID, response{from: from, payload: v})
+	case MessageHasFile:
+		go func() {
+			if err := s.handleMessageHasFile(from, msg.RequestID, v); err != nil {
+				log.Println("handle message error: ", err)
+			}
+		}()
+	case MessageHasFileResponse:
+		s.deliver(msg.RequestID, response{from: from, payload: v})
+	case MessageDeleteFile:
+		go func() {
+			if err := s.handleMessageDeleteFile(from, msg.RequestID, v); err != nil {
+				log.Println("handle message error: ", err)
+			}
+		}()
+	case MessageGetFileResponse:
+		s.deliver(msg.RequestID, response{from: from, payload: v})
+	case MessageStoreAck:
+		if !s.deliver(msg.RequestID, response{from: from, payload: v}) {
+			return fmt.Errorf("[%s] dropping late or unexpected ack for (%s) from %s", s.Transport.Addr(), v.Key, from)
+		}
+	case MessageDeleteAck:
+		if !s.deliver(msg.RequestID, response{from: from, payload: v}) {
+			return fmt.Errorf("[%s] dropping late or unexpected delete ack for (%s) from %s", s.Transport.Addr(), v.Key, from)
+		}
 	}
 
 	return nil
 }
 
 // 2. handleMessageGetFile ---------------------------//
-func (s *FileServer) handleMessageGetFile(from string, msg MessageGetFile) error {
-	if !s.store.Has(msg.ID, msg.Key) {
-		return fmt.Errorf("[%s] need to serve file (%s) but it does not exist on disk", s.Transport.Addr(), msg.Key)
+func (s *FileServer) handleMessageGetFile(from string, reqID uint64, msg MessageGetFile) error {
+	peer, ok := s.peerList()[from]
+	if !ok {
+		return fmt.Errorf("peer %s not in map", from)
 	}
 
-	fmt.Printf("[%s] serving file (%s) over the network\n", s.Transport.Addr(), msg.Key)
-
-	fileSize, r, err := s.store.Read(msg.ID, msg.Key)
+	var (
+		info     ObjectInfo
+		fileSize int64
+		r        io.Reader
+		err      error
+	)
+	if msg.Version == "" {
+		if !s.store.Has(msg.ID, msg.Key) || s.expired(msg.ID, msg.Key) {
+			// answer anyway so the requester does not wait on us until its deadline
+			return s.sendNotFound(peer, reqID, msg.ID, msg.Key)
+		}
+		if info, err = s.store.Stat(msg.ID, msg.Key); err != nil {
+			return err
+		}
+		fileSize, r, err = s.store.ReadStored(msg.ID, msg.Key)
+	} else {
+		info, err = s.statVersion(msg.ID, msg.Key, msg.Version)
+		if errors.Is(err, fs.ErrNotExist) {
+			return s.sendNotFound(peer, reqID, msg.ID, msg.Key)
+		}
+		if err != nil {
+			return err
+		}
+		fileSize, r, err = s.store.ReadVersion(msg.ID, msg.Key, msg.Version)
+	}
 	if err != nil {
 		return err
 	}
 
+	fmt.Printf("[%s] serving file (%s) over the network\n", s.Transport.Addr(), msg.Key)
+
 	if rc, ok := r.(io.ReadCloser); ok {
-		fmt.Println("closing readCloser")
 		defer rc.Close()
 	}
 
-	peer, ok := s.peers[from]
-	if !ok {
-		return fmt.Errorf("peer %s not in map", from)
+	resp := Message{
+		RequestID: reqID,
+		Payload: MessageGetFileResponse{
+			ID:   msg.ID,
+			Key:  msg.Key,
+			Size: fileSize,
+			Meta: info.Meta,
+		},
 	}
 
-	peer.Send([]byte{p2p.IncomingStream})
-	binary.Write(peer, binary.LittleEndian, fileSize)
-	n, err := io.Copy(peer, r) // copies content from r to peer until EOF
-	if err != nil {
+	if err := s.sendStream(peer, &resp, io.LimitReader(r, fileSize)); err != nil {
 		return err
 	}
 
-	fmt.Printf("[%s] written (%d) bytes over the network to %s\n", s.Transport.Addr(), n, from)
+	fmt.Printf("[%s] written (%d) bytes over the network to %s\n", s.Transport.Addr(), fileSize, from)
 
 	return nil
 }
 
 // 3. handleMessageStoreFile ---------------------------//
-func (s *FileServer) handleMessageStoreFile(from string, msg MessageStoreFile) error {
-	peer, ok := s.peers[from]
+func (s *FileServer) handleMessageStoreFile(from string, peer p2p.Peer, stream io.ReadCloser, reqID uint64, msg MessageStoreFile) error {
+	// refuse what won't fit before reading any of it, the Size is the peer's word but the
+	// store enforces the quota on the bytes that actually arrive as well
+	if err := s.store.CheckQuota(msg.ID, msg.Key, msg.Size); err != nil {
+		resetStream(stream) // stop the sender, rather than let it push the body we refuse
+		ack := MessageStoreAck{ID: msg.ID, Key: msg.Key, Err: err.Error(), QuotaExceeded: errors.Is(err, ErrQuotaExceeded)}
+		return s.send(peer, &Message{RequestID: reqID, Payload: ack})
+	}
+
+	hasher := sha256.New()
+
+	info, err := s.store.PutMeta(msg.ID, msg.Key, io.TeeReader(bodyReader(stream, msg.Size), hasher), msg.Meta)
+	stream.Close()
+
+	ack := MessageStoreAck{
+		ID:     msg.ID,
+		Key:    msg.Key,
+		Size:   info.Size,
+		Digest: hex.EncodeToString(hasher.Sum(nil)),
+	}
+	if err != nil {
+		ack.Err = err.Error()
+		ack.QuotaExceeded = errors.Is(err, ErrQuotaExceeded)
+	} else {
+		fmt.Printf("[%s] written %d bytes to disk\n", s.Transport.Addr(), info.Size)
+		go s.provide(msg.ID, msg.Key)
+	}
+
+	return s.send(peer, &Message{RequestID: reqID, Payload: ack})
+}
+
+// 4. handleStream ---------------------------//
+// Every path through here must either close the stream or hand it to someone who will.
+func (s *FileServer) handleStream(from string, stream io.ReadWriteCloser) {
+	peer, ok := s.peerList()[from]
 	if !ok {
-		return fmt.Errorf("peer (%s) could not be found in the peer list", from)
+		log.Printf("stream from unknown peer %s", from)
+		stream.Close()
+		return
 	}
 
-	n, err := s.store.Write(msg.ID, msg.Key, io.LimitReader(peer, msg.Size))
+	msg, err := readStreamHeader(stream)
 	if err != nil {
-		return err
+		log.Println("stream header error: ", err)
+		stream.Close()
+		return
 	}
 
-	fmt.Printf("[%s] written %d bytes to disk\n", s.Transport.Addr(), n)
+	switch v := msg.Payload.(type) {
+	case MessageStoreFile:
+		err = s.handleMessageStoreFile(from, peer, stream, msg.RequestID, v)
+	case MessageGetFileResponse:
+		s.handleMessageGetFileResponse(from, stream, msg.RequestID, v)
+	default:
+		err = fmt.Errorf("unexpected stream header %T from %s", msg.Payload, from)
+		stream.Close()
+	}
+
+	if err != nil {
+		log.Println("handle stream error: ", err)
+	}
+}
 
-	peer.Close()
+// 5. handleMessageGetFileResponse ---------------------------//
+func (s *FileServer) handleMessageGetFileResponse(from string, stream io.ReadCloser, reqID uint64, msg MessageGetFileResponse) {
+	resp := response{
+		from:    from,
+		stream:  stream,
+		body:    bodyReader(stream, msg.Size),
+		payload: msg,
+	}
 
-	return nil
+	// the waiting Get reads the body and closes the stream, or forget drains it
+	if !s.deliver(reqID, resp) {
+		resp.discard()
+	}
 }
 
 // ------------------------------- xxxxxxx ----------------------------------- //
@@ -359,7 +1266,18 @@ func (s *FileServer) handleMessageStoreFile(from string, msg MessageStoreFile) e
 // ---------------------- Registering the Message Types ---------------------- //
 func init() {
 	gob.Register(MessageStoreFile{})
+	gob.Register(MessageStoreAck{})
 	gob.Register(MessageGetFile{})
+	gob.Register(MessageGetRange{})
+	gob.Register(MessageGetFileResponse{})
+	gob.Register(MessageDeleteFile{})
+	gob.Register(MessageDeleteAck{})
+	gob.Register(MessageDHTRequest{})
+	gob.Register(MessageDHTResponse{})
+	gob.Register(MessageSWIM{})
+	gob.Register(MessageSWIMAck{})
+	gob.Register(MessageHasFile{})
+	gob.Register(MessageHasFileResponse{})
 }
 
 // ------------------------------- xxxxxxx ----------------------------------- //
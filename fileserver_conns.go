@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+
+	"github.com/MonalBarse/NimbusFS/p2p"
+)
+
+/*
+The BootstrapNodes are kept connected by a connection manager (p2p/conn_manager.go) rather
+than dialed once, so a node started before its peers joins them once they are up, and one
+that loses a bootstrap node gets it back when it returns. A dial that fails or whose
+handshake doesn't finish is tried again after a jittered backoff, RedialBackoff at first and
+doubling up to 30s, and a bootstrap node that disconnects, or that the membership dropped,
+is redialed the same way.
+
+OnPeer and OnPeerLost tell the manager about the connections, matched by the address the
+peer was dialed at and the one it listens on (p2p.PeerAddrs), so a bootstrap node given as
+"127.0.0.1:3000" that announces ":3000", or that dialed us first, counts as connected too.
+Connections tells where every bootstrap node stands.
+*/
+
+// ------------------------------ XXXXXXXXXXXXXXX---------------------------------------- //
+// ---------------------------- Connection Methods -------------------------------------- //
+
+/* Index
+1. Connections: Where the connections with the bootstrap nodes stand
+2. connectionLoop: Keep the bootstrap nodes connected until the server stops
+*/
+
+// 1. Connections ---------------------------//
+func (s *FileServer) Connections() []p2p.ConnStatus {
+	return s.conns.Status()
+}
+
+// 2. connectionLoop ---------------------------//
+func (s *FileServer) connectionLoop() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-s.quitCh
+		cancel()
+	}()
+
+	s.conns.Run(ctx)
+}
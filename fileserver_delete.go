@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+/*
+Delete removes a file from the network, not just from the local disk, where Get would fetch
+it back from a replica. The owner buries the key under a new version ID, made now, and sends
+that version to every peer in a MessageDeleteFile, which bury their replica under it too.
+
+The tombstones (store_tombstones.go) cover every version up to the delete, so a replica that
+was away and comes back with the file, a repair or a Get can't write it back anywhere that
+heard of the delete. A peer that missed the delete still holds the file, and still serves
+it, until it is deleted again. Tombstones go after FileServerOpts.TombstoneTTL, on the
+reaper's passes (reaper.go), so that should be longer than any node stays away.
+*/
+
+// ------------------------------ XXXXXXXXXXXXXXX---------------------------------------- //
+// ------------------------------- Delete Methods --------------------------------------- //
+
+/* Index
+1. Delete: Delete the file locally and on every peer, and keep it from coming back
+2. handleMessageDeleteFile: Bury the replica a peer deleted
+*/
+
+// 1. Delete ---------------------------//
+// Delete waits for ReplicationQuorum peers to ack like Store does, the local copy is gone
+// whatever they answer
+func (s *FileServer) Delete(ctx context.Context, key string) error {
+	version := newVersionID()
+	if err := s.store.Bury(s.ID, key, version); err != nil {
+		return err
+	}
+
+	fmt.Printf("[%s] deleted (%s) locally, deleting it on the network...\n", s.Transport.Addr(), key)
+
+	ctx, cancel := s.withDefaultTimeout(ctx)
+	defer cancel()
+
+	peers := s.networkPeers()
+	if len(peers) == 0 {
+		return nil
+	}
+
+	required := s.ReplicationQuorum
+	if required <= 0 || required > len(peers) {
+		required = len(peers)
+	}
+
+	reqID, w := s.expect(peers, MessageDeleteAck{})
+	defer s.forget(reqID)
+
+	msg := Message{
+		RequestID: reqID,
+		Payload:   MessageDeleteFile{ID: s.ID, Key: hashKey(key), Version: version},
+	}
+
+	var (
+		acked    = 0
+		failures = make(map[string]error)
+		waiting  = make(map[string]bool)
+	)
+	for addr, peer := range peers {
+		if err := s.send(peer, &msg); err != nil {
+			failures[addr] = err
+			continue
+		}
+		waiting[addr] = true
+	}
+
+	for acked < required && len(waiting) > 0 {
+		select {
+		case resp := <-w.ch:
+			if !waiting[resp.from] {
+				continue
+			}
+			delete(waiting, resp.from)
+
+			ack, ok := resp.payload.(MessageDeleteAck)
+			switch {
+			case !ok:
+				failures[resp.from] = fmt.Errorf("peer answered with %T instead of a delete ack", resp.payload)
+				resp.discard()
+			case ack.Err != "":
+				failures[resp.from] = errors.New(ack.Err)
+			default:
+				acked++
+			}
+
+		case <-ctx.Done():
+			for addr := range waiting {
+				if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+					failures[addr] = errAckTimeout
+				} else {
+					failures[addr] = ctx.Err()
+				}
+			}
+			waiting = nil
+		}
+	}
+
+	fmt.Printf("[%s] deleted (%s) on %d/%d peers\n", s.Transport.Addr(), key, acked, len(peers))
+
+	if acked < required {
+		return &ReplicationError{
+			Key:      hashKey(key),
+			Required: required,
+			Acked:    acked,
+			Failures: failures,
+		}
+	}
+	return nil
+}
+
+// 2. handleMessageDeleteFile ---------------------------//
+func (s *FileServer) handleMessageDeleteFile(from string, reqID uint64, msg MessageDeleteFile) error {
+	peer, ok := s.peerList()[from]
+	if !ok {
+		return fmt.Errorf("peer %s not in map", from)
+	}
+
+	ack := MessageDeleteAck{ID: msg.ID, Key: msg.Key}
+	if err := s.store.Bury(msg.ID, msg.Key, msg.Version); err != nil {
+		ack.Err = err.Error()
+	} else {
+		fmt.Printf("[%s] deleted (%s) for %s\n", s.Transport.Addr(), msg.Key, from)
+	}
+
+	return s.send(peer, &Message{RequestID: reqID, Payload: ack})
+}
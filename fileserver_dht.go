@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/MonalBarse/NimbusFS/p2p"
+)
+
+/*
+With FileServerOpts.DHT set the server joins a Kademlia DHT (p2p/dht.go) over the nodes of
+the network, which finds nodes beyond the BootstrapNodes and tells who holds a file without
+asking everyone:
+
+  - every peer the server connects with goes into the routing table, and the first one
+    starts a lookup of the node itself, which connects it with the nodes close to it
+  - a replica the server stores is provided under its ID and key
+  - Get looks the providers of the file up before it asks the owners and the other peers,
+    see ask in fileserver.go
+
+The DHT's requests travel as MessageDHTRequest and MessageDHTResponse. A contact the server
+isn't connected with is dialed at its listen address, and the connection is kept for later
+lookups, but the contact doesn't become a peer of the network: it is left out of the ring,
+the replicas and the broadcasts, and with the providers to ask Get doesn't fall back on
+every peer. So a node only sends files to the peers it was meant to, however many nodes its
+lookups touched. A contact that connects with us, or that the membership joins, is a peer.
+*/
+
+const dhtDialPoll = 10 * time.Millisecond
+
+// ------------------------------ XXXXXXXXXXXXXXX---------------------------------------- //
+// -------------------------------- DHT Methods ----------------------------------------- //
+
+/* Index
+1. CallDHT: Send a DHT request to a node and wait for its answer, for p2p.DHT
+2. providers: The connected peers that provide a file, dialing the ones we aren't connected with
+3. provide: Announce a replica we hold
+4. handleMessageDHTRequest: Answer a DHT request from a peer
+5. connect: The peer with a contact's identity, dialed when there is none yet, call asks it one thing,
+   promote makes a contact a peer
+6. joinDHT: Look the node itself up once it has a first contact
+*/
+
+// 1. CallDHT ---------------------------//
+func (s *FileServer) CallDHT(ctx context.Context, to p2p.Contact, req p2p.DHTRequest) (p2p.DHTResponse, error) {
+	resp, err := s.call(ctx, to, true, MessageDHTRequest{Req: req}, MessageDHTResponse{})
+	if err != nil {
+		return p2p.DHTResponse{}, fmt.Errorf("dht request to %s: %w", to.ID, err)
+	}
+	v, ok := resp.(MessageDHTResponse)
+	if !ok {
+		return p2p.DHTResponse{}, fmt.Errorf("dht request to %s answered with %T", to.ID, resp)
+	}
+	return v.Resp, nil
+}
+
+// 2. providers ---------------------------//
+func (s *FileServer) providers(ctx context.Context, id string, key string) map[string]p2p.Peer {
+	peers := make(map[string]p2p.Peer)
+	if s.dht == nil {
+		return peers
+	}
+
+	contacts, err := s.dht.FindProviders(ctx, id+"/"+key)
+	if err != nil {
+		fmt.Printf("[%s] looking up providers of (%s): %v\n", s.Transport.Addr(), key, err)
+	}
+	for _, c := range contacts {
+		if c.ID == s.NodeID {
+			continue // a record we left, for a replica we no longer have or we wouldn't ask
+		}
+		peer, err := s.connect(ctx, c, true)
+		if err != nil {
+			fmt.Printf("[%s] connecting with provider %s of (%s): %v\n", s.Transport.Addr(), c.Addr, key, err)
+			continue
+		}
+		peers[c.ID] = peer
+	}
+	return peers
+}
+
+// 3. provide ---------------------------//
+func (s *FileServer) provide(id string, key string) {
+	if s.dht == nil {
+		return
+	}
+
+	ctx, cancel := s.withDefaultTimeout(context.Background())
+	defer cancel()
+	if err := s.dht.Provide(ctx, id+"/"+key); err != nil {
+		fmt.Printf("[%s] providing (%s): %v\n", s.Transport.Addr(), key, err)
+	}
+}
+
+// 4. handleMessageDHTRequest ---------------------------//
+func (s *FileServer) handleMessageDHTRequest(from string, reqID uint64, msg MessageDHTRequest) error {
+	peer, ok := s.peerList()[from]
+	if !ok {
+		return fmt.Errorf("peer %s not in map", from)
+	}
+	if s.dht == nil {
+		return s.send(peer, &Message{RequestID: reqID, Payload: MessageDHTResponse{}})
+	}
+
+	// the sender is who the connection authenticated, not who the request says
+	msg.Req.Sender = p2p.Contact{ID: from, Addr: peer.ListenAddr()}
+	resp := s.dht.HandleRequest(msg.Req)
+
+	return s.send(peer, &Message{RequestID: reqID, Payload: MessageDHTResponse{Resp: resp}})
+}
+
+// 5. connect ---------------------------//
+// connect waits for the handshake of a dial to finish, until ctx is done. A contact only
+// answers the DHT, one that is connected with as a peer becomes part of the network.
+func (s *FileServer) connect(ctx context.Context, c p2p.Contact, contact bool) (p2p.Peer, error) {
+	if peer, ok := s.peerList()[c.ID]; ok {
+		if !contact {
+			s.promote(c.ID)
+		}
+		return peer, nil
+	}
+	if c.Addr == "" {
+		return nil, fmt.Errorf("no address to dial %s", c.ID)
+	}
+
+	if contact {
+		s.peerLock.Lock()
+		s.dhtDials[c.Addr] = true
+		s.peerLock.Unlock()
+
+		defer func() {
+			s.peerLock.Lock()
+			delete(s.dhtDials, c.Addr) // OnPeer took it already when the dial came up
+			s.peerLock.Unlock()
+		}()
+	}
+
+	if err := s.Transport.Dial(c.Addr); err != nil {
+		return nil, err
+	}
+
+	ticker := time.NewTicker(dhtDialPoll)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if peer, ok := s.peerList()[c.ID]; ok {
+				if !contact {
+					s.promote(c.ID)
+				}
+				return peer, nil
+			}
+		case <-ctx.Done():
+			return nil, fmt.Errorf("connecting with %s at %s: %w", c.ID, c.Addr, ctx.Err())
+		}
+	}
+}
+
+// promote makes a contact of the DHT a peer like the others, one that files go to
+func (s *FileServer) promote(id string) {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	if _, ok := s.peers[id]; ok && s.contacts[id] {
+		delete(s.contacts, id)
+		s.ring.add(id)
+		s.rebalanceSoon()
+	}
+}
+
+// call sends req to the node at to and waits for its answer, a message of the type of want.
+// contact is as for connect.
+func (s *FileServer) call(ctx context.Context, to p2p.Contact, contact bool, req any, want any) (any, error) {
+	ctx, cancel := s.withDefaultTimeout(ctx)
+	defer cancel()
+
+	peer, err := s.connect(ctx, to, contact)
+	if err != nil {
+		return nil, err
+	}
+
+	reqID, w := s.expect(map[string]p2p.Peer{to.ID: peer}, want)
+	defer s.forget(reqID)
+
+	if err := s.send(peer, &Message{RequestID: reqID, Payload: req}); err != nil {
+		return nil, err
+	}
+
+	select {
+	case resp := <-w.ch:
+		// deliver checks this too, an answer from anyone else would poison what we learn
+		if resp.from != to.ID {
+			resp.discard()
+			return nil, fmt.Errorf("answer from %s instead of %s", resp.from, to.ID)
+		}
+		return resp.payload, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// 6. joinDHT ---------------------------//
+func (s *FileServer) joinDHT() {
+	ctx, cancel := s.withDefaultTimeout(context.Background())
+	defer cancel()
+
+	if err := s.dht.Bootstrap(ctx); err != nil {
+		fmt.Printf("[%s] joining the dht: %v\n", s.Transport.Addr(), err)
+		return
+	}
+	fmt.Printf("[%s] joined the dht, %d peers connected\n", s.Transport.Addr(), len(s.peerList()))
+}
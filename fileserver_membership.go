@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/MonalBarse/NimbusFS/p2p"
+)
+
+/*
+With FileServerOpts.Membership set the server keeps its peers by the view of a SWIM
+membership protocol (p2p/swim.go) instead of by its connections alone. Every peer it
+connects with joins the view, and the events of the view change the peer set:
+
+  - a member that joins, e.g. one another member gossiped about, is connected with
+  - a member that fails or leaves is dropped from the peers, the ring and the DHT, and its
+    connection closed, even when a connection that isn't dead yet would have kept it
+
+A connection lost on its own only drops the peer, as without Membership, the member stays
+in the view until the probes say otherwise, and a probe reconnects with it if it can. Stop
+tells the members the node leaves. The pings, ping-reqs and acks travel as MessageSWIM and
+MessageSWIMAck.
+*/
+
+// ------------------------------ XXXXXXXXXXXXXXX---------------------------------------- //
+// ----------------------------- Membership Methods ------------------------------------- //
+
+/* Index
+1. Members: The nodes in the membership view
+2. CallSWIM: Send a SWIM message to a node and wait for its ack, for p2p.Membership
+3. handleMessageSWIM: Answer a SWIM message from a peer
+4. onMemberEvent: Change the peer set as the view changes
+5. membershipLoop: Probe the members until the server stops
+*/
+
+// 1. Members ---------------------------//
+// Members is nil without FileServerOpts.Membership
+func (s *FileServer) Members() []p2p.Member {
+	if s.members == nil {
+		return nil
+	}
+	return s.members.Members()
+}
+
+// 2. CallSWIM ---------------------------//
+func (s *FileServer) CallSWIM(ctx context.Context, to p2p.Contact, msg p2p.SWIMMessage) (p2p.SWIMMessage, error) {
+	resp, err := s.call(ctx, to, false, MessageSWIM{Msg: msg}, MessageSWIMAck{})
+	if err != nil {
+		return p2p.SWIMMessage{}, err
+	}
+
+	ack, ok := resp.(MessageSWIMAck)
+	if !ok {
+		return p2p.SWIMMessage{}, fmt.Errorf("swim message to %s answered with %T", to.ID, resp) // as good as no ack
+	}
+	if ack.Err != "" {
+		return p2p.SWIMMessage{}, errors.New(ack.Err)
+	}
+	return ack.Msg, nil
+}
+
+// 3. handleMessageSWIM ---------------------------//
+func (s *FileServer) handleMessageSWIM(from string, reqID uint64, msg MessageSWIM) error {
+	peer, ok := s.peerList()[from]
+	if !ok {
+		return fmt.Errorf("peer %s not in map", from)
+	}
+
+	var ack MessageSWIMAck
+	if s.members == nil {
+		ack.Err = "membership is off"
+	} else {
+		ctx, cancel := s.withDefaultTimeout(context.Background())
+		defer cancel()
+
+		resp, err := s.members.HandleMessage(ctx, p2p.Contact{ID: from, Addr: peer.ListenAddr()}, msg.Msg)
+		if err != nil {
+			ack.Err = err.Error()
+		}
+		ack.Msg = resp
+	}
+
+	return s.send(peer, &Message{RequestID: reqID, Payload: ack})
+}
+
+// 4. onMemberEvent ---------------------------//
+func (s *FileServer) onMemberEvent(ev p2p.MemberEvent) {
+	switch ev.Type {
+	case p2p.EventJoin:
+		if _, ok := s.networkPeers()[ev.Member.ID]; ok {
+			return
+		}
+		go func() {
+			ctx, cancel := s.withDefaultTimeout(context.Background())
+			defer cancel()
+			if _, err := s.connect(ctx, ev.Member.Contact, false); err != nil {
+				log.Printf("[%s] connecting with member %s: %v", s.Transport.Addr(), ev.Member.Addr, err)
+			}
+		}()
+
+	case p2p.EventFail, p2p.EventLeave:
+		fmt.Printf("[%s] member %s (%s) is %s, dropping it\n", s.Transport.Addr(), ev.Member.Addr, ev.Member.ID, ev.Member.State)
+		s.dropPeer(ev.Member.ID)
+	}
+}
+
+// 5. membershipLoop ---------------------------//
+func (s *FileServer) membershipLoop() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-s.quitCh
+		cancel()
+	}()
+
+	s.members.Run(ctx)
+}
+
+// ------------------------------ XXXXXXXXXXXXXXX---------------------------------------- //
+// ---------------------------------- Helpers ------------------------------------------- //
+
+// dropPeer forgets a peer and closes its connection, OnPeerLost finds it gone already
+func (s *FileServer) dropPeer(id string) {
+	s.peerLock.Lock()
+	peer, ok := s.peers[id]
+	delete(s.peers, id)
+	delete(s.contacts, id)
+	s.ring.remove(id)
+	s.peerLock.Unlock()
+
+	if ok {
+		s.rebalanceSoon()
+	}
+
+	if s.dht != nil {
+		s.dht.Remove(id)
+	}
+	if ok {
+		for _, addr := range p2p.PeerAddrs(peer) {
+			s.conns.Disconnected(addr)
+		}
+		peer.Close()
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+/*
+GetRange reads part of a file. When the file is on the local disk the store seeks to it
+(store_range.go). Otherwise the peers are asked with a MessageGetRange for the sealed chunks
+the range falls in, with the seal header as the Prefix, and those chunks are opened one by
+one as they arrive (copyOpenRange in crypto.go), so neither side touches the rest of the
+file. The peer doesn't need to know the format, to it the range is just bytes.
+
+Compressed files and files sealed before the chunked format can't be opened from the
+middle. For those GetRange falls back to fetching the whole file, as Get does, and reads
+the range from the local copy.
+*/
+
+// ------------------------------ XXXXXXXXXXXXXXX---------------------------------------- //
+// ------------------------------- Range Methods ---------------------------------------- //
+
+/* Index
+1. GetRange: Get length bytes of the file from offset on, from the local disk or the network
+2. fetchRange: Stream a range from the first peer that has the file, decrypting as it comes
+3. handleMessageGetRange: Send the requested range of a file to the peer that asked
+*/
+
+// 1. GetRange ---------------------------//
+// GetRange reads to the end of the file for a negative length. A range that comes from the
+// network is streamed, closing the reader early stops the transfer.
+func (s *FileServer) GetRange(ctx context.Context, key string, offset int64, length int64) (io.Reader, error) {
+	if s.expired(s.ID, key) {
+		return nil, fmt.Errorf("[%s] (%s) expired: %w", s.Transport.Addr(), key, ErrNotFound)
+	}
+	if s.store.Has(s.ID, key) {
+		fmt.Printf("[%s] serving range of (%s) from local disk\n", s.Transport.Addr(), key)
+		_, r, err := s.store.ReadRange(s.ID, key, offset, length)
+		return r, err
+	}
+	if offset < 0 {
+		return nil, fmt.Errorf("%w: offset %d", ErrInvalidRange, offset)
+	}
+
+	fmt.Printf("[%s] don't have file (%s) locally, fetching range from network...\n", s.Transport.Addr(), key)
+
+	r, err := s.fetchRange(ctx, key, offset, length)
+	if !errors.Is(err, errNotSeekable) {
+		return r, err
+	}
+
+	// only the whole file decrypts, so take all of it and read the range locally
+	whole, err := s.GetContext(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if rc, ok := whole.(io.Closer); ok {
+		rc.Close()
+	}
+	_, r, err = s.store.ReadRange(s.ID, key, offset, length)
+	return r, err
+}
+
+// 2. fetchRange ---------------------------//
+func (s *FileServer) fetchRange(ctx context.Context, key string, offset int64, length int64) (io.Reader, error) {
+	start, sealedLength, first := sealedRange(offset, length)
+	req := MessageGetRange{ID: s.ID, Key: hashKey(key), Offset: start, Length: sealedLength, Prefix: sealHeaderSize}
+
+	return s.fetchStream(ctx, req, key, func(body io.Reader, msg MessageGetFileResponse) (func(w io.Writer) (int64, error), error) {
+		header := make([]byte, sealHeaderSize)
+		if _, err := io.ReadFull(body, header); err != nil {
+			return nil, err
+		}
+		if msg.Meta.Compression != "" || !seekable(header) {
+			return nil, errNotSeekable
+		}
+
+		n, err := rangeSize(openedSize(msg.Total), offset, length)
+		if err != nil {
+			return nil, err
+		}
+
+		return func(w io.Writer) (int64, error) {
+			window := &windowWriter{w: w, skip: offset - int64(first)*sealChunkSize, n: n}
+			_, err := copyOpenRange(s.EncKey, header, first, msg.Total, body, window)
+			return n - window.n, err
+		}, nil
+	})
+}
+
+// 3. handleMessageGetRange ---------------------------//
+func (s *FileServer) handleMessageGetRange(from string, reqID uint64, msg MessageGetRange) error {
+	peer, ok := s.peerList()[from]
+	if !ok {
+		return fmt.Errorf("peer %s not in map", from)
+	}
+
+	if !s.store.Has(msg.ID, msg.Key) {
+		return s.sendNotFound(peer, reqID, msg.ID, msg.Key)
+	}
+
+	info, err := s.store.Stat(msg.ID, msg.Key)
+	if err != nil {
+		return err
+	}
+	if info.Meta.expired(time.Now()) {
+		return s.sendNotFound(peer, reqID, msg.ID, msg.Key)
+	}
+
+	prefixSize, prefix, err := s.store.ReadRange(msg.ID, msg.Key, 0, msg.Prefix)
+	if err != nil {
+		return err
+	}
+	if rc, ok := prefix.(io.Closer); ok {
+		defer rc.Close()
+	}
+
+	offset := min(msg.Offset, info.Size) // past the end is an empty range, the requester tells it from Total
+	size, r, err := s.store.ReadRange(msg.ID, msg.Key, offset, msg.Length)
+	if err != nil {
+		return err
+	}
+	if rc, ok := r.(io.Closer); ok {
+		defer rc.Close()
+	}
+
+	resp := Message{
+		RequestID: reqID,
+		Payload: MessageGetFileResponse{
+			ID:     msg.ID,
+			Key:    msg.Key,
+			Size:   prefixSize + size,
+			Offset: offset,
+			Total:  info.Size,
+			Meta:   info.Meta,
+		},
+	}
+	if err := s.sendStream(peer, &resp, io.MultiReader(prefix, r)); err != nil {
+		return err
+	}
+
+	fmt.Printf("[%s] written (%d) bytes of (%s) over the network to %s\n", s.Transport.Addr(), prefixSize+size, msg.Key, from)
+	return nil
+}
+
+// ------------------------------ XXXXXXXXXXXXXXX---------------------------------------- //
+// ---------------------------------- Helpers ------------------------------------------- //
+
+// windowWriter passes on n bytes after dropping the first skip, and swallows the rest
+type windowWriter struct {
+	w    io.Writer
+	skip int64
+	n    int64
+}
+
+func (w *windowWriter) Write(p []byte) (int, error) {
+	written := len(p)
+
+	drop := min(w.skip, int64(len(p)))
+	p, w.skip = p[drop:], w.skip-drop
+	p = p[:min(int64(len(p)), w.n)]
+
+	if len(p) > 0 {
+		if _, err := w.w.Write(p); err != nil {
+			return 0, err
+		}
+		w.n -= int64(len(p))
+	}
+	return written, nil
+}
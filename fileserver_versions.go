@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+)
+
+/*
+With FileServerOpts.Versioning the store keeps the versions a Store replaces (store_versions.go).
+The version IDs travel in Metadata, so the replicas, versioned as well when their nodes are,
+name every version the way the owner does and GetVersion can ask them for one by its ID.
+
+An old version fetched from a peer is decrypted on its way to the caller and not kept, the
+store only takes the current version of a key as a whole.
+*/
+
+// ------------------------------ XXXXXXXXXXXXXXX---------------------------------------- //
+// ------------------------------ Version Methods --------------------------------------- //
+
+/* Index
+1. Versions: The versions of the file this node keeps, newest first
+2. GetVersion: Get a given version of the file, from the local disk or the network
+3. statVersion: Describe a given version of what (id, key) holds
+*/
+
+// 1. Versions ---------------------------//
+func (s *FileServer) Versions(key string) ([]ObjectInfo, error) {
+	return s.store.Versions(s.ID, key)
+}
+
+// 2. GetVersion ---------------------------//
+// GetVersion is Get for an empty version
+func (s *FileServer) GetVersion(ctx context.Context, key string, version string) (io.Reader, error) {
+	if version == "" {
+		return s.GetContext(ctx, key)
+	}
+
+	_, r, err := s.store.ReadVersion(s.ID, key, version)
+	if err == nil {
+		fmt.Printf("[%s] serving version %s of (%s) from local disk\n", s.Transport.Addr(), version, key)
+		return r, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	fmt.Printf("[%s] don't have version %s of (%s) locally, fetching from network...\n", s.Transport.Addr(), version, key)
+
+	req := MessageGetFile{ID: s.ID, Key: hashKey(key), Version: version}
+	return s.fetchStream(ctx, req, key, func(body io.Reader, msg MessageGetFileResponse) (func(w io.Writer) (int64, error), error) {
+		if msg.Meta.Compression == "" {
+			return func(w io.Writer) (int64, error) {
+				n, err := copyOpen(s.EncKey, msg.Meta.Encryption, body, w)
+				return int64(n), err
+			}, nil
+		}
+
+		codec, err := lookupCodec(msg.Meta.Compression)
+		if err != nil {
+			return nil, err
+		}
+		return func(w io.Writer) (int64, error) {
+			return openDecompressed(s.EncKey, msg.Meta.Encryption, codec, body, w)
+		}, nil
+	})
+}
+
+// 3. statVersion ---------------------------//
+func (s *FileServer) statVersion(id string, key string, version string) (ObjectInfo, error) {
+	versions, err := s.store.Versions(id, key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	for _, info := range versions {
+		if info.Meta.Version == version && !info.Deleted {
+			return info, nil
+		}
+	}
+	return ObjectInfo{}, fmt.Errorf("version %s of (%s): %w", version, key, fs.ErrNotExist)
+}
+
+// ------------------------------ XXXXXXXXXXXXXXX---------------------------------------- //
+// ---------------------------------- Helpers ------------------------------------------- //
+
+// openDecompressed decrypts src and decompresses what comes out into dst. The decryption
+// finishes before it returns, so the last chunk is authenticated too.
+func openDecompressed(key []byte, format string, codec Codec, src io.Reader, dst io.Writer) (int64, error) {
+	pr, pw := io.Pipe()
+	opened := make(chan error, 1)
+	go func() {
+		_, err := copyOpen(key, format, src, pw)
+		pw.CloseWithError(err)
+		opened <- err
+	}()
+
+	dec, err := codec.NewReader(pr)
+	if err != nil {
+		pr.CloseWithError(err)
+		<-opened
+		return 0, err
+	}
+	n, err := io.Copy(dst, dec)
+	dec.Close()
+
+	pr.Close() // lets copyOpen return should the codec stop before the end
+	if oerr := <-opened; err == nil && oerr != nil && !errors.Is(oerr, io.ErrClosedPipe) {
+		err = oerr
+	}
+	return n, err
+}
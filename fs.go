@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+/*
+FS is everything LocalStore needs from a filesystem. Keeping the store on top of it means
+the same engine, with content addressing, chunking and atomic writes, runs on the disk
+(DiskFS) and entirely in memory (MemFS, memfs.go).
+*/
+
+type FS interface {
+	MkdirAll(path string) error
+	CreateTemp(dir, pattern string) (File, error) // a new empty file with a unique name in dir
+	Open(name string) (File, error)               // open for reading
+	Rename(oldpath, newpath string) error         // replaces newpath if it exists
+	Remove(name string) error                     // a file, or a directory that is empty
+	RemoveAll(path string) error
+	Stat(name string) (fs.FileInfo, error)
+	ReadDir(name string) ([]fs.DirEntry, error)
+	SyncDir(name string) error // make the entries of a directory durable
+}
+
+type File interface {
+	io.Reader
+	io.Seeker // for reads, range reads start from the middle
+	io.Writer
+	io.Closer
+	Name() string
+	Stat() (fs.FileInfo, error)
+	Sync() error
+}
+
+// ------------------------------ XXXXXXXXXXXXXXX---------------------------------------- //
+// ---------------------------------- DiskFS -------------------------------------------- //
+
+// DiskFS is the OS filesystem
+type DiskFS struct{}
+
+func (DiskFS) MkdirAll(path string) error {
+	return os.MkdirAll(path, os.ModePerm)
+}
+
+func (DiskFS) CreateTemp(dir, pattern string) (File, error) {
+	return os.CreateTemp(dir, pattern)
+}
+
+func (DiskFS) Open(name string) (File, error) {
+	return os.Open(name)
+}
+
+func (DiskFS) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (DiskFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (DiskFS) RemoveAll(path string) error {
+	return os.RemoveAll(path)
+}
+
+func (DiskFS) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (DiskFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return os.ReadDir(name)
+}
+
+func (DiskFS) SyncDir(name string) error {
+	d, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// ------------------------------ XXXXXXXXXXXXXXX---------------------------------------- //
+// ---------------------------------- Helpers ------------------------------------------- //
+
+func readFile(fsys FS, name string) ([]byte, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// walkFiles calls fn for every file under root, depth first in lexical order. Temp files that
+// are still being written are skipped, a missing root has no files, and fn returning
+// filepath.SkipAll stops the walk without an error.
+func walkFiles(fsys FS, root string, fn func(path string) error) error {
+	err := walkDir(fsys, root, false, fn)
+	if errors.Is(err, filepath.SkipAll) {
+		return nil
+	}
+	return err
+}
+
+// walkAllFiles is walkFiles with the temp files, for the GC that cleans them up
+func walkAllFiles(fsys FS, root string, fn func(path string) error) error {
+	err := walkDir(fsys, root, true, fn)
+	if errors.Is(err, filepath.SkipAll) {
+		return nil
+	}
+	return err
+}
+
+func walkDir(fsys FS, dir string, temps bool, fn func(path string) error) error {
+	entries, err := fsys.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		switch {
+		case entry.IsDir():
+			err = walkDir(fsys, path, temps, fn)
+		case !temps && isTempFile(path):
+			continue
+		default:
+			err = fn(path)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isTempFile(path string) bool {
+	matched, _ := filepath.Match(tempFilePattern, filepath.Base(path))
+	return matched
+}
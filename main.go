@@ -11,18 +11,35 @@ import (
 )
 
 func makeServer(listenAddr string, nodes ...string) *FileServer {
+	identity, err := p2p.NewIdentity()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	upgrade, err := p2p.NewTLSUpgradeFunc(p2p.TLSConfig{Identity: identity})
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	tcptransportOpts := p2p.TCPTransportOptions{
 		ListenAddress: listenAddr,
-		HandshakeFunc: p2p.NOPHandshakeFunc,
-		Decoder:       p2p.DefaultDecoder{},
+		HandshakeFunc: p2p.NewAuthHandshakeFunc(p2p.HandshakeConfig{
+			Identity:   identity,
+			ListenAddr: listenAddr,
+		}),
+		Decoder: p2p.FramedDecoder{},
+		Upgrade: upgrade,
 	}
 
 	tcpTransport := p2p.NewTCPTransport(tcptransportOpts)
 
 	fileServerOpts := FileServerOpts{
+		NodeID:            identity.ID(),
 		EncKey:            newEncryptionKey(),
 		StorageRoot:       listenAddr + "_network",
 		PathTransformFunc: CASPathTransformFunc,
+		ContentAddressed:  true,
+		Chunking:          true,
 		Transport:         tcpTransport,
 		BootstrapNodes:    nodes,
 	}
@@ -30,6 +47,7 @@ func makeServer(listenAddr string, nodes ...string) *FileServer {
 	s := NewFileServer(fileServerOpts)
 
 	tcpTransport.OnPeer = s.OnPeer
+	tcpTransport.OnPeerLost = s.OnPeerLost
 
 	return s
 }
@@ -51,7 +69,9 @@ func main() {
 	for i := 0; i < 20; i++ {
 		key := fmt.Sprintf("picture_%d.png", i)
 		data := bytes.NewReader([]byte("my big data file here!"))
-		s3.Store(key, data)
+		if err := s3.Store(key, data); err != nil {
+			log.Fatal(err)
+		}
 
 		if err := s3.store.Delete(s3.ID, key); err != nil {
 			log.Fatal(err)
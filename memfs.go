@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"math/rand"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+MemFS keeps a whole directory tree in memory. It is what NewMemoryStore runs on, so tests
+can start several nodes without touching the disk. Files are only ever appended to while
+they are open for writing and are never changed in place afterwards (the store renames new
+files over old ones), so a reader works on the bytes that were there when it opened.
+*/
+
+type MemFS struct {
+	mu    sync.RWMutex
+	files map[string]*memNode
+	dirs  map[string]time.Time // every directory with the time it was created
+}
+
+type memNode struct {
+	data    []byte
+	modTime time.Time
+}
+
+func NewMemFS() *MemFS {
+	return &MemFS{
+		files: make(map[string]*memNode),
+		dirs:  map[string]time.Time{".": time.Now(), "/": time.Now()},
+	}
+}
+
+// ------------------------------ XXXXXXXXXXXXXXX---------------------------------------- //
+// ------------------------------- Methods of MemFS ------------------------------------- //
+
+func (m *MemFS) MkdirAll(path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	path = filepath.Clean(path)
+	if _, ok := m.files[path]; ok {
+		return &fs.PathError{Op: "mkdir", Path: path, Err: fs.ErrExist}
+	}
+
+	for dir := path; ; dir = filepath.Dir(dir) {
+		if _, ok := m.dirs[dir]; ok {
+			break
+		}
+		m.dirs[dir] = time.Now()
+	}
+	return nil
+}
+
+func (m *MemFS) CreateTemp(dir, pattern string) (File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	dir = filepath.Clean(dir)
+	if _, ok := m.dirs[dir]; !ok {
+		return nil, &fs.PathError{Op: "createtemp", Path: dir, Err: fs.ErrNotExist}
+	}
+
+	prefix, suffix, _ := strings.Cut(pattern, "*")
+	for {
+		name := filepath.Join(dir, fmt.Sprintf("%s%d%s", prefix, rand.Uint32(), suffix))
+		if _, ok := m.files[name]; ok {
+			continue
+		}
+
+		node := &memNode{modTime: time.Now()}
+		m.files[name] = node
+		return &memFile{fs: m, name: name, node: node, writable: true}, nil
+	}
+}
+
+func (m *MemFS) Open(name string) (File, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	name = filepath.Clean(name)
+	node, ok := m.files[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return &memFile{fs: m, name: name, node: node, r: bytes.NewReader(node.data)}, nil
+}
+
+func (m *MemFS) Rename(oldpath, newpath string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	oldpath, newpath = filepath.Clean(oldpath), filepath.Clean(newpath)
+	node, ok := m.files[oldpath]
+	if !ok {
+		return &fs.PathError{Op: "rename", Path: oldpath, Err: fs.ErrNotExist}
+	}
+	if _, ok := m.dirs[filepath.Dir(newpath)]; !ok {
+		return &fs.PathError{Op: "rename", Path: newpath, Err: fs.ErrNotExist}
+	}
+
+	delete(m.files, oldpath)
+	m.files[newpath] = node
+	return nil
+}
+
+func (m *MemFS) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = filepath.Clean(name)
+	if _, ok := m.files[name]; ok {
+		delete(m.files, name)
+		return nil
+	}
+	if _, ok := m.dirs[name]; !ok {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	if len(m.children(name)) > 0 {
+		return &fs.PathError{Op: "remove", Path: name, Err: fmt.Errorf("directory not empty")}
+	}
+	delete(m.dirs, name)
+	return nil
+}
+
+func (m *MemFS) RemoveAll(path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	path = filepath.Clean(path)
+	prefix := path + string(filepath.Separator)
+	for name := range m.files {
+		if name == path || strings.HasPrefix(name, prefix) {
+			delete(m.files, name)
+		}
+	}
+	for name := range m.dirs {
+		if name == path || strings.HasPrefix(name, prefix) {
+			delete(m.dirs, name)
+		}
+	}
+	return nil
+}
+
+func (m *MemFS) Stat(name string) (fs.FileInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	name = filepath.Clean(name)
+	if node, ok := m.files[name]; ok {
+		return memFileInfo{name: filepath.Base(name), size: int64(len(node.data)), modTime: node.modTime}, nil
+	}
+	if created, ok := m.dirs[name]; ok {
+		return memFileInfo{name: filepath.Base(name), modTime: created, dir: true}, nil
+	}
+	return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+}
+
+func (m *MemFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	name = filepath.Clean(name)
+	if _, ok := m.dirs[name]; !ok {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+
+	children := m.children(name)
+	entries := make([]fs.DirEntry, 0, len(children))
+	for _, info := range children {
+		entries = append(entries, fs.FileInfoToDirEntry(info))
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// SyncDir has nothing to flush, memory does not outlive the process anyway
+func (m *MemFS) SyncDir(name string) error {
+	return nil
+}
+
+// children lists the files and directories right under dir, the caller holds the lock
+func (m *MemFS) children(dir string) []fs.FileInfo {
+	var infos []fs.FileInfo
+	for name, node := range m.files {
+		if filepath.Dir(name) == dir {
+			infos = append(infos, memFileInfo{name: filepath.Base(name), size: int64(len(node.data)), modTime: node.modTime})
+		}
+	}
+	for name, created := range m.dirs {
+		if name != dir && filepath.Dir(name) == dir {
+			infos = append(infos, memFileInfo{name: filepath.Base(name), modTime: created, dir: true})
+		}
+	}
+	return infos
+}
+
+// ------------------------------ XXXXXXXXXXXXXXX---------------------------------------- //
+// ------------------------------- memFile and memFileInfo ------------------------------ //
+
+type memFile struct {
+	fs       *MemFS
+	name     string
+	node     *memNode
+	r        *bytes.Reader // set when opened for reading
+	writable bool          // set for files from CreateTemp
+	closed   bool
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	if f.r == nil {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: fs.ErrPermission}
+	}
+	return f.r.Read(p)
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	if f.r == nil {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrPermission}
+	}
+	return f.r.Seek(offset, whence)
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	if !f.writable || f.closed {
+		return 0, &fs.PathError{Op: "write", Path: f.name, Err: fs.ErrClosed}
+	}
+
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	// readers hold a slice of what was there when they opened, appending never touches those bytes
+	f.node.data = append(f.node.data, p...)
+	f.node.modTime = time.Now()
+	return len(p), nil
+}
+
+func (f *memFile) Close() error {
+	f.closed = true
+	return nil
+}
+
+func (f *memFile) Name() string {
+	return f.name
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) {
+	f.fs.mu.RLock()
+	defer f.fs.mu.RUnlock()
+	return memFileInfo{name: filepath.Base(f.name), size: int64(len(f.node.data)), modTime: f.node.modTime}, nil
+}
+
+func (f *memFile) Sync() error {
+	return nil
+}
+
+type memFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (i memFileInfo) Name() string       { return i.name }
+func (i memFileInfo) Size() int64        { return i.size }
+func (i memFileInfo) ModTime() time.Time { return i.modTime }
+func (i memFileInfo) IsDir() bool        { return i.dir }
+func (i memFileInfo) Sys() any           { return nil }
+
+func (i memFileInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0o755
+	}
+	return 0o644
+}
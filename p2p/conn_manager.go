@@ -0,0 +1,358 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+ConnManager keeps a node connected with the peers it wants, e.g. its bootstrap nodes. Every
+address it is given gets a goroutine that dials it whenever it isn't connected, and waits
+for the connection to come up: Dial only opens it, the handshake finishes later, so the
+owner of the manager reports Connected and Disconnected as its peers come and go.
+
+A dial that fails, or doesn't come up within ConnectTimeout, is tried again after a backoff
+that starts at MinBackoff and doubles with every failure in a row up to MaxBackoff. A peer
+that disconnects is redialed the same way, from MinBackoff. Every backoff is jittered, half
+of it fixed and half random, so nodes that lost the same peer don't all dial it at once.
+
+Peers are known by the address they are added with. The owner reports a connection under
+every address of PeerAddrs: the one it was dialed at, which the handshake may have replaced
+with one written differently, e.g. ":3000" for "127.0.0.1:3000", and the one it listens on,
+which is all there is of inbound peers, so a peer that dialed us first counts as connected
+too.
+*/
+
+const (
+	defaultMinBackoff     = 500 * time.Millisecond
+	defaultMaxBackoff     = 30 * time.Second
+	defaultConnectTimeout = 5 * time.Second
+)
+
+var (
+	ErrConnectTimeout = errors.New("p2p: connection didn't come up in time")
+	ErrDisconnected   = errors.New("p2p: peer disconnected")
+)
+
+type ConnState int
+
+const (
+	ConnIdle       ConnState = iota + 1 // not dialed yet
+	ConnDialing                         // dialed, waiting for the connection to come up
+	ConnConnected                       // connected
+	ConnBackingOff                      // waiting to dial again after a failure or disconnect
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case ConnIdle:
+		return "idle"
+	case ConnDialing:
+		return "dialing"
+	case ConnConnected:
+		return "connected"
+	case ConnBackingOff:
+		return "backing off"
+	}
+	return "unknown"
+}
+
+// ConnStatus is where the connection with a peer stands
+type ConnStatus struct {
+	Addr      string
+	ID        string // the identity of the peer, once it connected
+	State     ConnState
+	Failures  int       // failed dials in a row, a disconnect counts as one
+	LastError error     // of the last failure
+	Since     time.Time // when State was entered
+	NextDial  time.Time // for ConnBackingOff
+}
+
+type ConnManagerOpts struct {
+	Dial           func(addr string) error // e.g. Transport.Dial
+	MinBackoff     time.Duration
+	MaxBackoff     time.Duration
+	ConnectTimeout time.Duration // how long a dial waits for Connected
+}
+
+type ConnManager struct {
+	ConnManagerOpts
+
+	mu      sync.Mutex
+	ctx     context.Context // of Run, nil before it
+	wg      sync.WaitGroup
+	entries map[string]*connEntry // by address
+}
+
+type connEntry struct {
+	ConnStatus
+	changed chan struct{} // poked when Connected or Disconnected change the state
+	cancel  context.CancelFunc
+}
+
+// ------------------------------- xxxxxxx ----------------------------------- //
+
+// ------------------------ ConnManager Initialization ----------------------- //
+
+func NewConnManager(opts ConnManagerOpts) *ConnManager {
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = defaultMinBackoff
+	}
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = max(defaultMaxBackoff, opts.MinBackoff)
+	}
+	if opts.ConnectTimeout <= 0 {
+		opts.ConnectTimeout = defaultConnectTimeout
+	}
+
+	return &ConnManager{
+		ConnManagerOpts: opts,
+		entries:         make(map[string]*connEntry),
+	}
+}
+
+// PeerAddrs are the addresses a peer may have been added to a ConnManager with: the one it
+// was dialed at and the one it listens on, with the host it connected from when it announced
+// none, e.g. "10.0.0.2:3000" for ":3000"
+func PeerAddrs(p Peer) []string {
+	var addrs []string
+	add := func(addr string) {
+		if addr != "" && !slices.Contains(addrs, addr) {
+			addrs = append(addrs, addr)
+		}
+	}
+
+	add(p.DialAddr())
+	add(p.ListenAddr())
+	if host, port, err := net.SplitHostPort(p.ListenAddr()); err == nil && (host == "" || net.ParseIP(host).IsUnspecified()) {
+		if remote, _, err := net.SplitHostPort(p.RemoteAddr().String()); err == nil {
+			add(net.JoinHostPort(remote, port))
+		}
+	}
+	return addrs
+}
+
+// ------------------------------- xxxxxxx ----------------------------------- //
+
+// ---------------------- Methods of ConnManager for Peers ------------------- //
+
+/* Index
+1. Add: Keep a peer connected
+2. Remove: Stop keeping a peer connected
+3. Connected: Report that a connection with a peer came up
+4. Disconnected: Report that the connection with a peer went away
+5. Status: Where the connections with the peers stand
+6. Run: Keep the peers connected until ctx is done
+*/
+
+// 1. Add ---------------------------//
+func (m *ConnManager) Add(addr string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.entries[addr]; ok || addr == "" {
+		return
+	}
+	e := &connEntry{
+		ConnStatus: ConnStatus{Addr: addr, State: ConnIdle, Since: time.Now()},
+		changed:    make(chan struct{}, 1),
+	}
+	m.entries[addr] = e
+	if m.ctx != nil {
+		m.start(e)
+	}
+}
+
+// 2. Remove ---------------------------//
+// Remove leaves a connection that is up alone
+func (m *ConnManager) Remove(addr string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if e, ok := m.entries[addr]; ok {
+		delete(m.entries, addr)
+		if e.cancel != nil {
+			e.cancel()
+		}
+	}
+}
+
+// 3. Connected ---------------------------//
+// Connected is ignored for a peer the manager doesn't keep
+func (m *ConnManager) Connected(addr string, id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, ok := m.entries[addr]
+	if !ok {
+		return
+	}
+	e.ID = id
+	e.Failures, e.LastError, e.NextDial = 0, nil, time.Time{}
+	m.setState(e, ConnConnected)
+}
+
+// 4. Disconnected ---------------------------//
+func (m *ConnManager) Disconnected(addr string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, ok := m.entries[addr]
+	if !ok || e.State != ConnConnected {
+		return
+	}
+	m.fail(e, ErrDisconnected)
+}
+
+// 5. Status ---------------------------//
+// Status is sorted by address
+func (m *ConnManager) Status() []ConnStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	status := make([]ConnStatus, 0, len(m.entries))
+	for _, e := range m.entries {
+		status = append(status, e.ConnStatus)
+	}
+	sort.Slice(status, func(i, j int) bool { return status[i].Addr < status[j].Addr })
+	return status
+}
+
+// 6. Run ---------------------------//
+func (m *ConnManager) Run(ctx context.Context) {
+	m.mu.Lock()
+	m.ctx = ctx
+	for _, e := range m.entries {
+		m.start(e)
+	}
+	m.mu.Unlock()
+
+	<-ctx.Done()
+	m.wg.Wait()
+}
+
+// ------------------------------- xxxxxxx ----------------------------------- //
+
+// ------------------- Internal Methods of ConnManager ----------------------- //
+
+/* Index
+1. start: Run keep for a peer, with mu held
+2. keep: Dial a peer whenever it isn't connected
+3. dial: Dial a peer and wait for it to come up
+4. fail: Back off after a failure, with mu held
+5. setState: Change the state of a peer and wake its keep, with mu held
+*/
+
+// 1. start ---------------------------//
+func (m *ConnManager) start(e *connEntry) {
+	ctx, cancel := context.WithCancel(m.ctx)
+	e.cancel = cancel
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		m.keep(ctx, e)
+	}()
+}
+
+// 2. keep ---------------------------//
+func (m *ConnManager) keep(ctx context.Context, e *connEntry) {
+	for {
+		m.mu.Lock()
+		state, wait := e.State, time.Until(e.NextDial)
+		m.mu.Unlock()
+
+		switch {
+		case state == ConnConnected:
+			select {
+			case <-e.changed:
+			case <-ctx.Done():
+				return
+			}
+
+		case state == ConnBackingOff && wait > 0:
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-e.changed: // e.g. the peer dialed us meanwhile
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			}
+			timer.Stop()
+
+		default:
+			m.dial(ctx, e)
+		}
+	}
+}
+
+// 3. dial ---------------------------//
+func (m *ConnManager) dial(ctx context.Context, e *connEntry) {
+	m.mu.Lock()
+	m.setState(e, ConnDialing)
+	m.mu.Unlock()
+
+	err := m.Dial(e.Addr)
+	if err == nil {
+		timer := time.NewTimer(m.ConnectTimeout)
+		defer timer.Stop()
+
+	wait:
+		for {
+			select {
+			case <-e.changed:
+				m.mu.Lock()
+				settled := e.State != ConnDialing // connected, or connected and lost again already
+				m.mu.Unlock()
+				if settled {
+					return
+				}
+			case <-timer.C:
+				err = ErrConnectTimeout
+				break wait
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if e.State == ConnDialing { // not connected by the peer dialing us meanwhile
+		m.fail(e, err)
+	}
+}
+
+// 4. fail ---------------------------//
+func (m *ConnManager) fail(e *connEntry, err error) {
+	e.Failures++
+	e.LastError = err
+
+	backoff := m.MinBackoff
+	for i := 1; i < e.Failures && backoff < m.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	backoff = min(backoff, m.MaxBackoff)
+	backoff = backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+
+	e.NextDial = time.Now().Add(backoff)
+	m.setState(e, ConnBackingOff)
+}
+
+// 5. setState ---------------------------//
+func (m *ConnManager) setState(e *connEntry, state ConnState) {
+	if e.State != state {
+		e.State, e.Since = state, time.Now()
+	}
+	select {
+	case e.changed <- struct{}{}:
+	default:
+	}
+}
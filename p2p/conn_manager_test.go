@@ -0,0 +1,168 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeDialer refuses the first fails dials, the ones after it report Connected on their own
+type fakeDialer struct {
+	mu    sync.Mutex
+	m     *ConnManager
+	fails int
+	dials []time.Time
+}
+
+func (d *fakeDialer) Dial(addr string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.dials = append(d.dials, time.Now())
+	if len(d.dials) <= d.fails {
+		return errors.New("connection refused")
+	}
+	go d.m.Connected(addr, "peer-"+addr) // the handshake finishes after Dial returns
+	return nil
+}
+
+func (d *fakeDialer) count() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.dials)
+}
+
+func newConnManager(t *testing.T, d *fakeDialer) *ConnManager {
+	m := NewConnManager(ConnManagerOpts{
+		Dial:           d.Dial,
+		MinBackoff:     20 * time.Millisecond,
+		MaxBackoff:     60 * time.Millisecond,
+		ConnectTimeout: 50 * time.Millisecond,
+	})
+	d.m = m
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		m.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return m
+}
+
+func waitForConnState(t *testing.T, m *ConnManager, addr string, state ConnState) ConnStatus {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		for _, st := range m.Status() {
+			if st.Addr == addr && st.State == state {
+				return st
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s never got %s: %+v", addr, state, m.Status())
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+}
+
+func TestConnManagerBacksOffUntilConnected(t *testing.T) {
+	d := &fakeDialer{fails: 4}
+	m := newConnManager(t, d)
+	m.Add(":4000")
+
+	st := waitForConnState(t, m, ":4000", ConnConnected)
+	assert.Equal(t, "peer-:4000", st.ID)
+	assert.Equal(t, 0, st.Failures)
+	assert.Nil(t, st.LastError)
+
+	// the waits double from MinBackoff, jittered to half of it at least, and stop at MaxBackoff
+	d.mu.Lock()
+	dials := d.dials
+	d.mu.Unlock()
+	assert.Len(t, dials, 5)
+	for i, min := range []time.Duration{10, 20, 30, 30} {
+		gap := dials[i+1].Sub(dials[i])
+		assert.GreaterOrEqual(t, gap, min*time.Millisecond, "wait %d", i)
+		assert.Less(t, gap, 60*time.Millisecond+50*time.Millisecond, "wait %d", i)
+	}
+
+	// a disconnect is redialed, and a peer the manager doesn't keep is left alone
+	m.Disconnected(":4000")
+	m.Disconnected(":5000")
+	m.Connected(":5000", "stranger")
+	waitForConnState(t, m, ":4000", ConnConnected)
+	assert.Equal(t, 6, d.count())
+	assert.Len(t, m.Status(), 1)
+}
+
+func TestConnManagerTimesOutAndStops(t *testing.T) {
+	m := NewConnManager(ConnManagerOpts{
+		Dial:           func(string) error { return nil }, // never comes up
+		MinBackoff:     20 * time.Millisecond,
+		ConnectTimeout: 10 * time.Millisecond,
+	})
+	m.Add(":4000")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		m.Run(ctx)
+		close(done)
+	}()
+
+	st := waitForConnState(t, m, ":4000", ConnBackingOff)
+	assert.ErrorIs(t, st.LastError, ErrConnectTimeout)
+	assert.True(t, st.NextDial.After(st.Since))
+
+	// the peer dialed us while we backed off
+	m.Connected(":4000", "peer")
+	waitForConnState(t, m, ":4000", ConnConnected)
+
+	m.Remove(":4000")
+	assert.Empty(t, m.Status())
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Run didn't return")
+	}
+}
+
+func TestConnManagerRedialsAConnectionLostAtOnce(t *testing.T) {
+	var m *ConnManager
+	var dials atomic.Int32
+	m = NewConnManager(ConnManagerOpts{
+		Dial: func(addr string) error {
+			if dials.Add(1) == 1 {
+				// the connection comes up and goes again before the dial looks
+				m.Connected(addr, "peer")
+				m.Disconnected(addr)
+				return nil
+			}
+			go m.Connected(addr, "peer")
+			return nil
+		},
+		MinBackoff:     10 * time.Millisecond,
+		ConnectTimeout: time.Hour,
+	})
+	m.Add(":4000")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go m.Run(ctx)
+
+	// the dial doesn't sit out the ConnectTimeout waiting for what already came and went
+	waitForConnState(t, m, ":4000", ConnConnected)
+	assert.Equal(t, int32(2), dials.Load())
+}
@@ -0,0 +1,453 @@
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"math/bits"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+DHT is a Kademlia distributed hash table over the nodes of the network. It routes two
+things: nodes, by the SHA-256 of their identity, and provider records, which say what node
+holds the value under a key, by the SHA-256 of the key. Both live in the same 256 bit space
+where the distance between two IDs is their XOR.
+
+Every node keeps a routing table of k-buckets, bucket i holding up to K contacts whose IDs
+share their first i bits with its own. A lookup starts from the K contacts it knows closest
+to the target and asks Alpha of them at a time for closer ones, until the K closest it heard
+of have all answered. Every step halves the distance, so a lookup takes O(log n) hops. The
+requests are:
+
+  - DHTFindNode: the K contacts the node knows closest to the target
+  - DHTFindValue: the providers the node holds records of for the target, or closer contacts
+  - DHTStore: keep a record of the sender as a provider for the target, for ProviderTTL
+
+A full bucket keeps the contacts it has, they have been around for longest, and takes new
+ones as calls to the old ones fail. Providers have to Provide again within ProviderTTL to
+stay findable.
+
+The DHT doesn't talk to the network itself, Network carries its requests. A node hands
+the requests it receives to HandleRequest and every peer it connects with to Update.
+*/
+
+const (
+	DefaultDHTBucketSize = 20 // K
+	DefaultDHTAlpha      = 3
+	defaultProviderTTL   = 24 * time.Hour
+)
+
+var ErrNoContacts = errors.New("dht: no contacts to ask")
+
+// NodeID is a point in the DHT's space, see NodeIDOf
+type NodeID [sha256.Size]byte
+
+// DHTOp is what a DHTRequest asks for
+type DHTOp int
+
+const (
+	DHTFindNode DHTOp = iota + 1
+	DHTFindValue
+	DHTStore
+)
+
+// Contact is how to reach a node of the DHT
+type Contact struct {
+	ID   string // the identity the handshake authenticates, Peer.ID
+	Addr string // where the node accepts connections, Peer.ListenAddr
+}
+
+type DHTRequest struct {
+	Op     DHTOp
+	Sender Contact // the provider, for DHTStore
+	Target NodeID
+}
+
+type DHTResponse struct {
+	Contacts  []Contact // the closest to Target the node knows
+	Providers []Contact // for DHTFindValue, those the node knows hold Target
+}
+
+// DHTNetwork carries a request to another node and returns its answer
+type DHTNetwork interface {
+	CallDHT(ctx context.Context, to Contact, req DHTRequest) (DHTResponse, error)
+}
+
+type DHTOpts struct {
+	Self        Contact
+	Network     DHTNetwork
+	K           int // bucket size, and how many nodes a lookup ends with
+	Alpha       int // requests a lookup has in flight
+	ProviderTTL time.Duration
+}
+
+type DHT struct {
+	DHTOpts
+	self NodeID
+
+	mu        sync.Mutex
+	buckets   [len(NodeID{}) * 8][]Contact // least recently seen first
+	providers map[NodeID]map[string]providerRecord
+}
+
+type providerRecord struct {
+	contact Contact
+	expires time.Time
+}
+
+// ------------------------------- xxxxxxx ----------------------------------- //
+
+// ----------------------------- DHT Initialization -------------------------- //
+
+func NewDHT(opts DHTOpts) *DHT {
+	if opts.K <= 0 {
+		opts.K = DefaultDHTBucketSize
+	}
+	if opts.Alpha <= 0 {
+		opts.Alpha = DefaultDHTAlpha
+	}
+	if opts.ProviderTTL <= 0 {
+		opts.ProviderTTL = defaultProviderTTL
+	}
+
+	return &DHT{
+		DHTOpts:   opts,
+		self:      NodeIDOf(opts.Self.ID),
+		providers: make(map[NodeID]map[string]providerRecord),
+	}
+}
+
+// NodeIDOf places a node identity or a key in the DHT's space
+func NodeIDOf(s string) NodeID {
+	return sha256.Sum256([]byte(s))
+}
+
+// ------------------------------- xxxxxxx ----------------------------------- //
+
+// ------------------------ Methods of DHT for Routing ------------------------ //
+
+/* Index
+1. Update: Note a contact as seen, adding it to its bucket if there is room
+2. Remove: Drop a contact that failed
+3. Closest: The n contacts of the routing table closest to a target
+4. HandleRequest: Answer a request from another node
+*/
+
+// 1. Update ---------------------------//
+func (d *DHT) Update(c Contact) {
+	if c.ID == "" || c.ID == d.Self.ID {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	bucket := &d.buckets[d.bucketOf(NodeIDOf(c.ID))]
+	for i, known := range *bucket {
+		if known.ID == c.ID {
+			*bucket = append(append((*bucket)[:i:i], (*bucket)[i+1:]...), c)
+			return
+		}
+	}
+	if len(*bucket) < d.K {
+		*bucket = append(*bucket, c)
+	}
+}
+
+// 2. Remove ---------------------------//
+func (d *DHT) Remove(id string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	bucket := &d.buckets[d.bucketOf(NodeIDOf(id))]
+	for i, known := range *bucket {
+		if known.ID == id {
+			*bucket = append((*bucket)[:i:i], (*bucket)[i+1:]...)
+			return
+		}
+	}
+}
+
+// 3. Closest ---------------------------//
+func (d *DHT) Closest(target NodeID, n int) []Contact {
+	d.mu.Lock()
+	var all []Contact
+	for _, bucket := range d.buckets {
+		all = append(all, bucket...)
+	}
+	d.mu.Unlock()
+
+	sortByDistance(all, target)
+	if len(all) > n {
+		all = all[:n]
+	}
+	return all
+}
+
+// 4. HandleRequest ---------------------------//
+func (d *DHT) HandleRequest(req DHTRequest) DHTResponse {
+	d.Update(req.Sender)
+
+	switch req.Op {
+	case DHTStore:
+		d.addProvider(req.Target, req.Sender)
+		return DHTResponse{}
+	case DHTFindValue:
+		if providers := d.localProviders(req.Target); len(providers) > 0 {
+			return DHTResponse{Providers: providers}
+		}
+	}
+	return DHTResponse{Contacts: d.Closest(req.Target, d.K)}
+}
+
+// ------------------------------- xxxxxxx ----------------------------------- //
+
+// ------------------------ Methods of DHT for Lookups ------------------------ //
+
+/* Index
+1. Bootstrap: Look up the node itself, which fills the buckets and tells the others of it
+2. FindNode: The K nodes closest to a target, asking the network
+3. Provide: Record the node as a provider of key on the K nodes closest to it
+4. FindProviders: The nodes that provide key
+5. lookup: The iterative walk towards a target all of the above share
+*/
+
+// 1. Bootstrap ---------------------------//
+// Bootstrap needs a contact, Update the ones the node was configured with first
+func (d *DHT) Bootstrap(ctx context.Context) error {
+	_, err := d.FindNode(ctx, d.self)
+	return err
+}
+
+// 2. FindNode ---------------------------//
+func (d *DHT) FindNode(ctx context.Context, target NodeID) ([]Contact, error) {
+	closest, _, err := d.lookup(ctx, DHTFindNode, target)
+	return closest, err
+}
+
+// 3. Provide ---------------------------//
+// Provide keeps a record locally as well, in case the node is among the closest itself
+func (d *DHT) Provide(ctx context.Context, key string) error {
+	target := NodeIDOf(key)
+	d.addProvider(target, d.Self)
+
+	closest, err := d.FindNode(ctx, target)
+	if errors.Is(err, ErrNoContacts) {
+		return nil // alone in the network, the local record is all there is
+	}
+	if err != nil {
+		return err
+	}
+
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		stored int
+		last   error
+	)
+	for _, c := range closest {
+		wg.Add(1)
+		go func(c Contact) {
+			defer wg.Done()
+			_, err := d.Network.CallDHT(ctx, c, DHTRequest{Op: DHTStore, Sender: d.Self, Target: target})
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				last = err
+				return
+			}
+			stored++
+		}(c)
+	}
+	wg.Wait()
+
+	if stored == 0 && last != nil {
+		return last
+	}
+	return nil
+}
+
+// 4. FindProviders ---------------------------//
+// FindProviders stops at the first node that knows any, the node itself counts
+func (d *DHT) FindProviders(ctx context.Context, key string) ([]Contact, error) {
+	target := NodeIDOf(key)
+	if providers := d.localProviders(target); len(providers) > 0 {
+		return providers, nil
+	}
+
+	_, providers, err := d.lookup(ctx, DHTFindValue, target)
+	if len(providers) > 0 {
+		return providers, nil
+	}
+	return nil, err
+}
+
+// 5. lookup ---------------------------//
+// lookup returns the K closest nodes that answered, and for DHTFindValue the providers of
+// the first one that knew any
+func (d *DHT) lookup(ctx context.Context, op DHTOp, target NodeID) ([]Contact, []Contact, error) {
+	type candidate struct {
+		Contact
+		queried bool
+		failed  bool
+	}
+
+	var (
+		list []*candidate
+		seen = make(map[string]bool)
+	)
+	add := func(c Contact) {
+		if c.ID == "" || c.ID == d.Self.ID || seen[c.ID] {
+			return
+		}
+		seen[c.ID] = true
+		list = append(list, &candidate{Contact: c})
+	}
+	for _, c := range d.Closest(target, d.K) {
+		add(c)
+	}
+	if len(list) == 0 {
+		return nil, nil, ErrNoContacts
+	}
+
+	type result struct {
+		c    *candidate
+		resp DHTResponse
+		err  error
+	}
+
+	for {
+		sort.Slice(list, func(i, j int) bool { return closer(list[i].ID, list[j].ID, target) })
+
+		// the next to ask are the closest that weren't, among the K closest still in the running
+		var batch []*candidate
+		live := 0
+		for _, c := range list {
+			if c.failed {
+				continue
+			}
+			if live++; live > d.K {
+				break
+			}
+			if !c.queried && len(batch) < d.Alpha {
+				batch = append(batch, c)
+			}
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		results := make(chan result, len(batch))
+		for _, c := range batch {
+			c.queried = true
+			go func(c *candidate) {
+				resp, err := d.Network.CallDHT(ctx, c.Contact, DHTRequest{Op: op, Sender: d.Self, Target: target})
+				results <- result{c: c, resp: resp, err: err}
+			}(c)
+		}
+
+		var providers []Contact
+		for range batch {
+			r := <-results
+			if r.err != nil {
+				r.c.failed = true
+				d.Remove(r.c.ID)
+				continue
+			}
+			d.Update(r.c.Contact)
+			providers = append(providers, r.resp.Providers...)
+			for _, c := range r.resp.Contacts {
+				add(c)
+			}
+		}
+		if len(providers) > 0 {
+			return nil, dedupe(providers), nil
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var closest []Contact
+	for _, c := range list {
+		if c.queried && !c.failed && len(closest) < d.K {
+			closest = append(closest, c.Contact)
+		}
+	}
+	return closest, nil, nil
+}
+
+// ------------------------------- xxxxxxx ----------------------------------- //
+
+// ---------------------------------- Helpers -------------------------------- //
+
+// bucketOf is the length of the prefix id shares with the node, the caller holds mu
+func (d *DHT) bucketOf(id NodeID) int {
+	for i := range id {
+		if x := id[i] ^ d.self[i]; x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
+		}
+	}
+	return len(d.buckets) - 1 // the node itself, never stored
+}
+
+func (d *DHT) addProvider(target NodeID, c Contact) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.providers[target] == nil {
+		d.providers[target] = make(map[string]providerRecord)
+	}
+	d.providers[target][c.ID] = providerRecord{contact: c, expires: time.Now().Add(d.ProviderTTL)}
+}
+
+// localProviders drops the expired records of target on the way
+func (d *DHT) localProviders(target NodeID) []Contact {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	var providers []Contact
+	for id, rec := range d.providers[target] {
+		if now.After(rec.expires) {
+			delete(d.providers[target], id)
+			continue
+		}
+		providers = append(providers, rec.contact)
+	}
+	if len(d.providers[target]) == 0 {
+		delete(d.providers, target)
+	}
+	return providers
+}
+
+// closer tells whether a is closer to target than b
+func closer(a string, b string, target NodeID) bool {
+	da, db := NodeIDOf(a), NodeIDOf(b)
+	for i := range target {
+		da[i] ^= target[i]
+		db[i] ^= target[i]
+	}
+	return bytes.Compare(da[:], db[:]) < 0
+}
+
+func sortByDistance(contacts []Contact, target NodeID) {
+	sort.Slice(contacts, func(i, j int) bool { return closer(contacts[i].ID, contacts[j].ID, target) })
+}
+
+func dedupe(contacts []Contact) []Contact {
+	seen := make(map[string]bool)
+	out := contacts[:0]
+	for _, c := range contacts {
+		if !seen[c.ID] {
+			seen[c.ID] = true
+			out = append(out, c)
+		}
+	}
+	return out
+}
@@ -0,0 +1,100 @@
+package p2p
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// memDHTNetwork delivers requests straight to the DHT of the node they are for
+type memDHTNetwork struct {
+	mu    sync.Mutex
+	nodes map[string]*DHT
+	calls atomic.Int64
+}
+
+func (n *memDHTNetwork) CallDHT(ctx context.Context, to Contact, req DHTRequest) (DHTResponse, error) {
+	n.calls.Add(1)
+	n.mu.Lock()
+	d, ok := n.nodes[to.ID]
+	n.mu.Unlock()
+	if !ok {
+		return DHTResponse{}, fmt.Errorf("%s is down", to.ID)
+	}
+	return d.HandleRequest(req), nil
+}
+
+func newDHTNetwork(t *testing.T, size int) (*memDHTNetwork, []*DHT) {
+	network := &memDHTNetwork{nodes: make(map[string]*DHT)}
+	var nodes []*DHT
+	for i := 0; i < size; i++ {
+		self := Contact{ID: fmt.Sprintf("node-%d", i), Addr: fmt.Sprintf(":%d", 9000+i)}
+		d := NewDHT(DHTOpts{Self: self, Network: network, K: 8})
+		network.nodes[self.ID] = d
+		nodes = append(nodes, d)
+	}
+
+	// everyone knows of node-0 only, and joins through it
+	for _, d := range nodes[1:] {
+		d.Update(nodes[0].Self)
+		assert.Nil(t, d.Bootstrap(context.Background()))
+	}
+	return network, nodes
+}
+
+func TestDHTFindsTheClosestNodes(t *testing.T) {
+	network, nodes := newDHTNetwork(t, 200)
+
+	target := NodeIDOf("some key")
+	var all []Contact
+	for _, d := range nodes {
+		all = append(all, d.Self)
+	}
+	sortByDistance(all, target)
+
+	network.calls.Store(0)
+	found, err := nodes[150].FindNode(context.Background(), target)
+	assert.Nil(t, err)
+	assert.Equal(t, 8, len(found))
+
+	// nodes[150] itself may be among the closest, it doesn't find itself
+	want := all[:9]
+	for _, c := range found {
+		assert.Contains(t, want, c)
+	}
+	assert.Less(t, network.calls.Load(), int64(60), "a lookup should ask a few nodes, not all of them")
+}
+
+func TestDHTProvidersAreFoundFromAnywhere(t *testing.T) {
+	network, nodes := newDHTNetwork(t, 100)
+
+	assert.Nil(t, nodes[42].Provide(context.Background(), "default/abc"))
+	assert.Nil(t, nodes[7].Provide(context.Background(), "default/abc"))
+
+	for _, d := range []*DHT{nodes[0], nodes[99], nodes[13]} {
+		providers, err := d.FindProviders(context.Background(), "default/abc")
+		assert.Nil(t, err)
+		assert.NotEmpty(t, providers)
+		for _, p := range providers {
+			assert.Contains(t, []string{"node-42", "node-7"}, p.ID)
+		}
+	}
+
+	providers, err := nodes[5].FindProviders(context.Background(), "default/nobody-has-this")
+	assert.Nil(t, err)
+	assert.Empty(t, providers)
+
+	// a node that went away is dropped from the tables of those that call it
+	network.mu.Lock()
+	delete(network.nodes, "node-42")
+	network.mu.Unlock()
+	_, err = nodes[1].FindNode(context.Background(), NodeIDOf("node-42"))
+	assert.Nil(t, err)
+	for _, c := range nodes[1].Closest(NodeIDOf("node-42"), 100) {
+		assert.NotEqual(t, "node-42", c.ID)
+	}
+}
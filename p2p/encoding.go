@@ -1,14 +1,28 @@
 package p2p
 
 import (
+	"encoding/binary"
 	"encoding/gob"
+	"errors"
+	"fmt"
 	"io"
 )
 
+// DefaultMaxFrameSize is used by the framed encoder/decoder when no MaxFrameSize is set
+const DefaultMaxFrameSize = 1 << 20
+
+// ErrFrameTooLarge is returned when a frame's length prefix is above the configured maximum
+var ErrFrameTooLarge = errors.New("p2p: frame exceeds maximum frame size")
+
 type Decoder interface {
 	Decode(io.Reader, *RPC) error
 }
 
+// Encoder writes an RPC to the wire in the format its matching Decoder reads
+type Encoder interface {
+	Encode(io.Writer, *RPC) error
+}
+
 type GOBDecoder struct{}
 
 func (dec GOBDecoder) Decode(r io.Reader, msg *RPC) error {
@@ -39,3 +53,118 @@ func (dec DefaultDecoder) Decode(r io.Reader, msg *RPC) error {
 
 	return nil
 }
+
+// DefaultEncoder writes the type byte followed by the raw payload, as DefaultDecoder expects
+type DefaultEncoder struct{}
+
+func (enc DefaultEncoder) Encode(w io.Writer, msg *RPC) error {
+	if msg.Stream {
+		_, err := w.Write([]byte{IncomingStream})
+		return err
+	}
+
+	_, err := w.Write(append([]byte{IncomingMessage}, msg.Payload...))
+	return err
+}
+
+// ------------------------------- xxxxxxx ----------------------------------- //
+
+// ------------------------- Length Prefixed Framing ------------------------- //
+
+/*
+A frame is a type byte (IncomingMessage or IncomingStream), the payload length as
+an unsigned varint and then exactly that many payload bytes. Stream frames carry no
+payload, the raw stream follows them on the connection.
+*/
+
+type FramedEncoder struct {
+	MaxFrameSize int // 0 means DefaultMaxFrameSize
+}
+
+type FramedDecoder struct {
+	MaxFrameSize int // 0 means DefaultMaxFrameSize
+}
+
+func (enc FramedEncoder) Encode(w io.Writer, msg *RPC) error {
+	typ, payload := byte(IncomingMessage), msg.Payload
+	if msg.Stream {
+		typ, payload = IncomingStream, nil
+	}
+
+	if max := maxFrameSize(enc.MaxFrameSize); len(payload) > max {
+		return fmt.Errorf("%w: %d > %d bytes", ErrFrameTooLarge, len(payload), max)
+	}
+
+	buf := make([]byte, 1+binary.MaxVarintLen64+len(payload))
+	buf[0] = typ
+	n := 1 + binary.PutUvarint(buf[1:], uint64(len(payload)))
+	n += copy(buf[n:], payload)
+
+	// one Write so the frame is never split by another writer on the same connection
+	_, err := w.Write(buf[:n])
+	return err
+}
+
+func (dec FramedDecoder) Decode(r io.Reader, msg *RPC) error {
+	br := &byteReader{r: r}
+
+	typ, err := br.ReadByte()
+	if err != nil {
+		return err
+	}
+
+	size, err := binary.ReadUvarint(br)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+
+	switch typ {
+	case IncomingStream:
+		if size != 0 {
+			return fmt.Errorf("p2p: stream frame with a %d byte payload", size)
+		}
+		msg.Stream = true
+		return nil
+	case IncomingMessage:
+	default:
+		return fmt.Errorf("p2p: unknown frame type 0x%x", typ)
+	}
+
+	if max := maxFrameSize(dec.MaxFrameSize); size > uint64(max) {
+		return fmt.Errorf("%w: %d > %d bytes", ErrFrameTooLarge, size, max)
+	}
+
+	msg.Payload = make([]byte, size)
+	if _, err := io.ReadFull(r, msg.Payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+
+	return nil
+}
+
+func maxFrameSize(n int) int {
+	if n <= 0 {
+		return DefaultMaxFrameSize
+	}
+	return n
+}
+
+// byteReader reads one byte at a time so that decoding the varint never consumes
+// bytes that belong to the payload or to a stream that follows the frame
+type byteReader struct {
+	r   io.Reader
+	buf [1]byte
+}
+
+func (b *byteReader) ReadByte() (byte, error) {
+	if _, err := io.ReadFull(b.r, b.buf[:]); err != nil {
+		return 0, err
+	}
+	return b.buf[0], nil
+}
@@ -0,0 +1,48 @@
+package p2p
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFramedEncodeDecode(t *testing.T) {
+	var (
+		buf     = new(bytes.Buffer)
+		enc     = FramedEncoder{}
+		dec     = FramedDecoder{}
+		payload = bytes.Repeat([]byte("nimbus"), 1000) // well past the old 1028 byte read
+	)
+
+	assert.Nil(t, enc.Encode(buf, &RPC{Payload: payload}))
+	assert.Nil(t, enc.Encode(buf, &RPC{Stream: true}))
+	assert.Nil(t, enc.Encode(buf, &RPC{Payload: []byte("after the stream")}))
+
+	// hand the decoder one byte per Read, as if every byte arrived in its own TCP segment
+	r := iotest.OneByteReader(buf)
+
+	var msg RPC
+	assert.Nil(t, dec.Decode(r, &msg))
+	assert.Equal(t, payload, msg.Payload)
+
+	msg = RPC{}
+	assert.Nil(t, dec.Decode(r, &msg))
+	assert.True(t, msg.Stream)
+
+	msg = RPC{}
+	assert.Nil(t, dec.Decode(r, &msg))
+	assert.Equal(t, []byte("after the stream"), msg.Payload)
+}
+
+func TestFramedDecoderRejectsOversizedFrames(t *testing.T) {
+	buf := new(bytes.Buffer)
+	assert.Nil(t, FramedEncoder{MaxFrameSize: 64}.Encode(buf, &RPC{Payload: make([]byte, 64)}))
+	assert.True(t, errors.Is(FramedEncoder{MaxFrameSize: 32}.Encode(buf, &RPC{Payload: make([]byte, 64)}), ErrFrameTooLarge))
+
+	var msg RPC
+	err := FramedDecoder{MaxFrameSize: 32}.Decode(buf, &msg)
+	assert.True(t, errors.Is(err, ErrFrameTooLarge))
+}
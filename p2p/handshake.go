@@ -1,5 +1,18 @@
 package p2p
 
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
 type HandshakeFunc func(Peer) error
 
 // NOPHandshakeFunc are generally used for testing purposes
@@ -8,3 +21,213 @@ type HandshakeFunc func(Peer) error
 func NOPHandshakeFunc(Peer) error {
 	return nil
 }
+
+// ------------------------------- xxxxxxx ----------------------------------- //
+
+// ------------------------- Authenticated Handshake ------------------------- //
+
+/*
+The authenticated handshake proves that the remote end holds the private key of the
+Ed25519 identity it claims. Both sides run the same two steps at the same time:
+
+ 1. hello: magic | version (2) | public key (32) | nonce (32) | listen addr length (2) | listen addr
+ 2. proof: an Ed25519 signature (64) over the remote's nonce and the contents of both hellos
+
+Signing the nonce the other side just picked means a recorded proof can never be replayed,
+and signing both hellos binds the version and the listen address to the identity. Once the
+proofs check out the peer's ID is the hex encoded public key.
+*/
+
+const (
+	ProtocolVersion  = 1
+	handshakeTimeout = 10 * time.Second
+	handshakeMagic   = "NMBS"
+	handshakeContext = "nimbusfs handshake v1"
+	nonceSize        = 32
+	maxListenAddrLen = 512
+)
+
+var (
+	ErrHandshakeVersion  = errors.New("p2p: unsupported protocol version")
+	ErrHandshakeProof    = errors.New("p2p: handshake signature does not match the claimed identity")
+	ErrSelfConnection    = errors.New("p2p: connected to ourselves")
+	ErrPeerNotAuthorized = errors.New("p2p: peer identity not authorized")
+)
+
+// Identity is the long lived Ed25519 key pair a node is known by
+type Identity struct {
+	PublicKey  ed25519.PublicKey
+	PrivateKey ed25519.PrivateKey
+}
+
+type HandshakeConfig struct {
+	Identity   *Identity
+	ListenAddr string                // the address other nodes can dial us on, announced in the hello
+	Authorize  func(id string) error // optional, lets the node refuse identities it does not trust
+}
+
+type hello struct {
+	version    uint16
+	publicKey  ed25519.PublicKey
+	nonce      []byte
+	listenAddr string
+	raw        []byte // the hello exactly as it went over the wire, both proofs sign it
+}
+
+// identifiable is implemented by peers that can carry the identity the handshake established
+type identifiable interface {
+	setIdentity(id, listenAddr string)
+}
+
+func NewIdentity() (*Identity, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{PublicKey: pub, PrivateKey: priv}, nil
+}
+
+// ID is the hex encoded public key, the name peers know this node by
+func (i *Identity) ID() string {
+	return hex.EncodeToString(i.PublicKey)
+}
+
+// NewAuthHandshakeFunc returns a HandshakeFunc that runs the authenticated handshake with cfg.Identity
+func NewAuthHandshakeFunc(cfg HandshakeConfig) HandshakeFunc {
+	return func(p Peer) error {
+		p.SetDeadline(time.Now().Add(handshakeTimeout))
+		defer p.SetDeadline(time.Time{})
+
+		remote, err := authenticate(p, cfg)
+		if err != nil {
+			return err
+		}
+
+		// over TLS the certificate must belong to the identity we just authenticated, otherwise
+		// the encrypted session could end at someone other than the peer we think we talk to
+		if key, ok := tlsPeerKey(p); ok && !bytes.Equal(key, remote.publicKey) {
+			return ErrTLSIdentityMismatch
+		}
+
+		if ip, ok := p.(identifiable); ok {
+			ip.setIdentity(hex.EncodeToString(remote.publicKey), remote.listenAddr)
+		}
+
+		return nil
+	}
+}
+
+func authenticate(conn net.Conn, cfg HandshakeConfig) (*hello, error) {
+	local := &hello{
+		version:    ProtocolVersion,
+		publicKey:  cfg.Identity.PublicKey,
+		nonce:      make([]byte, nonceSize),
+		listenAddr: cfg.ListenAddr,
+	}
+	if _, err := io.ReadFull(rand.Reader, local.nonce); err != nil {
+		return nil, err
+	}
+	local.raw = local.encode()
+
+	// both ends write before they read, so we write in the background in case the
+	// connection can't buffer a whole hello (net.Pipe can't buffer anything)
+	written := writeAsync(conn, local.raw)
+	remote, err := readHello(conn)
+	if werr := <-written; err == nil {
+		err = werr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if remote.version != ProtocolVersion {
+		return nil, fmt.Errorf("%w: %d, we speak %d", ErrHandshakeVersion, remote.version, ProtocolVersion)
+	}
+	if bytes.Equal(remote.publicKey, local.publicKey) {
+		return nil, ErrSelfConnection
+	}
+
+	proof := ed25519.Sign(cfg.Identity.PrivateKey, transcript(remote.nonce, local.raw, remote.raw))
+	written = writeAsync(conn, proof)
+	remoteProof := make([]byte, ed25519.SignatureSize)
+	_, err = io.ReadFull(conn, remoteProof)
+	if werr := <-written; err == nil {
+		err = werr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !ed25519.Verify(remote.publicKey, transcript(local.nonce, remote.raw, local.raw), remoteProof) {
+		return nil, ErrHandshakeProof
+	}
+
+	if cfg.Authorize != nil {
+		if err := cfg.Authorize(hex.EncodeToString(remote.publicKey)); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrPeerNotAuthorized, err)
+		}
+	}
+
+	return remote, nil
+}
+
+func writeAsync(w io.Writer, b []byte) <-chan error {
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := w.Write(b)
+		errCh <- err
+	}()
+	return errCh
+}
+
+// transcript is what a proof signs: the nonce chosen by the verifier, the signer's hello and the verifier's hello
+func transcript(nonce, signerHello, verifierHello []byte) []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteString(handshakeContext)
+	buf.Write(nonce)
+	buf.Write(signerHello)
+	buf.Write(verifierHello)
+	return buf.Bytes()
+}
+
+func (h *hello) encode() []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteString(handshakeMagic)
+	binary.Write(buf, binary.BigEndian, h.version)
+	buf.Write(h.publicKey)
+	buf.Write(h.nonce)
+	binary.Write(buf, binary.BigEndian, uint16(len(h.listenAddr)))
+	buf.WriteString(h.listenAddr)
+	return buf.Bytes()
+}
+
+func readHello(r io.Reader) (*hello, error) {
+	fixed := make([]byte, len(handshakeMagic)+2+ed25519.PublicKeySize+nonceSize+2)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return nil, err
+	}
+
+	if string(fixed[:len(handshakeMagic)]) != handshakeMagic {
+		return nil, errors.New("p2p: remote does not speak the nimbusfs handshake")
+	}
+
+	rest := fixed[len(handshakeMagic):]
+	h := &hello{
+		version:   binary.BigEndian.Uint16(rest[0:2]),
+		publicKey: ed25519.PublicKey(rest[2 : 2+ed25519.PublicKeySize]),
+		nonce:     rest[2+ed25519.PublicKeySize : 2+ed25519.PublicKeySize+nonceSize],
+	}
+
+	addrLen := binary.BigEndian.Uint16(rest[len(rest)-2:])
+	if addrLen > maxListenAddrLen {
+		return nil, fmt.Errorf("p2p: listen address of %d bytes", addrLen)
+	}
+	addr := make([]byte, addrLen)
+	if _, err := io.ReadFull(r, addr); err != nil {
+		return nil, err
+	}
+
+	h.listenAddr = string(addr)
+	h.raw = append(fixed, addr...)
+	return h, nil
+}
@@ -0,0 +1,73 @@
+package p2p
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func handshakePair(a, b HandshakeConfig) (*TCPPeer, *TCPPeer, error, error) {
+	c1, c2 := net.Pipe()
+	p1, p2 := NewTCPPeer(c1, true), NewTCPPeer(c2, false)
+
+	errCh := make(chan error)
+	go func() { errCh <- NewAuthHandshakeFunc(b)(p2) }()
+	err1 := NewAuthHandshakeFunc(a)(p1)
+	err2 := <-errCh
+
+	return p1, p2, err1, err2
+}
+
+func TestAuthHandshakeExchangesIdentities(t *testing.T) {
+	alice, _ := NewIdentity()
+	bob, _ := NewIdentity()
+
+	p1, p2, err1, err2 := handshakePair(
+		HandshakeConfig{Identity: alice, ListenAddr: ":3000"},
+		HandshakeConfig{Identity: bob, ListenAddr: ":4000"},
+	)
+	assert.Nil(t, err1)
+	assert.Nil(t, err2)
+
+	// each side sees the other's identity and listen address
+	assert.Equal(t, bob.ID(), p1.ID())
+	assert.Equal(t, ":4000", p1.ListenAddr())
+	assert.Equal(t, alice.ID(), p2.ID())
+	assert.Equal(t, ":3000", p2.ListenAddr())
+}
+
+func TestAuthHandshakeRejectsImpostors(t *testing.T) {
+	alice, _ := NewIdentity()
+	bob, _ := NewIdentity()
+	mallory, _ := NewIdentity()
+
+	// mallory claims bob's public key but can only sign with her own private key
+	impostor := &Identity{PublicKey: bob.PublicKey, PrivateKey: mallory.PrivateKey}
+
+	_, _, err, _ := handshakePair(
+		HandshakeConfig{Identity: alice},
+		HandshakeConfig{Identity: impostor},
+	)
+	assert.True(t, errors.Is(err, ErrHandshakeProof))
+}
+
+func TestAuthHandshakeAuthorize(t *testing.T) {
+	alice, _ := NewIdentity()
+	bob, _ := NewIdentity()
+
+	onlyAlice := func(id string) error {
+		if id != alice.ID() {
+			return errors.New("unknown node")
+		}
+		return nil
+	}
+
+	_, _, err1, err2 := handshakePair(
+		HandshakeConfig{Identity: alice, Authorize: onlyAlice},
+		HandshakeConfig{Identity: bob, Authorize: onlyAlice},
+	)
+	assert.True(t, errors.Is(err1, ErrPeerNotAuthorized))
+	assert.Nil(t, err2)
+}
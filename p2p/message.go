@@ -1,5 +1,7 @@
 package p2p
 
+import "io"
+
 const (
 	IncomingMessage = 0x1
 	IncomingStream  = 0x2
@@ -13,4 +15,5 @@ type RPC struct {
 	From    string
 	Payload []byte
 	Stream  bool
+	Conn    io.ReadWriteCloser // the stream the remote opened, set on Stream RPCs
 }
@@ -0,0 +1,571 @@
+package p2p
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+/*
+Session multiplexes many independent streams over a single connection, in the spirit of yamux.
+
+Every frame starts with a 12 byte header:
+
+	version (1) | type (1) | flags (2) | stream id (4) | length (4)
+
+For data frames length is the number of payload bytes that follow, for window updates it is the
+number of bytes the receiver grants the sender on top of its current window. Each stream starts
+with initialStreamWindow bytes of credit in both directions, so a slow reader only ever stalls its
+own stream and never the connection. Stream 0 is the control stream, it exists from the start on
+both sides and carries the regular messages. The dialing side opens odd stream ids and the
+accepting side even ones so the two never collide.
+*/
+
+const (
+	muxVersion    = 0
+	muxHeaderSize = 12
+
+	muxTypeData         = 0x0
+	muxTypeWindowUpdate = 0x1
+	muxTypeGoAway       = 0x2
+
+	muxFlagSYN = 0x1 // opens a new stream
+	muxFlagFIN = 0x4 // the sender will not write to the stream anymore
+	muxFlagRST = 0x8 // the sender abandoned the stream
+
+	controlStreamID     = 0
+	initialStreamWindow = 256 * 1024
+	maxDataFrameSize    = 32 * 1024
+	acceptBacklog       = 256
+)
+
+var (
+	ErrSessionClosed = errors.New("p2p: session closed")
+	ErrStreamClosed  = errors.New("p2p: stream closed")
+	ErrStreamReset   = errors.New("p2p: stream reset by peer")
+)
+
+// ----------------------------- Core Structures ----------------------------- //
+
+type Session struct {
+	conn    io.ReadWriteCloser
+	writeMu sync.Mutex // writeMu keeps frames from different streams from interleaving
+
+	mu      sync.Mutex
+	streams map[uint32]*Stream
+	nextID  uint32
+
+	control   *Stream
+	acceptCh  chan *Stream
+	closed    chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+}
+
+type Stream struct {
+	id      uint32
+	session *Session
+
+	mu           sync.Mutex
+	recvBuf      bytes.Buffer
+	recvWindow   uint32 // how many more bytes the remote may send us
+	consumed     uint32 // bytes read since the last window update we sent
+	sendWindow   uint32 // how many more bytes we may send the remote
+	readClosed   bool   // we stopped reading, incoming data is dropped
+	writeClosed  bool   // we sent FIN
+	remoteClosed bool   // the remote sent FIN
+	reset        bool
+
+	readCh chan struct{} // signalled when data or a FIN arrives
+	sendCh chan struct{} // signalled when the remote grants more window
+}
+
+// ------------------------------- xxxxxxx ----------------------------------- //
+
+// ------------------- Session and Stream Initialization --------------------- //
+
+func NewSession(conn io.ReadWriteCloser, outbound bool) *Session {
+	s := &Session{
+		conn:     conn,
+		streams:  make(map[uint32]*Stream),
+		acceptCh: make(chan *Stream, acceptBacklog),
+		closed:   make(chan struct{}),
+		nextID:   2,
+	}
+	if outbound {
+		s.nextID = 1
+	}
+
+	s.control = newStream(s, controlStreamID)
+	s.streams[controlStreamID] = s.control
+
+	go s.recvLoop()
+
+	return s
+}
+
+func newStream(s *Session, id uint32) *Stream {
+	return &Stream{
+		id:         id,
+		session:    s,
+		recvWindow: initialStreamWindow,
+		sendWindow: initialStreamWindow,
+		readCh:     make(chan struct{}, 1),
+		sendCh:     make(chan struct{}, 1),
+	}
+}
+
+// ------------------------------- xxxxxxx ----------------------------------- //
+
+// ---------------- Methods of Session for Stream Management ----------------- //
+
+/* Index
+1. Control: The control stream shared by both sides
+2. Open: Open a new stream to the remote
+3. Accept: Wait for the remote to open a stream
+4. Close: Close the session and every stream on it
+5. Closed: Channel closed once the session is gone
+*/
+
+// 1. Control ---------------------------//
+func (s *Session) Control() *Stream {
+	return s.control
+}
+
+// 2. Open ---------------------------//
+func (s *Session) Open() (*Stream, error) {
+	s.mu.Lock()
+	if s.isClosed() {
+		s.mu.Unlock()
+		return nil, ErrSessionClosed
+	}
+	st := newStream(s, s.nextID)
+	s.streams[st.id] = st
+	s.nextID += 2
+	s.mu.Unlock()
+
+	if err := s.writeFrame(muxTypeWindowUpdate, muxFlagSYN, st.id, 0, nil); err != nil {
+		s.remove(st.id)
+		return nil, err
+	}
+
+	return st, nil
+}
+
+// 3. Accept ---------------------------//
+func (s *Session) Accept() (*Stream, error) {
+	select {
+	case st := <-s.acceptCh:
+		return st, nil
+	case <-s.closed:
+		return nil, s.closeErr
+	}
+}
+
+// 4. Close ---------------------------//
+func (s *Session) Close() error {
+	s.writeFrame(muxTypeGoAway, 0, 0, 0, nil) // best effort, the remote notices the closed connection anyway
+	s.closeWith(ErrSessionClosed)
+	return nil
+}
+
+// 5. Closed ---------------------------//
+func (s *Session) Closed() <-chan struct{} {
+	return s.closed
+}
+
+// ------------------------------- xxxxxxx ----------------------------------- //
+
+// ------------------------ Internal Methods of Session ---------------------- //
+
+/* Index
+1. recvLoop: Read frames off the connection and route them to their streams
+2. streamFor: Look up a stream, creating it when the frame opens one
+3. writeFrame: Write a single frame to the connection
+4. remove: Forget a stream once both sides closed it
+5. closeWith: Tear the session down and wake every stream
+*/
+
+// 1. recvLoop ---------------------------//
+func (s *Session) recvLoop() {
+	hdr := make([]byte, muxHeaderSize)
+
+	for {
+		if _, err := io.ReadFull(s.conn, hdr); err != nil {
+			s.closeWith(ErrSessionClosed)
+			return
+		}
+
+		if hdr[0] != muxVersion {
+			s.closeWith(fmt.Errorf("p2p: unsupported mux version %d", hdr[0]))
+			return
+		}
+
+		var (
+			typ    = hdr[1]
+			flags  = binary.BigEndian.Uint16(hdr[2:4])
+			id     = binary.BigEndian.Uint32(hdr[4:8])
+			length = binary.BigEndian.Uint32(hdr[8:12])
+			err    error
+		)
+
+		switch typ {
+		case muxTypeData:
+			err = s.handleData(id, flags, length)
+		case muxTypeWindowUpdate:
+			err = s.handleWindowUpdate(id, flags, length)
+		case muxTypeGoAway:
+			err = ErrSessionClosed
+		default:
+			err = fmt.Errorf("p2p: unknown mux frame type 0x%x", typ)
+		}
+
+		if err != nil {
+			s.closeWith(err)
+			return
+		}
+	}
+}
+
+func (s *Session) handleData(id uint32, flags uint16, length uint32) error {
+	st, err := s.streamFor(id, flags)
+	if err != nil {
+		return err
+	}
+
+	if st == nil {
+		// the stream is already gone on our side, skip its payload
+		_, err := io.CopyN(io.Discard, s.conn, int64(length))
+		return err
+	}
+
+	if length > initialStreamWindow {
+		return fmt.Errorf("p2p: %d byte data frame on stream %d is larger than any window", length, id)
+	}
+
+	if length > 0 {
+		buf := make([]byte, length)
+		if _, err := io.ReadFull(s.conn, buf); err != nil {
+			return err
+		}
+		if err := st.receive(buf); err != nil {
+			return err
+		}
+	}
+
+	st.handleFlags(flags)
+	return nil
+}
+
+func (s *Session) handleWindowUpdate(id uint32, flags uint16, delta uint32) error {
+	st, err := s.streamFor(id, flags)
+	if err != nil || st == nil {
+		return err
+	}
+
+	st.grant(delta)
+	st.handleFlags(flags)
+	return nil
+}
+
+// 2. streamFor ---------------------------//
+func (s *Session) streamFor(id uint32, flags uint16) (*Stream, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if st, ok := s.streams[id]; ok {
+		return st, nil
+	}
+
+	if flags&muxFlagSYN == 0 {
+		return nil, nil
+	}
+
+	if id%2 == s.nextID%2 {
+		return nil, fmt.Errorf("p2p: remote opened stream %d from our id space", id)
+	}
+
+	st := newStream(s, id)
+	select {
+	case s.acceptCh <- st:
+		s.streams[id] = st
+		return st, nil
+	default:
+		// nobody is accepting, refuse the stream instead of buffering it forever
+		go s.writeFrame(muxTypeWindowUpdate, muxFlagRST, id, 0, nil)
+		return nil, nil
+	}
+}
+
+// 3. writeFrame ---------------------------//
+func (s *Session) writeFrame(typ byte, flags uint16, id uint32, length uint32, payload []byte) error {
+	if s.isClosed() {
+		return ErrSessionClosed
+	}
+
+	frame := make([]byte, muxHeaderSize+len(payload))
+	frame[0] = muxVersion
+	frame[1] = typ
+	binary.BigEndian.PutUint16(frame[2:4], flags)
+	binary.BigEndian.PutUint32(frame[4:8], id)
+	binary.BigEndian.PutUint32(frame[8:12], length)
+	copy(frame[muxHeaderSize:], payload)
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	if _, err := s.conn.Write(frame); err != nil {
+		go s.closeWith(ErrSessionClosed)
+		return err
+	}
+	return nil
+}
+
+// 4. remove ---------------------------//
+func (s *Session) remove(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	s.mu.Unlock()
+}
+
+// 5. closeWith ---------------------------//
+func (s *Session) closeWith(err error) {
+	s.closeOnce.Do(func() {
+		s.closeErr = err
+		close(s.closed)
+		s.conn.Close()
+
+		s.mu.Lock()
+		for _, st := range s.streams {
+			st.notify()
+		}
+		s.mu.Unlock()
+	})
+}
+
+func (s *Session) isClosed() bool {
+	select {
+	case <-s.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// ------------------------------- xxxxxxx ----------------------------------- //
+
+// ---------------------- Methods of Stream for I/O -------------------------- //
+
+/* Index
+1. Read: Read buffered data, granting the remote more window as it is consumed
+2. Write: Write data as long as the remote granted us window
+3. Close: Half close the stream and stop reading from it
+4. Reset: Abandon the stream on both sides
+*/
+
+// 1. Read ---------------------------//
+func (st *Stream) Read(p []byte) (int, error) {
+	for {
+		st.mu.Lock()
+		if st.recvBuf.Len() > 0 {
+			n, _ := st.recvBuf.Read(p)
+			st.consumed += uint32(n)
+
+			var delta uint32
+			if st.consumed >= initialStreamWindow/2 {
+				delta, st.consumed = st.consumed, 0
+				st.recvWindow += delta
+			}
+			st.mu.Unlock()
+
+			if delta > 0 {
+				st.session.writeFrame(muxTypeWindowUpdate, 0, st.id, delta, nil)
+			}
+			return n, nil
+		}
+
+		switch {
+		case st.reset:
+			st.mu.Unlock()
+			return 0, ErrStreamReset
+		case st.remoteClosed:
+			st.mu.Unlock()
+			return 0, io.EOF
+		case st.readClosed:
+			st.mu.Unlock()
+			return 0, ErrStreamClosed
+		case st.session.isClosed():
+			st.mu.Unlock()
+			return 0, st.session.closeErr
+		}
+		st.mu.Unlock()
+
+		<-st.readCh
+	}
+}
+
+// 2. Write ---------------------------//
+func (st *Stream) Write(p []byte) (int, error) {
+	written := 0
+
+	for len(p) > 0 {
+		st.mu.Lock()
+		switch {
+		case st.reset:
+			st.mu.Unlock()
+			return written, ErrStreamReset
+		case st.writeClosed:
+			st.mu.Unlock()
+			return written, ErrStreamClosed
+		case st.session.isClosed():
+			st.mu.Unlock()
+			return written, st.session.closeErr
+		}
+
+		if st.sendWindow == 0 {
+			st.mu.Unlock()
+			<-st.sendCh
+			continue
+		}
+
+		n := min(uint32(len(p)), st.sendWindow, maxDataFrameSize)
+		st.sendWindow -= n
+		st.mu.Unlock()
+
+		if err := st.session.writeFrame(muxTypeData, 0, st.id, n, p[:n]); err != nil {
+			return written, err
+		}
+
+		written += int(n)
+		p = p[n:]
+	}
+
+	return written, nil
+}
+
+// 3. Close ---------------------------//
+// Close tells the remote we are done writing and stops reading. The window of what we didn't
+// read is never handed back, a remote that still writes is reset (see receive), and so is
+// one that may be waiting for window when we close with data unread.
+func (st *Stream) Close() error {
+	st.mu.Lock()
+	if st.writeClosed {
+		st.mu.Unlock()
+		return nil
+	}
+
+	st.writeClosed = true
+	st.readClosed = true
+
+	unread := st.recvBuf.Len() > 0 && !st.remoteClosed && !st.reset
+	st.recvBuf.Reset()
+
+	done := st.remoteClosed || st.reset
+	st.mu.Unlock()
+
+	if unread {
+		return st.Reset()
+	}
+
+	st.notify()
+	if done {
+		st.session.remove(st.id)
+	}
+
+	return st.session.writeFrame(muxTypeWindowUpdate, muxFlagFIN, st.id, 0, nil)
+}
+
+// 4. Reset ---------------------------//
+func (st *Stream) Reset() error {
+	st.mu.Lock()
+	st.reset = true
+	st.mu.Unlock()
+
+	st.notify()
+	st.session.remove(st.id)
+
+	return st.session.writeFrame(muxTypeWindowUpdate, muxFlagRST, st.id, 0, nil)
+}
+
+// ------------------------------- xxxxxxx ----------------------------------- //
+
+// ------------------------ Internal Methods of Stream ----------------------- //
+
+func (st *Stream) receive(b []byte) error {
+	st.mu.Lock()
+	if uint32(len(b)) > st.recvWindow {
+		st.mu.Unlock()
+		return fmt.Errorf("p2p: stream %d sent %d bytes with a %d byte window", st.id, len(b), st.recvWindow)
+	}
+
+	if st.readClosed {
+		// nobody is going to read this, so the remote is told to stop rather than granted
+		// more. The receive loop never writes synchronously so it keeps draining the
+		// connection no matter what.
+		first := !st.reset
+		st.reset = true
+		st.mu.Unlock()
+
+		st.notify()
+		st.session.remove(st.id)
+		if first {
+			go st.session.writeFrame(muxTypeWindowUpdate, muxFlagRST, st.id, 0, nil)
+		}
+		return nil
+	}
+
+	st.recvWindow -= uint32(len(b))
+	st.recvBuf.Write(b)
+	st.mu.Unlock()
+
+	st.notify()
+	return nil
+}
+
+func (st *Stream) grant(delta uint32) {
+	if delta == 0 {
+		return
+	}
+
+	st.mu.Lock()
+	st.sendWindow += delta
+	st.mu.Unlock()
+
+	st.notify()
+}
+
+func (st *Stream) handleFlags(flags uint16) {
+	if flags&(muxFlagFIN|muxFlagRST) == 0 {
+		return
+	}
+
+	st.mu.Lock()
+	if flags&muxFlagFIN != 0 {
+		st.remoteClosed = true
+	}
+	if flags&muxFlagRST != 0 {
+		st.reset = true
+	}
+	done := st.reset || st.writeClosed
+	st.mu.Unlock()
+
+	st.notify()
+	if done {
+		st.session.remove(st.id)
+	}
+}
+
+// notify wakes up a blocked Read and a blocked Write without ever blocking itself
+func (st *Stream) notify() {
+	select {
+	case st.readCh <- struct{}{}:
+	default:
+	}
+	select {
+	case st.sendCh <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,145 @@
+package p2p
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newSessionPair() (*Session, *Session) {
+	a, b := net.Pipe()
+	return NewSession(a, true), NewSession(b, false)
+}
+
+func TestSessionConcurrentStreams(t *testing.T) {
+	client, server := newSessionPair()
+	defer client.Close()
+	defer server.Close()
+
+	const streams = 8
+	payload := bytes.Repeat([]byte("x"), 3*initialStreamWindow) // forces several window updates per stream
+
+	var wg sync.WaitGroup
+	for i := 0; i < streams; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			st, err := client.Open()
+			assert.Nil(t, err)
+			fmt.Fprintf(st, "%02d", i)
+			st.Write(payload)
+			st.Close()
+		}(i)
+	}
+
+	seen := make(map[string]bool)
+	for i := 0; i < streams; i++ {
+		st, err := server.Accept()
+		assert.Nil(t, err)
+
+		b, err := io.ReadAll(st)
+		assert.Nil(t, err)
+		assert.Equal(t, 2+len(payload), len(b))
+		seen[string(b[:2])] = true
+		st.Close()
+	}
+	wg.Wait()
+
+	assert.Equal(t, streams, len(seen))
+}
+
+func TestSessionFlowControlStallsOnlyTheSlowStream(t *testing.T) {
+	client, server := newSessionPair()
+	defer client.Close()
+	defer server.Close()
+
+	slow, _ := client.Open()
+	wrote := make(chan int)
+	go func() {
+		n, _ := slow.Write(make([]byte, initialStreamWindow+1))
+		wrote <- n
+	}()
+
+	slowRemote, _ := server.Accept()
+
+	// nobody reads the slow stream, so its writer must block on the window...
+	select {
+	case <-wrote:
+		t.Fatal("write went past the receive window")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// ...while the control stream keeps flowing
+	go client.Control().Write([]byte("ping"))
+	buf := make([]byte, 4)
+	_, err := io.ReadFull(server.Control(), buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "ping", string(buf))
+
+	// draining the slow stream lets the writer finish
+	go io.ReadAll(slowRemote)
+	select {
+	case n := <-wrote:
+		assert.Equal(t, initialStreamWindow+1, n)
+	case <-time.After(time.Second):
+		t.Fatal("writer never got more window")
+	}
+}
+
+func TestSessionCloseWakesStreams(t *testing.T) {
+	client, server := newSessionPair()
+
+	st, _ := client.Open()
+	remote, _ := server.Accept()
+
+	done := make(chan error)
+	go func() {
+		_, err := remote.Read(make([]byte, 1))
+		done <- err
+	}()
+
+	client.Close()
+	select {
+	case err := <-done:
+		assert.NotNil(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("reader was not woken up by the closed session")
+	}
+
+	_, err := st.Write([]byte("late"))
+	assert.NotNil(t, err)
+}
+
+func TestSessionClosedStreamStopsTheWriter(t *testing.T) {
+	client, server := newSessionPair()
+	defer client.Close()
+	defer server.Close()
+
+	st, _ := client.Open()
+	payload := make([]byte, 4*initialStreamWindow)
+	wrote := make(chan error)
+	var n int
+	go func() {
+		var err error
+		n, err = st.Write(payload)
+		wrote <- err
+	}()
+
+	// the remote refuses the stream without reading it, the writer must not push the rest
+	remote, _ := server.Accept()
+	remote.Close()
+
+	select {
+	case err := <-wrote:
+		assert.ErrorIs(t, err, ErrStreamReset)
+		assert.Less(t, n, len(payload))
+	case <-time.After(time.Second):
+		t.Fatal("writer was neither stopped nor finished")
+	}
+}
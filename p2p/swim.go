@@ -0,0 +1,539 @@
+package p2p
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+Membership keeps a view of the nodes of the network with SWIM: every ProbeInterval it pings
+one member, going round them all in a random order. A member that doesn't ack within
+ProbeTimeout is pinged through IndirectProbes others (ping-req), so a bad link between two
+nodes alone doesn't fail a member. When none of them gets an ack either it is suspected,
+and declared dead once it stayed suspected for SuspicionTimeout.
+
+What a node learns travels as gossip piggybacked on the pings and acks, every update a few
+times, more in bigger networks. Every member has an incarnation number only it raises: a
+member that hears it is suspected raises it and gossips that it is alive, which overrides
+the suspicion. A dead member coming back does the same, or a node sees it again directly,
+through Join. A member that leaves says so on its way out.
+
+A node that hears from a member it didn't know, or had as gone, answers with everything it
+knows, so a node joining through one contact gets the whole view at once, and one taken for
+dead hears of it and refutes.
+
+OnEvent reports when a member joins the view, leaves it, or fails. Membership doesn't talk
+to the network itself, Network carries its messages and HandleMessage answers them.
+*/
+
+const (
+	defaultProbeInterval  = time.Second
+	defaultProbeTimeout   = 500 * time.Millisecond
+	defaultIndirectProbes = 3
+	defaultSuspicionMult  = 5 // of ProbeInterval, the SuspicionTimeout
+	gossipRetransmitMult  = 3 // times log2 of the members, the times an update is sent
+	maxGossipPerMessage   = 8
+)
+
+type MemberState int
+
+const (
+	MemberAlive MemberState = iota + 1
+	MemberSuspect
+	MemberDead
+	MemberLeft
+)
+
+func (s MemberState) String() string {
+	switch s {
+	case MemberAlive:
+		return "alive"
+	case MemberSuspect:
+		return "suspect"
+	case MemberDead:
+		return "dead"
+	case MemberLeft:
+		return "left"
+	}
+	return "unknown"
+}
+
+// Member is a node as the view has it, and an update about it as gossip carries it
+type Member struct {
+	Contact
+	State       MemberState
+	Incarnation uint64
+}
+
+type MemberEventType int
+
+const (
+	EventJoin MemberEventType = iota + 1
+	EventLeave
+	EventFail
+)
+
+type MemberEvent struct {
+	Type   MemberEventType
+	Member Member
+}
+
+type SWIMOp int
+
+const (
+	SWIMPing SWIMOp = iota + 1
+	SWIMPingReq
+	SWIMAck
+)
+
+type SWIMMessage struct {
+	Op     SWIMOp
+	Target Contact  // for SWIMPingReq, who to ping
+	Gossip []Member // piggybacked updates
+}
+
+// SWIMNetwork carries a message to another node and returns its answer, an error when it
+// didn't come in time
+type SWIMNetwork interface {
+	CallSWIM(ctx context.Context, to Contact, msg SWIMMessage) (SWIMMessage, error)
+}
+
+type MembershipOpts struct {
+	Self             Contact
+	Network          SWIMNetwork
+	ProbeInterval    time.Duration
+	ProbeTimeout     time.Duration // how long a ping waits for its ack, a ping-req twice that
+	IndirectProbes   int
+	SuspicionTimeout time.Duration
+	OnEvent          func(MemberEvent) // called without locks held, never for the node itself
+}
+
+type Membership struct {
+	MembershipOpts
+
+	mu          sync.Mutex
+	incarnation uint64
+	members     map[string]*memberEntry // by ID, dead and left ones too so stale gossip can't bring them back
+	gossip      []*gossipItem
+	probeOrder  []string
+}
+
+type memberEntry struct {
+	Member
+	suspected time.Time
+}
+
+type gossipItem struct {
+	update Member
+	sent   int
+}
+
+// ------------------------------- xxxxxxx ----------------------------------- //
+
+// ------------------------- Membership Initialization ----------------------- //
+
+func NewMembership(opts MembershipOpts) *Membership {
+	if opts.ProbeInterval <= 0 {
+		opts.ProbeInterval = defaultProbeInterval
+	}
+	if opts.ProbeTimeout <= 0 {
+		opts.ProbeTimeout = min(defaultProbeTimeout, opts.ProbeInterval/2)
+	}
+	if opts.IndirectProbes <= 0 {
+		opts.IndirectProbes = defaultIndirectProbes
+	}
+	if opts.SuspicionTimeout <= 0 {
+		opts.SuspicionTimeout = defaultSuspicionMult * opts.ProbeInterval
+	}
+
+	return &Membership{
+		MembershipOpts: opts,
+		members:        make(map[string]*memberEntry),
+	}
+}
+
+// ------------------------------- xxxxxxx ----------------------------------- //
+
+// ------------------- Methods of Membership for the View -------------------- //
+
+/* Index
+1. Join: Add a node seen directly to the view, e.g. on a connection
+2. Leave: Tell the members the node is leaving
+3. Members: The members in the view, alive or suspected
+4. HandleMessage: Answer a ping or ping-req from another node
+*/
+
+// 1. Join ---------------------------//
+func (m *Membership) Join(c Contact) {
+	if c.ID == "" || c.ID == m.Self.ID {
+		return
+	}
+
+	m.mu.Lock()
+	var events []MemberEvent
+	e, ok := m.members[c.ID]
+	switch {
+	case !ok:
+		e = &memberEntry{Member: Member{Contact: c, State: MemberAlive}}
+		m.members[c.ID] = e
+		events = append(events, MemberEvent{Type: EventJoin, Member: e.Member})
+		m.queue(e.Member)
+	case e.State == MemberDead || e.State == MemberLeft:
+		// seen alive with our own eyes, which is as good as the member refuting it
+		e.State, e.Incarnation = MemberAlive, e.Incarnation+1
+		e.Addr = nonEmpty(c.Addr, e.Addr)
+		events = append(events, MemberEvent{Type: EventJoin, Member: e.Member})
+		m.queue(e.Member)
+	default:
+		e.Addr = nonEmpty(e.Addr, c.Addr)
+	}
+	m.mu.Unlock()
+
+	m.emit(events)
+}
+
+// 2. Leave ---------------------------//
+// Leave pings every member with the news, until ctx is done. The node should stop answering
+// after it, its Membership is done.
+func (m *Membership) Leave(ctx context.Context) {
+	m.mu.Lock()
+	m.incarnation++
+	left := Member{Contact: m.Self, State: MemberLeft, Incarnation: m.incarnation}
+	var targets []Contact
+	for _, e := range m.members {
+		if e.State == MemberAlive || e.State == MemberSuspect {
+			targets = append(targets, e.Contact)
+		}
+	}
+	m.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, c := range targets {
+		wg.Add(1)
+		go func(c Contact) {
+			defer wg.Done()
+			m.Network.CallSWIM(ctx, c, SWIMMessage{Op: SWIMPing, Gossip: []Member{left}})
+		}(c)
+	}
+	wg.Wait()
+}
+
+// 3. Members ---------------------------//
+// Members leaves the node itself out, sorted by ID
+func (m *Membership) Members() []Member {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var view []Member
+	for _, e := range m.members {
+		if e.State == MemberAlive || e.State == MemberSuspect {
+			view = append(view, e.Member)
+		}
+	}
+	sort.Slice(view, func(i, j int) bool { return view[i].ID < view[j].ID })
+	return view
+}
+
+// 4. HandleMessage ---------------------------//
+// HandleMessage fails a ping-req whose target didn't ack. A sender the view has as dead gets
+// told so, to refute it, rather than taken back on its word.
+func (m *Membership) HandleMessage(ctx context.Context, from Contact, msg SWIMMessage) (SWIMMessage, error) {
+	m.mu.Lock()
+	e, known := m.members[from.ID]
+	known = known && (e.State == MemberAlive || e.State == MemberSuspect)
+	m.mu.Unlock()
+
+	m.merge(append([]Member{{Contact: from, State: MemberAlive}}, msg.Gossip...)) // adds it when it is new
+
+	ack := SWIMMessage{Op: SWIMAck}
+	if msg.Op == SWIMPingReq {
+		ctx, cancel := context.WithTimeout(ctx, m.ProbeTimeout)
+		defer cancel()
+
+		resp, err := m.Network.CallSWIM(ctx, msg.Target, SWIMMessage{Op: SWIMPing, Gossip: m.piggyback()})
+		if err != nil {
+			return SWIMMessage{}, err
+		}
+		m.merge(resp.Gossip)
+	}
+
+	if known {
+		ack.Gossip = m.piggyback()
+	} else {
+		ack.Gossip = m.everything()
+	}
+	return ack, nil
+}
+
+// ------------------------------- xxxxxxx ----------------------------------- //
+
+// ------------------ Methods of Membership for Probing ---------------------- //
+
+/* Index
+1. Run: Probe a member every ProbeInterval until ctx is done
+2. probe: Ping the next member, through others if it doesn't ack, and suspect it if none does
+3. expireSuspects: Declare dead the members suspected for too long
+*/
+
+// 1. Run ---------------------------//
+func (m *Membership) Run(ctx context.Context) {
+	ticker := time.NewTicker(m.ProbeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.probe(ctx)
+			m.expireSuspects()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// 2. probe ---------------------------//
+func (m *Membership) probe(ctx context.Context) {
+	target, ok := m.nextTarget()
+	if !ok {
+		return
+	}
+
+	pingCtx, cancel := context.WithTimeout(ctx, m.ProbeTimeout)
+	resp, err := m.Network.CallSWIM(pingCtx, target.Contact, SWIMMessage{Op: SWIMPing, Gossip: m.piggyback()})
+	cancel()
+	if err == nil {
+		m.merge(resp.Gossip)
+		return
+	}
+	if ctx.Err() != nil {
+		return
+	}
+
+	// maybe it's only the link between us, ask others to try
+	helpers := m.randomMembers(m.IndirectProbes, target.ID)
+	acks := make(chan SWIMMessage, len(helpers))
+	reqCtx, cancel := context.WithTimeout(ctx, 2*m.ProbeTimeout)
+	defer cancel()
+	for _, c := range helpers {
+		go func(c Contact) {
+			resp, err := m.Network.CallSWIM(reqCtx, c, SWIMMessage{Op: SWIMPingReq, Target: target.Contact, Gossip: m.piggyback()})
+			if err == nil {
+				acks <- resp
+			} else {
+				acks <- SWIMMessage{}
+			}
+		}(c)
+	}
+	for range helpers {
+		if resp := <-acks; resp.Op == SWIMAck {
+			m.merge(resp.Gossip)
+			return
+		}
+	}
+
+	m.merge([]Member{{Contact: target.Contact, State: MemberSuspect, Incarnation: target.Incarnation}})
+}
+
+// 3. expireSuspects ---------------------------//
+func (m *Membership) expireSuspects() {
+	m.mu.Lock()
+	var dead []Member
+	for _, e := range m.members {
+		if e.State == MemberSuspect && time.Since(e.suspected) >= m.SuspicionTimeout {
+			dead = append(dead, Member{Contact: e.Contact, State: MemberDead, Incarnation: e.Incarnation})
+		}
+	}
+	m.mu.Unlock()
+
+	m.merge(dead)
+}
+
+// ------------------------------- xxxxxxx ----------------------------------- //
+
+// ---------------------------------- Helpers -------------------------------- //
+
+// merge applies gossip to the view. An update wins over what the view has with a higher
+// incarnation, or at the same one when it is worse news: suspect over alive, dead or left
+// over both.
+func (m *Membership) merge(updates []Member) {
+	var events []MemberEvent
+
+	m.mu.Lock()
+	for _, u := range updates {
+		if u.ID == "" {
+			continue
+		}
+		if u.ID == m.Self.ID {
+			// refute, the members only believe the node itself
+			if (u.State == MemberSuspect || u.State == MemberDead) && u.Incarnation >= m.incarnation {
+				m.incarnation = u.Incarnation + 1
+				m.queue(Member{Contact: m.Self, State: MemberAlive, Incarnation: m.incarnation})
+			}
+			continue
+		}
+
+		e, ok := m.members[u.ID]
+		if !ok {
+			e = &memberEntry{Member: u}
+			m.members[u.ID] = e
+			if u.State == MemberSuspect {
+				e.suspected = time.Now()
+			}
+			if u.State == MemberAlive || u.State == MemberSuspect {
+				events = append(events, MemberEvent{Type: EventJoin, Member: u})
+			}
+			m.queue(u)
+			continue
+		}
+
+		gone := e.State == MemberDead || e.State == MemberLeft
+		switch u.State {
+		case MemberAlive:
+			if u.Incarnation <= e.Incarnation {
+				continue
+			}
+			if gone {
+				events = append(events, MemberEvent{Type: EventJoin, Member: u})
+			}
+		case MemberSuspect:
+			if gone || u.Incarnation < e.Incarnation || (u.Incarnation == e.Incarnation && e.State == MemberSuspect) {
+				continue
+			}
+			e.suspected = time.Now()
+		case MemberDead, MemberLeft:
+			if gone || u.Incarnation < e.Incarnation {
+				continue
+			}
+			if u.State == MemberDead {
+				events = append(events, MemberEvent{Type: EventFail, Member: u})
+			} else {
+				events = append(events, MemberEvent{Type: EventLeave, Member: u})
+			}
+		default:
+			continue
+		}
+
+		e.State, e.Incarnation = u.State, u.Incarnation
+		e.Addr = nonEmpty(u.Addr, e.Addr)
+		m.queue(e.Member)
+	}
+	m.mu.Unlock()
+
+	m.emit(events)
+}
+
+// queue gossips an update, replacing what was queued about the same member. The caller holds mu.
+func (m *Membership) queue(u Member) {
+	for i, item := range m.gossip {
+		if item.update.ID == u.ID {
+			m.gossip = append(m.gossip[:i], m.gossip[i+1:]...)
+			break
+		}
+	}
+	m.gossip = append(m.gossip, &gossipItem{update: u})
+}
+
+// piggyback takes the updates sent the least times for a message, dropping those sent enough
+func (m *Membership) piggyback() []Member {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	limit := gossipRetransmitMult * int(math.Ceil(math.Log2(float64(len(m.members)+2))))
+
+	sort.SliceStable(m.gossip, func(i, j int) bool { return m.gossip[i].sent < m.gossip[j].sent })
+	var updates []Member
+	for _, item := range m.gossip {
+		if len(updates) == maxGossipPerMessage {
+			break
+		}
+		item.sent++
+		updates = append(updates, item.update)
+	}
+
+	kept := m.gossip[:0]
+	for _, item := range m.gossip {
+		if item.sent < limit {
+			kept = append(kept, item)
+		}
+	}
+	m.gossip = kept
+	return updates
+}
+
+// everything is the whole view as updates, the node itself included
+func (m *Membership) everything() []Member {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	all := []Member{{Contact: m.Self, State: MemberAlive, Incarnation: m.incarnation}}
+	for _, e := range m.members {
+		all = append(all, e.Member)
+	}
+	return all
+}
+
+// nextTarget goes round the members in a random order, reshuffled every round
+func (m *Membership) nextTarget() (Member, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for {
+		if len(m.probeOrder) == 0 {
+			for id, e := range m.members {
+				if e.State == MemberAlive || e.State == MemberSuspect {
+					m.probeOrder = append(m.probeOrder, id)
+				}
+			}
+			if len(m.probeOrder) == 0 {
+				return Member{}, false
+			}
+			rand.Shuffle(len(m.probeOrder), func(i, j int) {
+				m.probeOrder[i], m.probeOrder[j] = m.probeOrder[j], m.probeOrder[i]
+			})
+		}
+
+		id := m.probeOrder[0]
+		m.probeOrder = m.probeOrder[1:]
+		if e := m.members[id]; e.State == MemberAlive || e.State == MemberSuspect {
+			return e.Member, true
+		}
+	}
+}
+
+// randomMembers picks up to n alive members other than except
+func (m *Membership) randomMembers(n int, except string) []Contact {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var picks []Contact
+	for id, e := range m.members {
+		if id != except && e.State == MemberAlive {
+			picks = append(picks, e.Contact)
+		}
+	}
+	rand.Shuffle(len(picks), func(i, j int) { picks[i], picks[j] = picks[j], picks[i] })
+	if len(picks) > n {
+		picks = picks[:n]
+	}
+	return picks
+}
+
+func (m *Membership) emit(events []MemberEvent) {
+	if m.OnEvent == nil {
+		return
+	}
+	for _, ev := range events {
+		m.OnEvent(ev)
+	}
+}
+
+func nonEmpty(a string, b string) string {
+	if a != "" {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,146 @@
+package p2p
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// swimHub delivers messages between the Memberships of a test, with nodes and links that can fail
+type swimHub struct {
+	mu      sync.Mutex
+	nodes   map[string]*Membership
+	down    map[string]bool
+	cut     map[[2]string]bool
+	events  map[string][]MemberEvent // by the node that saw them
+	eventMu sync.Mutex
+}
+
+type swimLink struct {
+	hub  *swimHub
+	self Contact
+}
+
+func (l swimLink) CallSWIM(ctx context.Context, to Contact, msg SWIMMessage) (SWIMMessage, error) {
+	h := l.hub
+	h.mu.Lock()
+	m, ok := h.nodes[to.ID]
+	unreachable := !ok || h.down[to.ID] || h.down[l.self.ID] || h.cut[[2]string{l.self.ID, to.ID}] || h.cut[[2]string{to.ID, l.self.ID}]
+	h.mu.Unlock()
+
+	if unreachable {
+		<-ctx.Done() // a lost message is only noticed by the timeout
+		return SWIMMessage{}, ctx.Err()
+	}
+	return m.HandleMessage(ctx, l.self, msg)
+}
+
+func newSwimCluster(t *testing.T, size int) (*swimHub, []*Membership) {
+	hub := &swimHub{
+		nodes:  make(map[string]*Membership),
+		down:   make(map[string]bool),
+		cut:    make(map[[2]string]bool),
+		events: make(map[string][]MemberEvent),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	var members []*Membership
+	for i := 0; i < size; i++ {
+		self := Contact{ID: fmt.Sprintf("node-%d", i), Addr: fmt.Sprintf(":%d", 9100+i)}
+		m := NewMembership(MembershipOpts{
+			Self:          self,
+			Network:       swimLink{hub: hub, self: self},
+			ProbeInterval: 20 * time.Millisecond,
+			ProbeTimeout:  8 * time.Millisecond,
+			OnEvent: func(ev MemberEvent) {
+				hub.eventMu.Lock()
+				defer hub.eventMu.Unlock()
+				hub.events[self.ID] = append(hub.events[self.ID], ev)
+			},
+		})
+		hub.nodes[self.ID] = m
+		members = append(members, m)
+	}
+
+	// everyone joins through node-0
+	for _, m := range members[1:] {
+		m.Join(members[0].Self)
+		go m.Run(ctx)
+	}
+	go members[0].Run(ctx)
+	return hub, members
+}
+
+func (h *swimHub) saw(node string, typ MemberEventType, member string) bool {
+	h.eventMu.Lock()
+	defer h.eventMu.Unlock()
+	for _, ev := range h.events[node] {
+		if ev.Type == typ && ev.Member.ID == member {
+			return true
+		}
+	}
+	return false
+}
+
+func viewSize(m *Membership) int { return len(m.Members()) }
+
+func TestMembershipSpreadsAndDetectsFailures(t *testing.T) {
+	hub, members := newSwimCluster(t, 6)
+
+	for _, m := range members {
+		assert.Eventually(t, func() bool { return viewSize(m) == 5 }, 2*time.Second, 10*time.Millisecond, "%s sees %v", m.Self.ID, m.Members())
+	}
+
+	hub.mu.Lock()
+	hub.down["node-3"] = true
+	hub.mu.Unlock()
+
+	for _, m := range members {
+		if m.Self.ID == "node-3" {
+			continue
+		}
+		assert.Eventually(t, func() bool { return hub.saw(m.Self.ID, EventFail, "node-3") }, 3*time.Second, 10*time.Millisecond, "%s missed the failure", m.Self.ID)
+		assert.Equal(t, 4, viewSize(m))
+	}
+}
+
+func TestMembershipSurvivesABadLink(t *testing.T) {
+	hub, members := newSwimCluster(t, 4)
+	for _, m := range members {
+		assert.Eventually(t, func() bool { return viewSize(m) == 3 }, 2*time.Second, 10*time.Millisecond)
+	}
+
+	// node-0 and node-1 can't talk, the others ping for them
+	hub.mu.Lock()
+	hub.cut[[2]string{"node-0", "node-1"}] = true
+	hub.mu.Unlock()
+
+	time.Sleep(500 * time.Millisecond)
+	for _, m := range members {
+		assert.Equal(t, 3, viewSize(m), "%s sees %v", m.Self.ID, m.Members())
+		assert.False(t, hub.saw(m.Self.ID, EventFail, "node-0") || hub.saw(m.Self.ID, EventFail, "node-1"))
+	}
+}
+
+func TestMembershipLeave(t *testing.T) {
+	hub, members := newSwimCluster(t, 3)
+	for _, m := range members {
+		assert.Eventually(t, func() bool { return viewSize(m) == 2 }, 2*time.Second, 10*time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	members[2].Leave(ctx)
+
+	for _, m := range members[:2] {
+		assert.True(t, hub.saw(m.Self.ID, EventLeave, "node-2"), "%s missed the leave", m.Self.ID)
+		assert.False(t, hub.saw(m.Self.ID, EventFail, "node-2"))
+		assert.Equal(t, 1, viewSize(m))
+	}
+}
@@ -1,7 +1,9 @@
 package p2p
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"sync"
 )
@@ -10,8 +12,13 @@ import (
 
 type TCPPeer struct {
 	net.Conn
-	outbound bool
-	wg       *sync.WaitGroup
+	outbound   bool
+	id         string     // id is the identity the handshake authenticated, empty with NOPHandshakeFunc
+	listenAddr string     // listenAddr is where the peer accepts connections, announced in the handshake
+	dialAddr   string     // dialAddr is the address we dialed the peer at, empty for inbound peers
+	session    *Session   // session multiplexes the control stream and file streams over Conn once the handshake is done
+	encoder    Encoder    // encoder frames everything written by Send
+	sendMu     sync.Mutex // sendMu keeps concurrent Sends from interleaving on the control stream
 }
 
 type TCPTransport struct {
@@ -25,8 +32,11 @@ type TCPTransport struct {
 type TCPTransportOptions struct {
 	ListenAddress string
 	HandshakeFunc HandshakeFunc    // in this project we are using NOPHandshakeFunc does nothing. But if we want to implement the handshake we can implement it by creating a function and passing it here
-	Decoder       Decoder          // Decoder is an interface that defines the methods that a decoder must implement
+	Decoder       Decoder          // Decoder is an interface that defines the methods that a decoder must implement, FramedDecoder by default
+	Encoder       Encoder          // Encoder must match the Decoder, it defaults to the encoder paired with it
+	Upgrade       ConnUpgradeFunc  // optional, wraps every connection (e.g. in TLS, see tls.go) before the handshake
 	OnPeer        func(Peer) error // When new peer is connected, this function does something - here we are doing nothing
+	OnPeerLost    func(Peer)       // called once a peer OnPeer accepted is disconnected
 }
 
 // ------------------------------- xxxxxxx ----------------------------------- //
@@ -37,11 +47,24 @@ func NewTCPPeer(conn net.Conn, outbound bool) *TCPPeer {
 	return &TCPPeer{
 		Conn:     conn,
 		outbound: outbound,
-		wg:       &sync.WaitGroup{},
+		encoder:  DefaultEncoder{},
 	}
 }
 
 func NewTCPTransport(options TCPTransportOptions) *TCPTransport {
+	if options.Decoder == nil {
+		options.Decoder = FramedDecoder{} // DefaultDecoder reads fixed 1028 byte buffers, which split large messages
+	}
+
+	if options.Encoder == nil {
+		switch dec := options.Decoder.(type) {
+		case FramedDecoder:
+			options.Encoder = FramedEncoder{MaxFrameSize: dec.MaxFrameSize}
+		default:
+			options.Encoder = DefaultEncoder{}
+		}
+	}
+
 	return &TCPTransport{
 		TCPTransportOptions: options,
 		rpcCh:               make(chan RPC, 1024),
@@ -53,19 +76,67 @@ func NewTCPTransport(options TCPTransportOptions) *TCPTransport {
 // ------------------ Methods of TCPPeer for Peer Operations ----------------- //
 
 /* Index
-1. CloseStream: Close the stream
-2. Send: Send data to the peer
+1. Send: Send a message to the peer on the control stream
+2. OpenStream: Open a new multiplexed stream to the peer
+3. Close: Close the session and the connection under it
+4. ID: The authenticated identity of the peer
+5. ListenAddr: The address the peer accepts connections on
+6. DialAddr: The address we dialed the peer at
 */
 
-// 1. CloseStream ---------------------------//
-func (p *TCPPeer) CloseStream() {
-	p.wg.Done()
+// 1. Send ---------------------------//
+func (p *TCPPeer) Send(b []byte) error {
+	p.sendMu.Lock()
+	defer p.sendMu.Unlock()
+
+	if p.session == nil {
+		return p.encoder.Encode(p.Conn, &RPC{Payload: b})
+	}
+	return p.encoder.Encode(p.session.Control(), &RPC{Payload: b})
 }
 
-// 2. Send ---------------------------//
-func (p *TCPPeer) Send(b []byte) error {
-	_, err := p.Write(b)
-	return err
+// 2. OpenStream ---------------------------//
+func (p *TCPPeer) OpenStream() (io.ReadWriteCloser, error) {
+	if p.session == nil {
+		return nil, ErrSessionClosed
+	}
+	return p.session.Open()
+}
+
+// 3. Close ---------------------------//
+func (p *TCPPeer) Close() error {
+	if p.session != nil {
+		return p.session.Close()
+	}
+	return p.Conn.Close()
+}
+
+// 4. ID ---------------------------//
+// Without an authenticating handshake all we know about the peer is its remote address
+func (p *TCPPeer) ID() string {
+	if p.id == "" {
+		return p.RemoteAddr().String()
+	}
+	return p.id
+}
+
+// 5. ListenAddr ---------------------------//
+func (p *TCPPeer) ListenAddr() string {
+	return p.listenAddr
+}
+
+// 6. DialAddr ---------------------------//
+// The handshake may replace the listenAddr with one written differently, e.g. ":3000" for the
+// "127.0.0.1:3000" we dialed, the dialed one stays known here
+func (p *TCPPeer) DialAddr() string {
+	return p.dialAddr
+}
+
+func (p *TCPPeer) setIdentity(id, listenAddr string) {
+	p.id = id
+	if listenAddr != "" {
+		p.listenAddr = listenAddr
+	}
 }
 
 // ------------------------------- xxxxxxx ----------------------------------- //
@@ -112,7 +183,7 @@ func (t *TCPTransport) Dial(address string) error {
 	if err != nil {
 		return err
 	}
-	go t.handleConn(conn, true)
+	go t.handleConn(conn, true, address)
 	return nil
 }
 
@@ -123,23 +194,40 @@ func (t *TCPTransport) Dial(address string) error {
 /* Index
 1. startAcceptLoop: Start accepting connections
 2. handleConn: Handle a new connection
+3. acceptStreams: Hand every stream the peer opens to the consumer
 */
 
 // 1. startAcceptLoop ---------------------------//
 func (t *TCPTransport) startAcceptLoop() {
 	for {
 		conn, err := t.listener.Accept() // conn is the connection object and err is the error object
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 		if err != nil {
 			fmt.Printf("TCPTransport: failed to accept connection: %v\n", err)
 			continue
 		}
-		go t.handleConn(conn, false) // here after accepting the connection (inbound) we are handling the connection by calling handleConn (outbound = false)
+		go t.handleConn(conn, false, "") // here after accepting the connection (inbound) we are handling the connection by calling handleConn (outbound = false)
 	}
 }
 
 // 2. handleConn ---------------------------//
-func (t *TCPTransport) handleConn(conn net.Conn, outbound bool) {
+func (t *TCPTransport) handleConn(conn net.Conn, outbound bool, dialAddr string) {
+	if t.Upgrade != nil {
+		upgraded, err := t.Upgrade(conn, outbound)
+		if err != nil {
+			fmt.Printf("TCPTransport: upgrading %s failed: %v\n", conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+		conn = upgraded
+	}
+
 	peer := NewTCPPeer(conn, outbound) // creates a new TCPPeer object using the connection
+	peer.encoder = t.Encoder
+	peer.listenAddr = dialAddr // we know where outbound peers listen, inbound ones tell us in the handshake
+	peer.dialAddr = dialAddr
 
 	if err := t.HandshakeFunc(peer); err != nil { //performs a handshake using the HandshakeFunc, here we are using NOPHandshakeFunc
 		fmt.Printf("TCPTransport: handshake failed: %v\n", err)
@@ -147,35 +235,71 @@ func (t *TCPTransport) handleConn(conn net.Conn, outbound bool) {
 		return
 	}
 
+	// From here on the connection only carries mux frames, see mux.go
+	peer.session = NewSession(conn, outbound)
+
 	if t.OnPeer != nil { // The OnPeer function is called when a new peer is connected. It is used to do something when a new peer is connected. Here we are doing nothing
 		if err := t.OnPeer(peer); err != nil {
 			fmt.Printf("TCPTransport: OnPeer failed: %v\n", err)
-			conn.Close()
+			peer.Close()
 			return
 		}
 	}
 
 	// The peer is added to the peers map
 	t.mu.Lock()
-	t.peers[conn.RemoteAddr().String()] = peer // conn.RemoteAddr() will give the address of the remote peer
+	t.peers[peer.ID()] = peer // peer.ID() is the authenticated identity, or the remote address without one
 	t.mu.Unlock()
 
+	go t.acceptStreams(peer)
+
 	for {
 		rpc := RPC{}
-		err := t.Decoder.Decode(conn, &rpc) //It uses the Decoder to decode the incoming message into the RPC object.
+		err := t.Decoder.Decode(peer.session.Control(), &rpc) //It uses the Decoder to decode the incoming message from the control stream into the RPC object.
 		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, ErrSessionClosed) {
+				fmt.Printf("TCPTransport: dropping %s: %v\n", conn.RemoteAddr(), err)
+			}
 			break
 		}
-		// It sets the From field of the RPC to the remote address. It sends the RPC object to the rpcCh channel for processing.
-		rpc.From = conn.RemoteAddr().String()
+		// It sets the From field of the RPC to the peer's ID. It sends the RPC object to the rpcCh channel for processing.
+		rpc.From = peer.ID()
+
+		// Streams are opened on the session now, a stream frame on the control stream carries nothing
+		if rpc.Stream {
+			continue
+		}
+
 		t.rpcCh <- rpc
 	}
 
 	// If there is an error while decoding the message, the connection is closed and the peer is removed from the peers map.
 	t.mu.Lock()
-	delete(t.peers, conn.RemoteAddr().String())
+	if t.peers[peer.ID()] == Peer(peer) {
+		delete(t.peers, peer.ID())
+	}
 	t.mu.Unlock()
-	conn.Close()
+	peer.Close()
+
+	if t.OnPeerLost != nil {
+		t.OnPeerLost(peer)
+	}
+}
+
+// 3. acceptStreams ---------------------------//
+func (t *TCPTransport) acceptStreams(peer *TCPPeer) {
+	for {
+		stream, err := peer.session.Accept()
+		if err != nil {
+			return
+		}
+
+		t.rpcCh <- RPC{
+			From:   peer.ID(),
+			Stream: true,
+			Conn:   stream,
+		}
+	}
 }
 
 // ------------------------------- xxxxxxx ----------------------------------- //
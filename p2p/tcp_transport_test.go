@@ -19,3 +19,9 @@ func TestTCPTransport(t *testing.T) {
 	// Server
 	// tr.Start()
 }
+
+func TestTCPTransportDefaultsToFraming(t *testing.T) {
+	tr := NewTCPTransport(TCPTransportOptions{ListenAddress: ":8081"})
+	assert.Equal(t, FramedDecoder{}, tr.Decoder)
+	assert.Equal(t, FramedEncoder{}, tr.Encoder)
+}
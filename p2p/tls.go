@@ -0,0 +1,148 @@
+package p2p
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"time"
+)
+
+/*
+The TLS upgrade wraps every connection in TLS 1.3 before the handshake in handshake.go runs,
+so the handshake itself, the control messages and the file streams are all encrypted and
+integrity protected. There is no certificate authority: each node presents a self-signed
+certificate for its Ed25519 identity key and the remote checks the key instead of a chain.
+The key can be pinned to a fixed set of identities, and the authenticated handshake checks
+that the certificate key is the identity it proved, so the TLS session is bound to it.
+*/
+
+// ConnUpgradeFunc wraps a freshly dialed or accepted connection, e.g. in TLS, before the handshake
+type ConnUpgradeFunc func(conn net.Conn, outbound bool) (net.Conn, error)
+
+type TLSConfig struct {
+	Identity    *Identity
+	PinnedPeers []string // identity IDs we accept certificates for, empty accepts any self-signed identity
+}
+
+var (
+	ErrCertificateNotPinned = errors.New("p2p: certificate identity is not pinned")
+	ErrTLSIdentityMismatch  = errors.New("p2p: tls certificate does not belong to the handshake identity")
+)
+
+// NewTLSUpgradeFunc returns a ConnUpgradeFunc that runs a mutually authenticated TLS 1.3 handshake
+func NewTLSUpgradeFunc(cfg TLSConfig) (ConnUpgradeFunc, error) {
+	cert, err := selfSignedCertificate(cfg.Identity)
+	if err != nil {
+		return nil, err
+	}
+
+	pinned := make(map[string]bool, len(cfg.PinnedPeers))
+	for _, id := range cfg.PinnedPeers {
+		pinned[id] = true
+	}
+
+	verify := func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("p2p: remote presented no certificate")
+		}
+
+		remote, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return err
+		}
+
+		key, ok := remote.PublicKey.(ed25519.PublicKey)
+		if !ok {
+			return fmt.Errorf("p2p: certificate key is %T, not ed25519", remote.PublicKey)
+		}
+		if err := remote.CheckSignature(remote.SignatureAlgorithm, remote.RawTBSCertificate, remote.Signature); err != nil {
+			return fmt.Errorf("p2p: certificate is not self-signed by its key: %w", err)
+		}
+		if len(pinned) > 0 && !pinned[hex.EncodeToString(key)] {
+			return fmt.Errorf("%w: %s", ErrCertificateNotPinned, hex.EncodeToString(key))
+		}
+
+		return nil
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates:          []tls.Certificate{cert},
+		MinVersion:            tls.VersionTLS13,
+		ClientAuth:            tls.RequireAnyClientCert,
+		InsecureSkipVerify:    true, // there is no chain to verify, VerifyPeerCertificate checks the key instead
+		VerifyPeerCertificate: verify,
+	}
+
+	return func(conn net.Conn, outbound bool) (net.Conn, error) {
+		var tlsConn *tls.Conn
+		if outbound {
+			tlsConn = tls.Client(conn, tlsConfig)
+		} else {
+			tlsConn = tls.Server(conn, tlsConfig)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), handshakeTimeout)
+		defer cancel()
+
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			return nil, err
+		}
+		return tlsConn, nil
+	}, nil
+}
+
+func selfSignedCertificate(id *Identity) (tls.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: id.ID()},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, id.PublicKey, id.PrivateKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  id.PrivateKey,
+	}, nil
+}
+
+// tlsPeerKey returns the identity key of the certificate the peer presented, if the peer runs over TLS
+func tlsPeerKey(p Peer) (ed25519.PublicKey, bool) {
+	tp, ok := p.(*TCPPeer)
+	if !ok {
+		return nil, false
+	}
+
+	tlsConn, ok := tp.Conn.(*tls.Conn)
+	if !ok {
+		return nil, false
+	}
+
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil, false
+	}
+
+	key, ok := certs[0].PublicKey.(ed25519.PublicKey)
+	return key, ok
+}
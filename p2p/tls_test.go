@@ -0,0 +1,91 @@
+package p2p
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func tlsPair(t *testing.T, a, b TLSConfig) (net.Conn, net.Conn, error, error) {
+	upA, err := NewTLSUpgradeFunc(a)
+	assert.Nil(t, err)
+	upB, err := NewTLSUpgradeFunc(b)
+	assert.Nil(t, err)
+
+	c1, c2 := net.Pipe()
+	t.Cleanup(func() { c1.Close(); c2.Close() })
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	resCh := make(chan result)
+	go func() {
+		conn, err := upB(c2, false)
+		if err != nil {
+			c2.Close() // unblock the other side, it may still wait for our handshake messages
+		}
+		resCh <- result{conn, err}
+	}()
+
+	conn1, err1 := upA(c1, true)
+	if err1 != nil {
+		c1.Close()
+	}
+	res := <-resCh
+
+	return conn1, res.conn, err1, res.err
+}
+
+func TestTLSUpgradeThenHandshake(t *testing.T) {
+	alice, _ := NewIdentity()
+	bob, _ := NewIdentity()
+
+	c1, c2, err1, err2 := tlsPair(t, TLSConfig{Identity: alice}, TLSConfig{Identity: bob})
+	assert.Nil(t, err1)
+	assert.Nil(t, err2)
+	assert.Equal(t, uint16(tls.VersionTLS13), c1.(*tls.Conn).ConnectionState().Version)
+
+	p1, p2 := NewTCPPeer(c1, true), NewTCPPeer(c2, false)
+	errCh := make(chan error)
+	go func() { errCh <- NewAuthHandshakeFunc(HandshakeConfig{Identity: bob})(p2) }()
+	assert.Nil(t, NewAuthHandshakeFunc(HandshakeConfig{Identity: alice})(p1))
+	assert.Nil(t, <-errCh)
+
+	assert.Equal(t, bob.ID(), p1.ID())
+	assert.Equal(t, alice.ID(), p2.ID())
+}
+
+func TestTLSUpgradeRejectsUnpinnedPeers(t *testing.T) {
+	alice, _ := NewIdentity()
+	bob, _ := NewIdentity()
+	mallory, _ := NewIdentity()
+
+	_, _, err1, _ := tlsPair(t,
+		TLSConfig{Identity: alice, PinnedPeers: []string{bob.ID()}},
+		TLSConfig{Identity: mallory},
+	)
+	assert.True(t, errors.Is(err1, ErrCertificateNotPinned))
+}
+
+func TestHandshakeRejectsForeignCertificate(t *testing.T) {
+	alice, _ := NewIdentity()
+	bob, _ := NewIdentity()
+	mallory, _ := NewIdentity()
+
+	// the TLS session ends at mallory's certificate, but the identity proved inside it is bob's
+	c1, c2, err1, err2 := tlsPair(t, TLSConfig{Identity: alice}, TLSConfig{Identity: mallory})
+	assert.Nil(t, err1)
+	assert.Nil(t, err2)
+
+	p1, p2 := NewTCPPeer(c1, true), NewTCPPeer(c2, false)
+	errCh := make(chan error)
+	go func() { errCh <- NewAuthHandshakeFunc(HandshakeConfig{Identity: bob})(p2) }()
+	err := NewAuthHandshakeFunc(HandshakeConfig{Identity: alice})(p1)
+	<-errCh
+
+	assert.True(t, errors.Is(err, ErrTLSIdentityMismatch))
+}
@@ -1,14 +1,21 @@
 package p2p
 
-import "net"
+import (
+	"io"
+	"net"
+)
 
 /*
 Peer is an interface that defines the methods that a peer must implement ( It represents a node in the network )
 */
 type Peer interface {
-	Close() error      // Close closes the connection between the local node and the remote node
-	Send([]byte) error // Send sends a message to the remote node
-	net.Conn           // Conn returns the connection between the local node and the remote node
+	Close() error                            // Close closes the connection between the local node and the remote node
+	Send([]byte) error                       // Send sends a message to the remote node
+	OpenStream() (io.ReadWriteCloser, error) // OpenStream opens a new stream to the remote node that shares the connection with every other stream
+	ID() string                              // ID is the identity the handshake authenticated, it falls back to the remote address
+	ListenAddr() string                      // ListenAddr is the address the remote node accepts connections on, if known
+	DialAddr() string                        // DialAddr is the address the local node dialed the remote node at, empty for inbound connections
+	net.Conn                                 // Conn returns the connection between the local node and the remote node, only the handshake may read or write it directly
 	// All of these merthods are implemented in the TCPPeer struct in tcp_transport.go
 }
 
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+/*
+An object stored with a TTL (StoreTTL) carries its expiry in Metadata.Expires, which the
+replicas get along with the rest of its metadata, so every node lets its copy go at the same
+time without hearing from the owner.
+
+From the expiry on the object reads as missing, locally and to the peers that ask for it.
+The reaper then deletes it for good: every ReapInterval it walks the whole store, replicas
+included, and buries what expired (store_tombstones.go). The tombstone keeps a copy from
+coming back, whether a peer that hasn't reaped yet sends it, a scrub repairs it or a Get
+fetches it. A copy that expired is refused by the store anyway, the tombstone also holds
+when clocks disagree. Tombstones older than TombstoneTTL are purged on the same pass.
+*/
+
+const (
+	defaultReapInterval = time.Minute
+	defaultTombstoneTTL = 7 * 24 * time.Hour // well past the time a node may be away and come back with old copies
+)
+
+// ReapReport is what a reaper pass removed
+type ReapReport struct {
+	Started    time.Time
+	Finished   time.Time
+	Expired    int   // objects buried
+	Bytes      int64 // their size
+	Tombstones int   // purged for being older than TombstoneTTL
+}
+
+type reaper struct {
+	running sync.Mutex // held for the whole pass
+}
+
+// ------------------------------ XXXXXXXXXXXXXXX---------------------------------------- //
+// ----------------------------- Methods of the Reaper ---------------------------------- //
+
+/* Index
+1. StoreTTL: Store the file so that it expires after ttl, everywhere
+2. Reap: Bury every expired object of the store and purge the old tombstones
+3. expired: Whether the local copy of an object has expired
+4. reapLoop: Run a pass every ReapInterval until the server stops
+*/
+
+// 1. StoreTTL ---------------------------//
+func (s *FileServer) StoreTTL(ctx context.Context, key string, r io.Reader, ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("ttl must be positive, got %s", ttl)
+	}
+	return s.StoreMeta(ctx, key, r, Metadata{Expires: time.Now().Add(ttl)})
+}
+
+// 2. Reap ---------------------------//
+func (s *FileServer) Reap(ctx context.Context) (ReapReport, error) {
+	s.reap.running.Lock()
+	defer s.reap.running.Unlock()
+
+	report := ReapReport{Started: time.Now()}
+	defer func() { report.Finished = time.Now() }()
+
+	ids, err := s.store.IDs()
+	if err != nil {
+		return report, err
+	}
+
+	for _, id := range ids {
+		// collect first and bury after, so the walk doesn't run into the records Bury removes
+		var expired []ObjectInfo
+		err := s.store.Walk(id, "", func(info ObjectInfo) error {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if info.Meta.expired(report.Started) {
+				expired = append(expired, info)
+			}
+			return nil
+		})
+		if err != nil {
+			return report, err
+		}
+
+		for _, info := range expired {
+			if err := s.store.Bury(id, info.Key, info.Meta.Version); err != nil {
+				return report, fmt.Errorf("reaping (%s) in %s: %w", info.Key, id, err)
+			}
+			fmt.Printf("[%s] reaped (%s), expired at %s\n", s.Transport.Addr(), info.Key, info.Meta.Expires.Format(time.RFC3339))
+			report.Expired++
+			report.Bytes += info.Size
+		}
+	}
+
+	report.Tombstones, err = s.store.PurgeTombstones(time.Now().Add(-s.TombstoneTTL))
+	return report, err
+}
+
+// 3. expired ---------------------------//
+func (s *FileServer) expired(id string, key string) bool {
+	info, err := s.store.Stat(id, key)
+	return err == nil && info.Meta.expired(time.Now())
+}
+
+// 4. reapLoop ---------------------------//
+func (s *FileServer) reapLoop() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-s.quitCh
+		cancel()
+	}()
+
+	ticker := time.NewTicker(s.ReapInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := s.Reap(ctx); err != nil && ctx.Err() == nil {
+				log.Printf("[%s] reap: %v", s.Transport.Addr(), err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
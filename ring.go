@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/MonalBarse/NimbusFS/p2p"
+)
+
+/*
+With FileServerOpts.ReplicationFactor set, a file goes to that many peers instead of every
+one. Which ones is decided by a consistent-hash ring over the identities of the connected
+peers: every peer takes ringVirtualNodes points on the ring, and the owners of a file are
+the first distinct peers found walking clockwise from the hash of its ID and key. The
+virtual nodes spread every peer's share around the ring, so the keys a peer owns are evenly
+spread over the others when it leaves, and taken evenly from them when it joins.
+
+The ring follows the connections, a peer is added on OnPeer and removed on OnPeerLost, but
+the contacts of the DHT aren't on it (fileserver_dht.go). Get asks the owners first and,
+without a DHT, the other peers when none of them has the file, which finds copies placed
+under an earlier ring too. Rebalance sends every file of the node to the owners under the
+ring of the moment that don't hold it yet, asked with a MessageHasFile, copies left on
+peers that stopped being owners stay where they are. With a ReplicationFactor it runs on
+its own once the peers change, rebalanceDelay after the last change so that a burst of
+joins, or a membership event, is one pass.
+
+Each node only places its own files, against its own view of the ring, so the views don't
+have to agree.
+*/
+
+const (
+	ringVirtualNodes = 128
+	rebalanceDelay   = 200 * time.Millisecond
+)
+
+type ringPoint struct {
+	hash uint64
+	node string
+}
+
+// hashRing is the consistent-hash ring, safe for concurrent use
+type hashRing struct {
+	mu     sync.RWMutex
+	points []ringPoint // sorted by hash
+}
+
+// ------------------------------ XXXXXXXXXXXXXXX---------------------------------------- //
+// ---------------------------- Methods of the Ring ------------------------------------- //
+
+/* Index
+1. add: Put the virtual nodes of a node on the ring
+2. remove: Take the virtual nodes of a node off the ring
+3. owners: The first n distinct nodes clockwise from a key
+*/
+
+// 1. add ---------------------------//
+func (r *hashRing) add(node string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, p := range r.points {
+		if p.node == node {
+			return
+		}
+	}
+	for i := 0; i < ringVirtualNodes; i++ {
+		r.points = append(r.points, ringPoint{hash: ringHash(node + "#" + strconv.Itoa(i)), node: node})
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i].hash < r.points[j].hash })
+}
+
+// 2. remove ---------------------------//
+func (r *hashRing) remove(node string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	kept := r.points[:0]
+	for _, p := range r.points {
+		if p.node != node {
+			kept = append(kept, p)
+		}
+	}
+	r.points = kept
+}
+
+// 3. owners ---------------------------//
+// owners returns fewer than n nodes when the ring holds fewer
+func (r *hashRing) owners(key string, n int) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if len(r.points) == 0 || n <= 0 {
+		return nil
+	}
+
+	h := ringHash(key)
+	start := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+
+	var (
+		owners []string
+		seen   = make(map[string]bool)
+	)
+	for i := 0; i < len(r.points) && len(owners) < n; i++ {
+		p := r.points[(start+i)%len(r.points)]
+		if seen[p.node] {
+			continue
+		}
+		seen[p.node] = true
+		owners = append(owners, p.node)
+	}
+	return owners
+}
+
+// ------------------------------ XXXXXXXXXXXXXXX---------------------------------------- //
+// --------------------------- Placement Methods ---------------------------------------- //
+
+/* Index
+1. replicaPeers: The connected peers a file goes to
+2. splitOwners: The peers to ask for a file first, and the rest
+3. Rebalance: Send every file of the node to the owners under the current ring that lack it
+4. handleMessageHasFile: Tell a peer whether we hold a file
+5. rebalanceLoop: Rebalance after the peers changed until the server stops
+*/
+
+// 1. replicaPeers ---------------------------//
+// replicaPeers is every peer without a ReplicationFactor
+func (s *FileServer) replicaPeers(id string, key string) map[string]p2p.Peer {
+	owners, rest := s.splitOwners(id, key)
+	if s.ReplicationFactor <= 0 {
+		for addr, peer := range rest {
+			owners[addr] = peer
+		}
+	}
+	return owners
+}
+
+// 2. splitOwners ---------------------------//
+// splitOwners puts every peer in owners without a ReplicationFactor
+func (s *FileServer) splitOwners(id string, key string) (map[string]p2p.Peer, map[string]p2p.Peer) {
+	peers := s.networkPeers()
+	if s.ReplicationFactor <= 0 {
+		return peers, map[string]p2p.Peer{}
+	}
+
+	owners := make(map[string]p2p.Peer)
+	for _, addr := range s.ring.owners(id+"/"+key, s.ReplicationFactor) {
+		if peer, ok := peers[addr]; ok { // the ring may be a step ahead of the peer map
+			owners[addr] = peer
+			delete(peers, addr)
+		}
+	}
+	return owners, peers
+}
+
+// 3. Rebalance ---------------------------//
+// Rebalance is for after the peers changed, e.g. a node joined that now owns some of the
+// files. An owner that holds the file already, with the same digest, isn't sent it again.
+func (s *FileServer) Rebalance(ctx context.Context) error {
+	var own []ObjectInfo
+	err := s.store.Walk(s.ID, "", func(info ObjectInfo) error {
+		if info.Meta.Encryption == EncryptionNone { // not the replicas peers sent us under the same ID
+			own = append(own, info)
+		}
+		return ctx.Err()
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, info := range own {
+		peers := s.replicaPeers(s.ID, hashKey(info.Key))
+		for id := range s.holders(ctx, peers, s.ID, hashKey(info.Key), info.Meta.Digest) {
+			delete(peers, id)
+		}
+		if len(peers) == 0 {
+			continue
+		}
+
+		if err := s.replicateObject(ctx, info, peers); err != nil {
+			return fmt.Errorf("rebalancing (%s): %w", info.Key, err)
+		}
+	}
+	return nil
+}
+
+// 4. handleMessageHasFile ---------------------------//
+func (s *FileServer) handleMessageHasFile(from string, reqID uint64, msg MessageHasFile) error {
+	peer, ok := s.peerList()[from]
+	if !ok {
+		return fmt.Errorf("peer %s not in map", from)
+	}
+
+	resp := MessageHasFileResponse{ID: msg.ID, Key: msg.Key}
+	if info, err := s.store.Stat(msg.ID, msg.Key); err == nil && !info.Meta.expired(time.Now()) {
+		resp.Digest = info.Meta.Digest
+	}
+
+	return s.send(peer, &Message{RequestID: reqID, Payload: resp})
+}
+
+// 5. rebalanceLoop ---------------------------//
+func (s *FileServer) rebalanceLoop() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-s.quitCh
+		cancel()
+	}()
+
+	for {
+		select {
+		case <-s.rebalanceCh:
+		case <-ctx.Done():
+			return
+		}
+
+		// wait for the peers to settle, what changes meanwhile is part of this pass
+		select {
+		case <-time.After(rebalanceDelay):
+		case <-ctx.Done():
+			return
+		}
+		select {
+		case <-s.rebalanceCh:
+		default:
+		}
+
+		if err := s.Rebalance(ctx); err != nil {
+			log.Printf("[%s] rebalancing: %v", s.Transport.Addr(), err)
+		}
+	}
+}
+
+// ------------------------------ XXXXXXXXXXXXXXX---------------------------------------- //
+// ---------------------------------- Helpers ------------------------------------------- //
+
+func ringHash(s string) uint64 {
+	sum := sha256.Sum256([]byte(s))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// placement is the ID and key a request for a file is placed by
+func placement(req any) (string, string) {
+	switch v := req.(type) {
+	case MessageGetFile:
+		return v.ID, v.Key
+	case MessageGetRange:
+		return v.ID, v.Key
+	}
+	return "", ""
+}
+
+// rebalanceSoon has rebalanceLoop run a pass, there is nothing to place without a
+// ReplicationFactor, every peer gets every file as it is stored
+func (s *FileServer) rebalanceSoon() {
+	if s.ReplicationFactor <= 0 {
+		return
+	}
+	select {
+	case s.rebalanceCh <- struct{}{}:
+	default:
+	}
+}
+
+// holders asks peers whether they hold the object under (id, key) with digest, those that
+// don't answer before the RequestTimeout are taken not to
+func (s *FileServer) holders(ctx context.Context, peers map[string]p2p.Peer, id string, key string, digest string) map[string]bool {
+	held := make(map[string]bool)
+	if digest == "" || len(peers) == 0 {
+		return held
+	}
+
+	ctx, cancel := s.withDefaultTimeout(ctx)
+	defer cancel()
+
+	reqID, w := s.expect(peers, MessageHasFileResponse{})
+	defer s.forget(reqID)
+
+	asked := 0
+	for addr, peer := range peers {
+		if err := s.send(peer, &Message{RequestID: reqID, Payload: MessageHasFile{ID: id, Key: key}}); err != nil {
+			log.Printf("[%s] asking %s for (%s): %v", s.Transport.Addr(), addr, key, err)
+			continue
+		}
+		asked++
+	}
+
+	for ; asked > 0; asked-- {
+		select {
+		case resp := <-w.ch:
+			if v, ok := resp.payload.(MessageHasFileResponse); ok && v.Digest == digest {
+				held[resp.from] = true
+			}
+		case <-ctx.Done():
+			return held
+		}
+	}
+	return held
+}
+
+// replicateObject seals what the store holds under info.Key and sends it to peers
+func (s *FileServer) replicateObject(ctx context.Context, info ObjectInfo, peers map[string]p2p.Peer) error {
+	msg := MessageStoreFile{
+		ID:   s.ID,
+		Key:  hashKey(info.Key),
+		Size: sealedSize(info.Size),
+		Meta: info.Meta,
+	}
+	msg.Meta.Encryption = EncryptionSealed // what the peers get is sealed
+
+	ctx, cancel := s.withDefaultTimeout(ctx)
+	defer cancel()
+
+	// Nothing is held in memory: every peer gets the file sealed straight off the disk, as
+	// compressed as it is stored.
+	return s.replicate(ctx, peers, msg, func(w io.Writer) error {
+		_, r, err := s.store.ReadStored(s.ID, info.Key)
+		if err != nil {
+			return err
+		}
+		if rc, ok := r.(io.Closer); ok {
+			defer rc.Close()
+		}
+
+		_, err = copySeal(s.EncKey, r, w)
+		return err
+	})
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+)
+
+func TestRingSpreadsAndMovesLittle(t *testing.T) {
+	var r hashRing
+	for i := 0; i < 10; i++ {
+		r.add(fmt.Sprintf("node-%d", i))
+	}
+
+	const keys = 10000
+	before := make([][]string, keys)
+	primaries := make(map[string]int)
+	for i := range before {
+		before[i] = r.owners(fmt.Sprintf("default/key-%d", i), 3)
+		if len(before[i]) != 3 || before[i][0] == before[i][1] || before[i][1] == before[i][2] || before[i][0] == before[i][2] {
+			t.Fatalf("owners of key-%d: %v", i, before[i])
+		}
+		primaries[before[i][0]]++
+	}
+	for node, n := range primaries {
+		if n < keys/10/2 || n > keys/10*3/2 {
+			t.Errorf("%s is the first owner of %d keys of %d", node, n, keys)
+		}
+	}
+
+	// only the keys the node owned change owners when it leaves, and they keep the others
+	r.remove("node-3")
+	for i, owners := range before {
+		after := r.owners(fmt.Sprintf("default/key-%d", i), 3)
+		if !slices.Contains(owners, "node-3") {
+			if !slices.Equal(after, owners) {
+				t.Fatalf("key-%d moved from %v to %v", i, owners, after)
+			}
+			continue
+		}
+		for _, node := range owners {
+			if node != "node-3" && !slices.Contains(after, node) {
+				t.Fatalf("key-%d lost %s moving from %v to %v", i, node, owners, after)
+			}
+		}
+	}
+
+	if owners := r.owners("default/key-0", 20); len(owners) != 9 {
+		t.Errorf("%d owners out of 9 nodes", len(owners))
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"sync"
+	"time"
+)
+
+/*
+The scrubber re-reads everything the store holds, a little at a time, so damage on disk is
+found before a Get runs into it. Every object is read back and hashed against the CID its
+index record holds, and the node's own plaintext against the Digest of its metadata as well,
+so content that matches its address but isn't what was written is caught too. An object
+that doesn't match, or whose content is gone, is quarantined
+(store_quarantine.go) and fetched again from the peers:
+
+  - the node's own plaintext is fetched sealed under the hashed key and decrypted, as Get does
+  - a replica (Metadata.Encryption set) is fetched as is from another replica
+
+With FileServerOpts.ScrubInterval set, Start runs a pass every interval. Scrub runs one on
+demand and ScrubStatus reports the pass in progress, or the last one.
+*/
+
+const defaultScrubRate = 8 << 20 // bytes per second
+
+var errScrubRunning = errors.New("a scrub is already running")
+
+// ScrubReport is the progress of a scrub pass, and its result once Finished is set
+type ScrubReport struct {
+	Started  time.Time
+	Finished time.Time
+	Checked  int   // objects read back so far
+	Bytes    int64 // bytes read back so far
+	Problems []ScrubProblem
+}
+
+// ScrubProblem is an object that failed verification, and what became of it
+type ScrubProblem struct {
+	ID        string
+	Key       string
+	Err       error // what the check found
+	Repaired  bool
+	RepairErr error // why no good copy could be written back, the object stays quarantined
+}
+
+type scrubber struct {
+	running sync.Mutex // held for the whole pass
+
+	mu     sync.Mutex
+	report ScrubReport
+}
+
+// ------------------------------ XXXXXXXXXXXXXXX---------------------------------------- //
+// ---------------------------- Methods of the Scrubber --------------------------------- //
+
+/* Index
+1. Scrub: Verify every object once, quarantining and repairing the damaged ones
+2. ScrubStatus: A copy of the report of the current or last pass
+3. scrubObject: Read an object back and check it against its CID and the digest of its metadata
+4. repair: Fetch a good copy of a quarantined object from the peers
+5. scrubLoop: Run a pass every ScrubInterval until the server stops
+*/
+
+// 1. Scrub ---------------------------//
+func (s *FileServer) Scrub(ctx context.Context) (ScrubReport, error) {
+	if !s.scrub.running.TryLock() {
+		return ScrubReport{}, errScrubRunning
+	}
+	defer s.scrub.running.Unlock()
+
+	s.updateScrub(func(r *ScrubReport) { *r = ScrubReport{Started: time.Now()} })
+
+	ids, err := s.store.IDs()
+	if err != nil {
+		return s.finishScrub(), err
+	}
+
+	limit := &rateLimiter{rate: s.ScrubRate, start: time.Now()}
+	for _, id := range ids {
+		// collect first and repair after, so the walk doesn't run into the records repair writes
+		var (
+			damaged []ScrubProblem
+			metas   = make(map[string]Metadata) // what repair needs to know where to fetch from
+		)
+		err := s.store.Walk(id, "", func(info ObjectInfo) error {
+			n, err := s.scrubObject(ctx, limit, id, info)
+			s.updateScrub(func(r *ScrubReport) {
+				r.Checked++
+				r.Bytes += n
+			})
+
+			switch {
+			case ctx.Err() != nil:
+				return ctx.Err()
+			case isDamage(err):
+				log.Printf("[%s] scrub: (%s) in %s is damaged: %v", s.Transport.Addr(), info.Key, id, err)
+				damaged = append(damaged, ScrubProblem{ID: id, Key: info.Key, Err: err})
+				metas[info.Key] = info.Meta
+			case err != nil:
+				// not something a fresh copy fixes, so only report it
+				s.updateScrub(func(r *ScrubReport) {
+					r.Problems = append(r.Problems, ScrubProblem{ID: id, Key: info.Key, Err: err})
+				})
+			}
+			return nil
+		})
+		if err != nil {
+			return s.finishScrub(), err
+		}
+
+		for _, problem := range damaged {
+			// the key leaves the index either way, a repaired object is written back under it
+			if err := s.store.Quarantine(id, problem.Key); err != nil {
+				problem.RepairErr = fmt.Errorf("quarantine: %w", err)
+			} else if err := s.repair(ctx, id, problem.Key, metas[problem.Key]); err != nil {
+				problem.RepairErr = err
+			} else {
+				problem.Repaired = true
+			}
+
+			s.updateScrub(func(r *ScrubReport) { r.Problems = append(r.Problems, problem) })
+		}
+	}
+
+	report := s.finishScrub()
+	fmt.Printf("[%s] scrubbed %d objects (%d bytes), %d damaged\n", s.Transport.Addr(), report.Checked, report.Bytes, len(report.Problems))
+	return report, nil
+}
+
+// 2. ScrubStatus ---------------------------//
+func (s *FileServer) ScrubStatus() ScrubReport {
+	s.scrub.mu.Lock()
+	defer s.scrub.mu.Unlock()
+
+	report := s.scrub.report
+	report.Problems = append([]ScrubProblem(nil), report.Problems...)
+	return report
+}
+
+// 3. scrubObject ---------------------------//
+// scrubObject returns the bytes it read and why the object is damaged, if it is
+func (s *FileServer) scrubObject(ctx context.Context, limit *rateLimiter, id string, info ObjectInfo) (int64, error) {
+	size, r, err := s.store.ReadStored(id, info.Key) // the bytes the CID is the hash of
+	if err != nil {
+		return 0, err
+	}
+	if rc, ok := r.(io.Closer); ok {
+		defer rc.Close()
+	}
+
+	// content-addressed reads verify themselves, hashing here covers plain stores too
+	hasher := sha256.New()
+	n, err := io.Copy(hasher, &limitedReader{ctx: ctx, r: io.LimitReader(r, size), limit: limit})
+	if err != nil {
+		return n, err
+	}
+	if n != info.Size {
+		return n, fmt.Errorf("%w: read %d of %d bytes", ErrContentCorrupt, n, info.Size)
+	}
+	got := hex.EncodeToString(hasher.Sum(nil))
+	if got != info.CID {
+		return n, fmt.Errorf("%w: %s hashes to %s", ErrContentCorrupt, info.CID, got)
+	}
+
+	// the CID only says the bytes are the ones stored under it, the digest recorded with the
+	// object says they are what was written. A replica's digest is of a plaintext we can't open.
+	if info.Meta.Digest == "" || info.Meta.Encryption != EncryptionNone {
+		return n, nil
+	}
+	if info.Meta.compressed() {
+		if got, err = s.plainDigest(ctx, limit, id, info.Key); err != nil {
+			return n, err
+		}
+	}
+	if got != info.Meta.Digest {
+		return n, fmt.Errorf("%w: (%s) hashes to %s, its metadata says %s", ErrContentCorrupt, info.Key, got, info.Meta.Digest)
+	}
+	return n, nil
+}
+
+// plainDigest hashes what Read makes of a compressed object
+func (s *FileServer) plainDigest(ctx context.Context, limit *rateLimiter, id string, key string) (string, error) {
+	size, r, err := s.store.Read(id, key)
+	if err != nil {
+		return "", err
+	}
+	if rc, ok := r.(io.Closer); ok {
+		defer rc.Close()
+	}
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, &limitedReader{ctx: ctx, r: io.LimitReader(r, size), limit: limit}); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// 4. repair ---------------------------//
+func (s *FileServer) repair(ctx context.Context, id string, key string, meta Metadata) error {
+	if meta.Encryption != EncryptionNone {
+		// a replica, any other replica of it will do
+		return s.fetch(ctx, id, key, func(from string, body io.Reader, msg MessageGetFileResponse) error {
+			_, err := s.store.PutMeta(id, key, body, msg.Meta)
+			return err
+		})
+	}
+
+	if id != s.ID {
+		return fmt.Errorf("plaintext of %s can't be fetched with our key", id)
+	}
+	return s.fetch(ctx, id, hashKey(key), func(from string, body io.Reader, msg MessageGetFileResponse) error {
+		_, err := s.store.WriteDecrypt(s.EncKey, id, key, body, msg.Meta)
+		return err
+	})
+}
+
+// 5. scrubLoop ---------------------------//
+func (s *FileServer) scrubLoop() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-s.quitCh
+		cancel()
+	}()
+
+	ticker := time.NewTicker(s.ScrubInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := s.Scrub(ctx); err != nil && ctx.Err() == nil {
+				log.Printf("[%s] scrub: %v", s.Transport.Addr(), err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// ------------------------------ XXXXXXXXXXXXXXX---------------------------------------- //
+// ---------------------------------- Helpers ------------------------------------------- //
+
+func (s *FileServer) updateScrub(fn func(r *ScrubReport)) {
+	s.scrub.mu.Lock()
+	defer s.scrub.mu.Unlock()
+	fn(&s.scrub.report)
+}
+
+// isDamage tells the errors of content that is wrong or gone from those of a store that failed to read it
+func isDamage(err error) bool {
+	return errors.Is(err, ErrContentCorrupt) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, fs.ErrNotExist)
+}
+
+func (s *FileServer) finishScrub() ScrubReport {
+	s.updateScrub(func(r *ScrubReport) { r.Finished = time.Now() })
+	return s.ScrubStatus()
+}
+
+// rateLimiter spreads reads out so they average rate bytes per second since start
+type rateLimiter struct {
+	rate  int64
+	start time.Time
+	total int64
+}
+
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	l.total += int64(n)
+	due := l.start.Add(time.Duration(float64(l.total) / float64(l.rate) * float64(time.Second)))
+
+	ahead := time.Until(due)
+	if ahead <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(ahead)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type limitedReader struct {
+	ctx   context.Context
+	r     io.Reader
+	limit *rateLimiter
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if werr := r.limit.wait(r.ctx, n); werr != nil {
+		return n, werr
+	}
+	return n, err
+}
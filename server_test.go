@@ -1 +1,845 @@
 package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	mrand "math/rand"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/MonalBarse/NimbusFS/p2p"
+)
+
+// ------------------------ Utility func ------------------------ //
+func newTestServer(t *testing.T, listenAddr string, nodes ...string) *FileServer {
+	return newTestServerWith(t, StoreOpts{}, listenAddr, nodes...)
+}
+
+// newTestServerWith runs the server on a memory store with storeOpts, chunked and content-addressed
+func newTestServerWith(t *testing.T, storeOpts StoreOpts, listenAddr string, nodes ...string) *FileServer {
+	return newTestServerOpts(t, FileServerOpts{}, storeOpts, listenAddr, nodes...)
+}
+
+// newTestServerOpts is newTestServerWith with the server options the helpers don't set
+func newTestServerOpts(t *testing.T, opts FileServerOpts, storeOpts StoreOpts, listenAddr string, nodes ...string) *FileServer {
+	storeOpts.PathTransformFunc = CASPathTransformFunc
+	storeOpts.Chunking = true
+
+	identity, err := p2p.NewIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upgrade, err := p2p.NewTLSUpgradeFunc(p2p.TLSConfig{Identity: identity})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tcpTransport := p2p.NewTCPTransport(p2p.TCPTransportOptions{
+		ListenAddress: listenAddr,
+		HandshakeFunc: p2p.NewAuthHandshakeFunc(p2p.HandshakeConfig{
+			Identity:   identity,
+			ListenAddr: listenAddr,
+		}),
+		Decoder: p2p.FramedDecoder{},
+		Upgrade: upgrade,
+	})
+
+	opts.NodeID = identity.ID()
+	opts.EncKey = newEncryptionKey()
+	opts.Storage = NewMemoryStore(storeOpts)
+	opts.Transport = tcpTransport
+	opts.BootstrapNodes = nodes
+	opts.RequestTimeout = time.Second
+
+	s := NewFileServer(opts)
+	tcpTransport.OnPeer = s.OnPeer
+	tcpTransport.OnPeerLost = s.OnPeerLost
+
+	go s.Start()
+	t.Cleanup(s.Stop)
+	time.Sleep(50 * time.Millisecond) // let the listener come up before anyone dials it
+
+	return s
+}
+
+func waitForPeers(t *testing.T, s *FileServer, n int) {
+	deadline := time.Now().Add(2 * time.Second)
+	for len(s.peerList()) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("[%s] expected %d peers, have %d", s.Transport.Addr(), n, len(s.peerList()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// ------------------------ Replication test ------------------------ //
+
+func TestStoreReplicatesWithAcks(t *testing.T) {
+	s1 := newTestServer(t, ":4101")
+	s2 := newTestServer(t, ":4102")
+	s3 := newTestServer(t, ":4103", ":4101", ":4102")
+	waitForPeers(t, s3, 2)
+
+	data := []byte("replicated bytes")
+	if err := s3.Store("foo.txt", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Store only returns once both replicas acked, so they must be on disk by now
+	for _, s := range []*FileServer{s1, s2} {
+		if !s.store.Has(s3.ID, hashKey("foo.txt")) {
+			t.Errorf("[%s] expected a replica of foo.txt", s.Transport.Addr())
+		}
+	}
+
+	if err := s3.store.Delete(s3.ID, "foo.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := s3.Get("foo.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(r)
+	if rc, ok := r.(io.ReadCloser); ok {
+		rc.Close()
+	}
+	if !bytes.Equal(b, data) {
+		t.Errorf("want %s have %s", data, b)
+	}
+}
+
+func TestStoreCarriesMetadataToReplicas(t *testing.T) {
+	s1 := newTestServer(t, ":4131")
+	s2 := newTestServer(t, ":4132", ":4131")
+	waitForPeers(t, s2, 1)
+
+	data := []byte("<html><body>hello</body></html>")
+	sum := sha256.Sum256(data)
+	digest := hex.EncodeToString(sum[:])
+
+	meta := Metadata{Attrs: map[string]string{"album": "summer"}}
+	if err := s2.StoreMeta(context.Background(), "page.html", bytes.NewReader(data), meta); err != nil {
+		t.Fatal(err)
+	}
+
+	replica, err := s1.store.Stat(s2.ID, hashKey("page.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := replica.Meta; m.Creator != s2.NodeID || m.Digest != digest || m.Encryption != EncryptionSealed ||
+		m.ContentType != "text/html; charset=utf-8" || m.Attrs["album"] != "summer" {
+		t.Errorf("replica described as %+v", m)
+	}
+
+	// fetching it back restores the owner's description of the plaintext
+	if err := s2.store.Delete(s2.ID, "page.html"); err != nil {
+		t.Fatal(err)
+	}
+	r, err := s2.Get("page.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.(io.Closer).Close()
+
+	local, err := s2.store.Stat(s2.ID, "page.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := local.Meta; m.Digest != digest || m.Encryption != EncryptionNone || m.Attrs["album"] != "summer" ||
+		!m.Created.Equal(replica.Meta.Created) {
+		t.Errorf("fetched copy described as %+v", m)
+	}
+}
+
+func TestCompressedFilesSurviveTheRoundTrip(t *testing.T) {
+	s1 := newTestServer(t, ":4161")
+	s2 := newTestServerWith(t, StoreOpts{Compression: CompressionGzip}, ":4162", ":4161")
+	waitForPeers(t, s2, 1)
+
+	data := bytes.Repeat([]byte("the same line of the log, over and over\n"), 2000)
+	if err := s2.Store("app.log", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the replica is sealed from the compressed bytes, so it is about as small
+	replica, err := s1.store.Stat(s2.ID, hashKey("app.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := replica.Meta; m.Compression != CompressionGzip || m.PlainSize != int64(len(data)) || replica.Size >= int64(len(data))/10 {
+		t.Errorf("replica of %d bytes is %d, described as %+v", len(data), replica.Size, m)
+	}
+
+	if err := s2.store.Delete(s2.ID, "app.log"); err != nil {
+		t.Fatal(err)
+	}
+	r, err := s2.Get("app.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(r)
+	r.(io.Closer).Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, data) {
+		t.Errorf("got back %d bytes of the %d stored", len(b), len(data))
+	}
+}
+
+func TestGetRangeFromPeers(t *testing.T) {
+	newTestServer(t, ":4171")
+	s2 := newTestServerWith(t, StoreOpts{Compression: CompressionGzip}, ":4172", ":4171")
+	waitForPeers(t, s2, 1)
+
+	data := make([]byte, 300<<10) // several sealed chunks, and it won't compress
+	mrand.New(mrand.NewSource(3)).Read(data)
+	text := bytes.Repeat([]byte("compressed, so the range comes out of the whole file\n"), 5000)
+
+	for key, content := range map[string][]byte{"video.bin": data, "app.log": text} {
+		if err := s2.Store(key, bytes.NewReader(content)); err != nil {
+			t.Fatal(err)
+		}
+
+		size := int64(len(content))
+		for _, r := range [][2]int64{{100000, 70000}, {size - 10, -1}, {0, 1}, {size, 5}} {
+			if err := s2.store.Delete(s2.ID, key); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				t.Fatal(err)
+			}
+
+			rd, err := s2.GetRange(context.Background(), key, r[0], r[1])
+			if err != nil {
+				t.Fatalf("%s %v: %v", key, r, err)
+			}
+			got, err := io.ReadAll(rd)
+			if err != nil {
+				t.Fatalf("%s %v: %v", key, r, err)
+			}
+			rd.(io.Closer).Close()
+
+			end := size
+			if r[1] >= 0 {
+				end = min(r[0]+r[1], size)
+			}
+			if !bytes.Equal(got, content[r[0]:end]) {
+				t.Errorf("%s %v: got %d bytes, want %d", key, r, len(got), end-r[0])
+			}
+		}
+
+		if _, err := s2.GetRange(context.Background(), key, size+1, 1); !errors.Is(err, ErrInvalidRange) {
+			t.Errorf("%s: range past the end gave %v", key, err)
+		}
+	}
+}
+
+func TestGetOldVersionFromPeers(t *testing.T) {
+	newTestServerWith(t, StoreOpts{Versioning: true}, ":4181")
+	s2 := newTestServerWith(t, StoreOpts{Versioning: true, Compression: CompressionGzip}, ":4182", ":4181")
+	waitForPeers(t, s2, 1)
+
+	first := bytes.Repeat([]byte("the first version of the notes\n"), 1000)
+	if err := s2.Store("notes.txt", bytes.NewReader(first)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s2.Store("notes.txt", bytes.NewReader([]byte("the second version"))); err != nil {
+		t.Fatal(err)
+	}
+
+	versions, err := s2.Versions("notes.txt")
+	if err != nil || len(versions) != 2 {
+		t.Fatalf("%d versions, %v", len(versions), err)
+	}
+	old := versions[1].Meta.Version
+
+	// with the local history gone the replica's has it, under the same ID
+	if err := s2.store.(*LocalStore).Clear(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := s2.GetVersion(context.Background(), "notes.txt", old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, first) {
+		t.Errorf("got %d bytes of version %s, want %d", len(b), old, len(first))
+	}
+
+	if _, err := s2.GetVersion(context.Background(), "notes.txt", "no-such-version"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("a missing version gave %v", err)
+	}
+}
+
+func TestExpiredFilesAreReapedEverywhere(t *testing.T) {
+	s1 := newTestServer(t, ":4191")
+	s2 := newTestServer(t, ":4192", ":4191")
+	waitForPeers(t, s2, 1)
+
+	if err := s2.StoreTTL(context.Background(), "session.tmp", bytes.NewReader([]byte("for a moment")), 200*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	local, err := s2.store.Stat(s2.ID, "session.tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	replica, err := s1.store.Stat(s2.ID, hashKey("session.tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if local.Meta.Expires.IsZero() || !replica.Meta.Expires.Equal(local.Meta.Expires) {
+		t.Fatalf("replica expires at %v, the file at %v", replica.Meta.Expires, local.Meta.Expires)
+	}
+
+	time.Sleep(250 * time.Millisecond)
+	if _, err := s2.Get("session.tmp"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expired file read as %v", err)
+	}
+
+	// the owner reaps first, the replica it could fetch the file back from is expired too
+	for _, s := range []*FileServer{s2, s1} {
+		report, err := s.Reap(context.Background())
+		if err != nil || report.Expired != 1 {
+			t.Errorf("[%s] reaped %d, %v", s.Transport.Addr(), report.Expired, err)
+		}
+	}
+	if _, err := s2.Get("session.tmp"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("reaped file read as %v", err)
+	}
+	if s1.store.Has(s2.ID, hashKey("session.tmp")) || s2.store.Has(s2.ID, "session.tmp") {
+		t.Error("reaped file is still stored")
+	}
+}
+
+func TestDeleteReachesEveryReplica(t *testing.T) {
+	s1 := newTestServer(t, ":4201")
+	s2 := newTestServer(t, ":4202")
+	s3 := newTestServer(t, ":4203", ":4201", ":4202")
+	waitForPeers(t, s3, 2)
+
+	if err := s3.Store("old_photo.png", bytes.NewReader([]byte("nobody should see this again"))); err != nil {
+		t.Fatal(err)
+	}
+
+	// what s1 could bring back later, were it away while the file was deleted
+	replica, err := s1.store.Stat(s3.ID, hashKey("old_photo.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, r, err := s1.store.ReadStored(s3.ID, hashKey("old_photo.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := io.ReadAll(r)
+	r.(io.Closer).Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s3.Delete(context.Background(), "old_photo.png"); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []*FileServer{s1, s2} {
+		if s.store.Has(s3.ID, hashKey("old_photo.png")) {
+			t.Errorf("[%s] still has the replica", s.Transport.Addr())
+		}
+	}
+	if _, err := s3.Get("old_photo.png"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("deleted file read as %v", err)
+	}
+
+	if _, err := s1.store.PutMeta(s3.ID, hashKey("old_photo.png"), bytes.NewReader(sealed), replica.Meta); !errors.Is(err, ErrTombstoned) {
+		t.Errorf("deleted replica written back: %v", err)
+	}
+
+	// the key itself isn't buried, a new file can take it
+	if err := s3.Store("old_photo.png", bytes.NewReader([]byte("a new one"))); err != nil {
+		t.Fatal(err)
+	}
+	if !s2.store.Has(s3.ID, hashKey("old_photo.png")) {
+		t.Error("new file under a deleted key not replicated")
+	}
+}
+
+func TestReplicationFactorPlacesFilesOnTheRing(t *testing.T) {
+	nodes := []*FileServer{newTestServer(t, ":4211"), newTestServer(t, ":4212"), newTestServer(t, ":4213")}
+	s := newTestServerOpts(t, FileServerOpts{ReplicationFactor: 2}, StoreOpts{}, ":4214", ":4211", ":4212", ":4213")
+	waitForPeers(t, s, 3)
+
+	holders := func(key string) []string {
+		var ids []string
+		for _, n := range nodes {
+			if n.store.Has(s.ID, hashKey(key)) {
+				ids = append(ids, n.NodeID)
+			}
+		}
+		slices.Sort(ids)
+		return ids
+	}
+	owners := func(key string) []string {
+		ids := s.ring.owners(s.ID+"/"+hashKey(key), s.ReplicationFactor)
+		slices.Sort(ids)
+		return ids
+	}
+
+	for i := 0; i < 6; i++ {
+		key := fmt.Sprintf("report_%d.pdf", i)
+		if err := s.Store(key, bytes.NewReader([]byte("quarterly numbers "+key))); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := holders(key), owners(key); !slices.Equal(got, want) {
+			t.Errorf("(%s) went to %v, its owners are %v", key, got, want)
+		}
+	}
+
+	// a Get finds it on the owners
+	if err := s.store.Delete(s.ID, "report_0.pdf"); err != nil {
+		t.Fatal(err)
+	}
+	r, err := s.Get("report_0.pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.(io.Closer).Close()
+
+	// every copy is sealed afresh, so a replica that is sent again gets another CID
+	replicas := func(key string) map[string]string {
+		cids := make(map[string]string)
+		for _, n := range nodes {
+			if info, err := n.store.Stat(s.ID, hashKey(key)); err == nil {
+				cids[n.NodeID] = info.CID
+			}
+		}
+		return cids
+	}
+	before := make(map[string]map[string]string)
+	for i := 0; i < 6; i++ {
+		key := fmt.Sprintf("report_%d.pdf", i)
+		before[key] = replicas(key)
+	}
+
+	// a node that joins takes over some keys, the files are rebalanced without being asked
+	nodes = append(nodes, newTestServer(t, ":4215", ":4214"))
+	waitForPeers(t, s, 4)
+
+	deadline := time.Now().Add(3 * time.Second)
+	for i := 0; i < 6; i++ {
+		key := fmt.Sprintf("report_%d.pdf", i)
+		for _, owner := range owners(key) {
+			for !slices.Contains(holders(key), owner) {
+				if time.Now().After(deadline) {
+					t.Fatalf("(%s) is not on its owner %s after the rebalance", key, owner)
+				}
+				time.Sleep(20 * time.Millisecond)
+			}
+		}
+	}
+
+	// and the owners that had a file already weren't sent it again
+	if err := s.Rebalance(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for key, cids := range before {
+		for node, cid := range replicas(key) {
+			if old, ok := cids[node]; ok && old != cid {
+				t.Errorf("(%s) was sent again to %s, which held it", key, node)
+			}
+		}
+	}
+}
+
+func TestDHTFindsNodesAndHolders(t *testing.T) {
+	opts := FileServerOpts{DHT: true, ReplicationFactor: 1}
+	s1 := newTestServerOpts(t, opts, StoreOpts{}, ":4221")
+	s2 := newTestServerOpts(t, opts, StoreOpts{}, ":4222", ":4221")
+	s3 := newTestServerOpts(t, opts, StoreOpts{}, ":4223", ":4222")
+	s4 := newTestServerOpts(t, opts, StoreOpts{}, ":4224", ":4223")
+
+	// s4 only knew of s3, the lookup of itself found the rest
+	waitForPeers(t, s4, 3)
+
+	// but only as contacts, the files of s4 don't go to every node its lookups touched
+	if peers := s4.networkPeers(); len(peers) != 1 || peers[s3.NodeID] == nil {
+		t.Fatalf("expected s3 as the only network peer of s4, have %d", len(peers))
+	}
+
+	if err := s4.Store("map.svg", bytes.NewReader([]byte("<svg>here be dragons</svg>"))); err != nil {
+		t.Fatal(err)
+	}
+
+	var holder *FileServer
+	for _, s := range []*FileServer{s1, s2, s3} {
+		if s.store.Has(s4.ID, hashKey("map.svg")) {
+			holder = s
+		}
+	}
+	if holder == nil {
+		t.Fatal("no replica")
+	}
+
+	// the holder provides it in the background
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		providers, err := s4.dht.FindProviders(context.Background(), s4.ID+"/"+hashKey("map.svg"))
+		if err == nil && len(providers) == 1 && providers[0].ID == holder.NodeID {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("providers %v, %v, want %s", providers, err, holder.NodeID)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	if err := s4.store.Delete(s4.ID, "map.svg"); err != nil {
+		t.Fatal(err)
+	}
+	r, err := s4.Get("map.svg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.(io.Closer).Close()
+}
+
+func TestMembershipFindsAndDropsNodes(t *testing.T) {
+	opts := FileServerOpts{Membership: true, ProbeInterval: 50 * time.Millisecond}
+	s1 := newTestServerOpts(t, opts, StoreOpts{}, ":4231")
+	s2 := newTestServerOpts(t, opts, StoreOpts{}, ":4232", ":4231")
+	s3 := newTestServerOpts(t, opts, StoreOpts{}, ":4233", ":4232")
+
+	// s3 only knew of s2, the gossip told it of s1
+	waitForPeers(t, s3, 2)
+
+	// s2 hangs: its connections stay open, but it answers nothing anymore
+	s2.stopOnce.Do(func() { close(s2.quitCh) })
+
+	waitForDrop := func(s *FileServer, id string) {
+		t.Helper()
+		deadline := time.Now().Add(3 * time.Second)
+		for {
+			_, peer := s.peerList()[id]
+			member := slices.ContainsFunc(s.Members(), func(m p2p.Member) bool { return m.ID == id })
+			if !peer && !member {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("[%s] still has %s, peer %v member %v", s.Transport.Addr(), id, peer, member)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+	waitForDrop(s1, s2.NodeID)
+	waitForDrop(s3, s2.NodeID)
+
+	// a node that leaves is dropped as soon as the others hear of it
+	start := time.Now()
+	s3.Stop()
+	waitForDrop(s1, s3.NodeID)
+	if time.Since(start) > time.Second {
+		t.Errorf("the leave took %v to be noticed", time.Since(start))
+	}
+}
+
+func TestBootstrapNodesAreRedialed(t *testing.T) {
+	// s2 starts before the node it bootstraps to
+	s2 := newTestServerOpts(t, FileServerOpts{RedialBackoff: 50 * time.Millisecond}, StoreOpts{}, ":4242", ":4241")
+	s1 := newTestServer(t, ":4241")
+	waitForPeers(t, s2, 1)
+
+	waitForConnection := func(old p2p.Peer) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			peer, ok := s2.peerList()[s1.NodeID]
+			st := s2.Connections()
+			if ok && peer != old && len(st) == 1 && st[0].State == p2p.ConnConnected && st[0].ID == s1.NodeID {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("not reconnected: %+v", st)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitForConnection(nil)
+
+	// a connection that goes away is dialed again
+	old := s2.peerList()[s1.NodeID]
+	old.Close()
+	waitForConnection(old)
+}
+
+func TestBootstrapNodeDialedByHostCountsAsConnected(t *testing.T) {
+	// s1 announces ":4391" in the handshake, s2 dialed it as "127.0.0.1:4391"
+	s1 := newTestServer(t, ":4391")
+	s2 := newTestServer(t, ":4392", "127.0.0.1:4391")
+	waitForPeers(t, s2, 1)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		st := s2.Connections()
+		if len(st) == 1 && st[0].Addr == "127.0.0.1:4391" && st[0].State == p2p.ConnConnected && st[0].ID == s1.NodeID && st[0].Failures == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("bootstrap node not connected: %+v", st)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReplicationErrorListsFailures(t *testing.T) {
+	err := &ReplicationError{
+		Key:      "foo",
+		Required: 2,
+		Acked:    0,
+		Failures: map[string]error{"b:2": errAckTimeout, "a:1": io.ErrUnexpectedEOF},
+	}
+
+	want := "replication of (foo) got 0/2 acks [a:1: unexpected EOF; b:2: no ack before the replication deadline]"
+	if err.Error() != want {
+		t.Errorf("want %q have %q", want, err.Error())
+	}
+}
+
+// ------------------------ Request/response test ------------------------ //
+
+func TestGetMissingFileFromPeers(t *testing.T) {
+	newTestServer(t, ":4111")
+	s2 := newTestServer(t, ":4112", ":4111")
+	waitForPeers(t, s2, 1)
+
+	// every peer answers, so a miss is reported well before the request deadline
+	start := time.Now()
+	_, err := s2.Get("nobody_has_this.txt")
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, have %v", err)
+	}
+	if time.Since(start) >= s2.RequestTimeout {
+		t.Errorf("Get waited for the deadline instead of the peers' answers")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := s2.GetContext(ctx, "nobody_has_this.txt"); !errors.Is(err, context.Canceled) && !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected a cancelled Get, have %v", err)
+	}
+}
+
+func TestDeliverOnlyTakesTheExpectedAnswers(t *testing.T) {
+	s := &FileServer{pending: make(map[uint64]*waiter)}
+	reqID, w := s.expect(map[string]p2p.Peer{"a": nil, "b": nil}, MessageGetFileResponse{})
+	defer s.forget(reqID)
+
+	// an answer of another type, e.g. an ack a peer sends under the ID, would panic the Get
+	if s.deliver(reqID, response{from: "a", payload: MessageStoreAck{}}) {
+		t.Error("delivered an answer of the wrong type")
+	}
+	if s.deliver(reqID, response{from: "c", payload: MessageGetFileResponse{}}) {
+		t.Error("delivered an answer from a peer that wasn't asked")
+	}
+	if !s.deliver(reqID, response{from: "a", payload: MessageGetFileResponse{}}) {
+		t.Error("dropped the answer of a peer that was asked")
+	}
+	if s.deliver(reqID, response{from: "a", payload: MessageGetFileResponse{}}) {
+		t.Error("delivered a second answer from the same peer")
+	}
+
+	if len(w.ch) != 1 {
+		t.Errorf("expected 1 answer waiting, have %d", len(w.ch))
+	}
+}
+
+// ------------------------ Quota test ------------------------ //
+
+func TestReplicaOverQuotaFailsTheStore(t *testing.T) {
+	s1 := newTestServerWith(t, StoreOpts{Quota: Quota{BytesPerID: 1000}}, ":4151")
+	s2 := newTestServer(t, ":4152", ":4151")
+	waitForPeers(t, s2, 1)
+
+	if err := s2.Store("small.txt", bytes.NewReader(make([]byte, 500))); err != nil {
+		t.Fatal(err)
+	}
+
+	err := s2.Store("big.txt", bytes.NewReader(make([]byte, 2000)))
+	var replErr *ReplicationError
+	if !errors.As(err, &replErr) || !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("want a ReplicationError for the quota, have %v", err)
+	}
+	if s1.store.Has(s2.ID, hashKey("big.txt")) {
+		t.Error("the peer kept a replica over its quota")
+	}
+	if u, _ := s1.store.Usage(s2.ID); u.Objects != 1 || u.Bytes != sealedSize(500) {
+		t.Errorf("peer accounts %+v for one sealed 500 byte replica", u)
+	}
+}
+
+// ------------------------ Scrubber test ------------------------ //
+
+// damageChunk overwrites the first chunk of the object under key with other bytes
+func damageChunk(t *testing.T, s *FileServer, id string, key string) {
+	ls := s.store.(*LocalStore)
+	info, err := ls.Stat(id, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := ls.readManifest(id, info.CID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ls.writeAtomic(ls.blobPath(id, m.Chunks[0].CID), func(w io.Writer) (int64, error) {
+		return io.Copy(w, bytes.NewReader([]byte("rotten bits")))
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestScrubRepairsDamagedObjects(t *testing.T) {
+	s1 := newTestServer(t, ":4141")
+	newTestServer(t, ":4142", ":4141")
+	s3 := newTestServer(t, ":4143", ":4141", ":4142")
+	waitForPeers(t, s1, 2)
+	waitForPeers(t, s3, 2)
+
+	data := bytes.Repeat([]byte("scrub me "), 10000)
+	if err := s3.Store("old.txt", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	// a replica on s1 and the owner's plaintext on s3 both rot
+	damageChunk(t, s1, s3.ID, hashKey("old.txt"))
+	damageChunk(t, s3, s3.ID, "old.txt")
+
+	for _, s := range []*FileServer{s1, s3} {
+		report, err := s.Scrub(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(report.Problems) != 1 || !report.Problems[0].Repaired || report.Finished.IsZero() {
+			t.Fatalf("[%s] scrub reported %+v", s.Transport.Addr(), report)
+		}
+		if status := s.ScrubStatus(); status.Checked != report.Checked {
+			t.Errorf("[%s] status %+v does not match the last pass", s.Transport.Addr(), status)
+		}
+
+		// a second pass finds nothing left to fix
+		if report, _ := s.Scrub(context.Background()); len(report.Problems) != 0 {
+			t.Errorf("[%s] still damaged after repair: %+v", s.Transport.Addr(), report.Problems)
+		}
+	}
+
+	r, err := s3.Get("old.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(r)
+	r.(io.Closer).Close()
+	if err != nil || !bytes.Equal(b, data) {
+		t.Errorf("read back %d bytes after repair, %v", len(b), err)
+	}
+}
+
+func TestScrubChecksTheMetadataDigest(t *testing.T) {
+	s := newTestServer(t, ":4144")
+	ls := s.store.(*LocalStore)
+
+	for key, data := range map[string]string{"a.txt": "the right bytes", "b.txt": "some other bytes"} {
+		if _, err := ls.Put(s.ID, key, bytes.NewReader([]byte(data))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a.txt points at content that matches its own CID, but isn't what a.txt was written with
+	a, _ := ls.Stat(s.ID, "a.txt")
+	b, _ := ls.Stat(s.ID, "b.txt")
+	a.CID, a.Size = b.CID, b.Size
+	if _, err := ls.writeIndex(s.ID, a); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := s.Scrub(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Problems) != 1 || report.Problems[0].Key != "a.txt" || !errors.Is(report.Problems[0].Err, ErrContentCorrupt) {
+		t.Fatalf("scrub reported %+v", report.Problems)
+	}
+	if ls.Has(s.ID, "a.txt") {
+		t.Error("a.txt wasn't quarantined")
+	}
+}
+
+// ------------------------ Multiplexing test ------------------------ //
+
+func TestConcurrentGetsShareOneConnection(t *testing.T) {
+	s1 := newTestServer(t, ":4121")
+	s2 := newTestServer(t, ":4122", ":4121")
+	waitForPeers(t, s2, 1)
+	waitForPeers(t, s1, 1)
+
+	// a connection that is dropped and dialed again is another peer, so the same peer on both
+	// sides afterwards is the same connection, still open
+	conns := func() [2]p2p.Peer {
+		return [2]p2p.Peer{s2.peerList()[s1.NodeID], s1.peerList()[s2.NodeID]}
+	}
+	before := conns()
+
+	keys := []string{"a.txt", "b.txt", "c.txt", "d.txt"}
+	for _, key := range keys {
+		if err := s2.Store(key, bytes.NewReader(bytes.Repeat([]byte(key), 100000))); err != nil {
+			t.Fatal(err)
+		}
+		if err := s2.store.Delete(s2.ID, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	errs := make(chan error, len(keys))
+	for _, key := range keys {
+		go func(key string) {
+			r, err := s2.Get(key)
+			if err == nil {
+				var b []byte
+				b, err = io.ReadAll(r)
+				r.(io.Closer).Close()
+				if err == nil && len(b) != len(key)*100000 {
+					err = fmt.Errorf("%s: got %d bytes", key, len(b))
+				}
+			}
+			errs <- err
+		}(key)
+	}
+
+	for range keys {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+
+	// the peer served every Get over the same connection
+	after := conns()
+	if before[0] == nil || before[1] == nil || after != before || len(s2.peerList()) != 1 || len(s1.peerList()) != 1 {
+		t.Errorf("the Gets didn't share the one connection: %v before, %v after", before, after)
+	}
+	if err := s2.store.Delete(s2.ID, "a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	r, err := s2.Get("a.txt")
+	if err != nil {
+		t.Fatalf("the connection didn't stay usable: %v", err)
+	}
+	r.(io.Closer).Close()
+	if conns() != before {
+		t.Error("another Get took another connection")
+	}
+}
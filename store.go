@@ -9,6 +9,8 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 )
 
 const defaultRootFolderName = "nimus_root"
@@ -68,16 +70,67 @@ func (p PathKey) FullPath() string {
 // ------------------------------ XXXXXXXXXXXXXXX---------------------------------------- //
 //------------------------ Store Options and Constructor -------------------------------- //
 
-type Store struct {
+// Store is what the FileServer keeps its files in
+type Store interface {
+	Write(id string, key string, r io.Reader) (int64, error)
+	Put(id string, key string, r io.Reader) (ObjectInfo, error) // like Write, and reports the content ID
+	PutMeta(id string, key string, r io.Reader, meta Metadata) (ObjectInfo, error)
+	Read(id string, key string) (int64, io.Reader, error)
+	ReadStored(id string, key string) (int64, io.Reader, error)                            // the bytes as stored, compressed if they are
+	ReadRange(id string, key string, offset int64, length int64) (int64, io.Reader, error) // see store_range.go
+	ReadVersion(id string, key string, version string) (int64, io.Reader, error)
+	Versions(id string, key string) ([]ObjectInfo, error) // newest first, see store_versions.go
+	Bury(id string, key string, version string) error     // delete version for good, see store_tombstones.go
+	PurgeTombstones(before time.Time) (int, error)
+	Has(id string, key string) bool
+	Delete(id string, key string) error
+	WriteDecrypt(encKey []byte, id string, key string, r io.Reader, meta Metadata) (int64, error)
+	Stat(id string, key string) (ObjectInfo, error)
+	List(id string, prefix string) ([]ObjectInfo, error)                 // sorted by key
+	Walk(id string, prefix string, fn func(info ObjectInfo) error) error // streams instead of collecting
+	IDs() ([]string, error)
+	Quarantine(id string, key string) error // set a corrupt object aside, see store_quarantine.go
+	GC(grace time.Duration) (GCReport, error)
+	Usage(id string) (Usage, error)                     // what id holds, the whole node for ""
+	CheckQuota(id string, key string, size int64) error // whether writing size bytes under key fits the quota
+}
+
+// LocalStore keeps the files of a node in a directory tree, on disk or, with NewMemoryStore, in memory
+type LocalStore struct {
 	StoreOpts // Embedding StoreOpts to use its fields directly
+
+	pins         pinSet     // the CIDs of the writes in flight, kept safe from GC
+	usage        usageTable // what every id holds, with Quota set
+	versionsMu   sync.Mutex // serializes the changes to version histories
+	tombstonesMu sync.Mutex // serializes the changes to tombstones
 }
 
 type StoreOpts struct {
 	Root              string            // Root folder for the storage system
+	FS                FS                // the filesystem Root lives on, defaults to DiskFS
 	PathTransformFunc PathTransformFunc // Function to transform keys into paths
+	ContentAddressed  bool              // store content under its SHA-256 and keys as index records, see store_cas.go
+	Chunking          bool              // split content into deduplicated chunks, see store_chunks.go, implies ContentAddressed
+	Chunker           ChunkerOpts       // chunk sizes used with Chunking
+	Durability        Durability        // how hard a write tries to survive a crash, defaults to DurabilityFsyncFile
+	Quota             Quota             // limits on what the store holds, see store_quota.go
+	Compression       string            // codec to compress content with when it pays, see store_compress.go
+	Versioning        bool              // keep the versions a write replaces, see store_versions.go, implies ContentAddressed
+	Retention         Retention         // how many old versions, and how old, Versioning keeps
 }
 
-func NewStore(opts StoreOpts) *Store {
+// Durability decides what a write syncs before it reports success. Writes are atomic either way.
+type Durability string
+
+const (
+	DurabilityNone      Durability = "none"       // leave flushing to the OS, a crash can lose the latest writes
+	DurabilityFsyncFile Durability = "fsync-file" // fsync the file before it is renamed into place
+	DurabilityFsyncDir  Durability = "fsync-dir"  // also fsync the directory, so the rename itself survives a crash
+)
+
+const tempFilePattern = ".tmp-*" // temp files live next to their destination until they are complete
+
+func NewLocalStore(opts StoreOpts) *LocalStore {
 	// Initialize default path transform function if not provided
 	if opts.PathTransformFunc == nil {
 		opts.PathTransformFunc = DefaultPathTransformFunc
@@ -86,12 +139,27 @@ func NewStore(opts StoreOpts) *Store {
 	if opts.Root == "" {
 		opts.Root = defaultRootFolderName
 	}
+	if opts.FS == nil {
+		opts.FS = DiskFS{}
+	}
+	if opts.Chunking || opts.Versioning {
+		opts.ContentAddressed = true // chunks are blobs, so there is no chunking without them
+	}
+	if opts.Durability == "" {
+		opts.Durability = DurabilityFsyncFile
+	}
 
-	return &Store{
+	return &LocalStore{
 		StoreOpts: opts,
 	}
 }
 
+// NewMemoryStore returns a LocalStore that keeps everything in memory, Root only names the tree in it
+func NewMemoryStore(opts StoreOpts) *LocalStore {
+	opts.FS = NewMemFS()
+	return NewLocalStore(opts)
+}
+
 // Let's say the root is "nimus_dir" and the path transform function is CASPathTransformFunc then the store will be created with these options
 // and for eg. if the user provides : key = 'hello.txt' id = 'user1' then the path will be: nimus_dir/user1/68044/29f74/181a6/3c50c/3d81d/733a1/2f14a/353ff/hello.txt
 
@@ -99,50 +167,109 @@ func NewStore(opts StoreOpts) *Store {
 // --------------------------------Store Methods ---------------------------------------- //
 
 /* 1. Write the file to the store and return the number of bytes written ---------------- */
-func (s *Store) Write(id string, key string, r io.Reader) (int64, error) {
+func (s *LocalStore) Write(id string, key string, r io.Reader) (int64, error) {
 	// Write data to a file in the store
+	if s.ContentAddressed {
+		info, err := s.Put(id, key, r)
+		return info.Size, err
+	}
 	return s.writeStream(id, key, r)
 }
 
-func (s *Store) writeStream(id string, key string, r io.Reader) (int64, error) {
+func (s *LocalStore) writeStream(id string, key string, r io.Reader) (int64, error) {
 	// Write data from the reader to the file
-	f, err := s.openFileForWriting(id, key)
+	info, err := s.put(id, key, Metadata{}, s.Compression, func(w io.Writer) (int64, error) {
+		return io.Copy(w, r)
+	})
+	return info.Size, err
+}
+
+func (s *LocalStore) filePath(id string, key string) string {
+	pathKey := s.PathTransformFunc(key)
+	return fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FullPath()) // The fullPathWithRoot will be "nimus_dir/user1/68044/29f74/181a6/3c50c/3d81d/733a1/2f14a/353ff/hello.txt"
+}
+
+// writeAtomic writes what fill produces to a temp file next to path and renames it into place
+// once it is complete, so path holds either the old content or the new one, never a part of it
+func (s *LocalStore) writeAtomic(path string, fill func(w io.Writer) (int64, error)) (int64, error) {
+	dir := filepath.Dir(path)
+	if err := s.FS.MkdirAll(dir); err != nil { // MkdirAll creates a directory named path, along with any necessary parents
+		return 0, err
+	}
+
+	tmp, err := s.FS.CreateTemp(dir, tempFilePattern)
 	if err != nil {
 		return 0, err
 	}
-	return io.Copy(f, r)
-}
+	defer s.FS.Remove(tmp.Name()) // a no-op once the temp file is renamed
 
-func (s *Store) openFileForWriting(id string, key string) (*os.File, error) {
-	// Open a file for writing, creating directories as needed
-	pathKey := s.PathTransformFunc(key)
-	pathNameWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.PathName) // The pathNameWithRoot will be "nimus_dir/user1/68044/29f74/181a6/3c50c/3d81d/733a1/2f14a/353ff"
-	if err := os.MkdirAll(pathNameWithRoot, os.ModePerm); err != nil {        // os.MkdirAll creates a directory named path, along with any necessary parents, and returns nil, or else returns an error.
-		return nil, err
+	n, err := fill(tmp)
+	if err != nil {
+		tmp.Close()
+		return n, err
 	}
 
-	fullPathWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FullPath()) // The fullPathWithRoot will be "nimus_dir/user1/68044/29f74/181a6/3c50c/3d81d/733a1/2f14a/353ff/hello.txt"
+	return n, s.commitTemp(tmp, n, path)
+}
+
+// commitTemp closes a temp file holding n bytes and renames it to path, syncing as the durability policy asks
+func (s *LocalStore) commitTemp(tmp File, n int64, path string) error {
+	defer tmp.Close()
 
-	f, err := os.Create(fullPathWithRoot) // os.Create creates or truncates the named file. If the file already exists, it is truncated. If the file does not exist, it is created with mode 0666 (before umask).
+	if s.Durability != DurabilityNone {
+		if err := tmp.Sync(); err != nil {
+			return err
+		}
+	}
+
+	stat, err := tmp.Stat()
 	if err != nil {
-		return nil, err
+		return err
+	}
+	if stat.Size() != n {
+		return fmt.Errorf("wrote %d bytes but %s holds %d", n, tmp.Name(), stat.Size())
 	}
-	return f, nil // The file will be created and returned
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := s.FS.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	if s.Durability == DurabilityFsyncDir {
+		return s.FS.SyncDir(filepath.Dir(path)) // flushes the directory entry the rename created
+	}
+	return nil
 }
 
 /* 2. Read the file from the store and return the number of bytes read and the reader --- */
 
-func (s *Store) Read(id string, key string) (int64, io.Reader, error) {
-	// Read data from a file in the store
+// Read hands out the content as it was written, decompressed if put compressed it
+func (s *LocalStore) Read(id string, key string) (int64, io.Reader, error) {
+	rec, err := s.readIndex(s.indexPath(id, key))
+	if err == nil && rec.Meta.compressed() {
+		if rec.Key == "" {
+			rec.Key = key
+		}
+		return s.readDecompressed(id, rec)
+	}
+	return s.ReadStored(id, key) // plain files from before the index have no record
+}
+
+func (s *LocalStore) ReadStored(id string, key string) (int64, io.Reader, error) {
+	if s.ContentAddressed {
+		return s.casRead(id, key)
+	}
 	return s.readStream(id, key)
 }
 
-func (s *Store) readStream(id string, key string) (int64, io.ReadCloser, error) {
+func (s *LocalStore) readStream(id string, key string) (int64, io.ReadCloser, error) {
 	// Read data from the file and return the size and reader
 	pathKey := s.PathTransformFunc(key)
 	fullPathWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FullPath())
 
-	file, err := os.Open(fullPathWithRoot)
+	file, err := s.FS.Open(fullPathWithRoot)
 	if err != nil {
 		return 0, nil, err
 	}
@@ -157,41 +284,71 @@ func (s *Store) readStream(id string, key string) (int64, io.ReadCloser, error)
 }
 
 /* 3. Check if the file exists in the store ---------------------------------------------- */
-func (s *Store) Has(id string, key string) bool {
+func (s *LocalStore) Has(id string, key string) bool {
 	// Check if a file exists in the store
+	if s.ContentAddressed {
+		return s.casHas(id, key)
+	}
+
 	pathKey := s.PathTransformFunc(key)
 	fullPathWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FullPath())
 
-	_, err := os.Stat(fullPathWithRoot)    // os.Stat returns file info. It will return an error if the file does not exist
-	return !errors.Is(err, os.ErrNotExist) // errors.Is reports whether any error in err's chain matches target. os.ErrNotExist is the error returned by os.Stat when the file does not exist
+	_, err := s.FS.Stat(fullPathWithRoot)  // Stat returns file info. It will return an error if the file does not exist
+	return !errors.Is(err, os.ErrNotExist) // errors.Is reports whether any error in err's chain matches target. os.ErrNotExist is the error returned by Stat when the file does not exist
 }
 
 /* 4. Delete the file from the store ----------------------------------------------------- */
 
-func (s *Store) Delete(id string, key string) error {
+func (s *LocalStore) Delete(id string, key string) error {
+	size, counted := s.recordedSize(id, key)
+
+	if err := s.delete(id, key); err != nil || !counted {
+		return err
+	}
+	return s.unaccount(id, size)
+}
+
+func (s *LocalStore) delete(id string, key string) error {
+	if s.ContentAddressed {
+		return s.casDelete(id, key)
+	}
+
 	pathKey := s.PathTransformFunc(key)
 
 	fullPathWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FullPath())
 
+	if err := s.removeWithEmptyParents(fullPathWithRoot); err != nil {
+		return err
+	}
+
+	// files from before the index have no record to remove
+	if err := s.removeWithEmptyParents(s.indexPath(id, key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// removeWithEmptyParents removes the file and then every directory above it that it leaves empty
+func (s *LocalStore) removeWithEmptyParents(fullPathWithRoot string) error {
 	// Remove the specific file
-	if err := os.Remove(fullPathWithRoot); err != nil {
+	if err := s.FS.Remove(fullPathWithRoot); err != nil {
 		return fmt.Errorf("failed to delete file: %w", err)
 	}
 
 	// Clean up empty directories up to the root
 	for {
 		parentDir := filepath.Dir(fullPathWithRoot)
-		if parentDir == s.Root {
+		if parentDir == filepath.Clean(s.Root) {
 			break // Stop at the root folder to avoid unintended deletions
 		}
 
-		isEmpty, err := isDirEmpty(parentDir)
+		isEmpty, err := s.isDirEmpty(parentDir)
 		if err != nil {
 			return fmt.Errorf("failed to check directory: %w", err)
 		}
 
 		if isEmpty {
-			if err := os.Remove(parentDir); err != nil {
+			if err := s.FS.Remove(parentDir); err != nil {
 				return fmt.Errorf("failed to remove directory: %w", err)
 			}
 		} else {
@@ -206,34 +363,42 @@ func (s *Store) Delete(id string, key string) error {
 }
 
 // to check if the dir is empty first
-func isDirEmpty(dir string) (bool, error) {
-	f, err := os.Open(dir)
+func (s *LocalStore) isDirEmpty(dir string) (bool, error) {
+	entries, err := s.FS.ReadDir(dir)
 	if err != nil {
 		return false, err
 	}
-	defer f.Close()
-
-	_, err = f.Readdir(1)
-	if err == io.EOF {
-		return true, nil
-	}
-	return false, err
+	return len(entries) == 0, nil
 }
 
 // for testing purposes to clear away the entire storage
-func (s *Store) Clear() error {
+func (s *LocalStore) Clear() error {
 	// Clear the entire storage by removing the root directory
-	return os.RemoveAll(s.Root)
+	s.usage.mu.Lock()
+	s.usage.loaded = false // counted again from the empty index
+	s.usage.mu.Unlock()
+
+	return s.FS.RemoveAll(s.Root)
 }
 
 /* 5. Write the file to the store and return the number of bytes written ---------------- */
-func (s *Store) WriteDecrypt(encKey []byte, id string, key string, r io.Reader) (int64, error) {
-	f, err := s.openFileForWriting(id, key)
-	if err != nil {
-		return 0, err
+func (s *LocalStore) WriteDecrypt(encKey []byte, id string, key string, r io.Reader, meta Metadata) (int64, error) {
+	// what we keep is the plaintext, so its digest is ours to compute, unless the owner had
+	// compressed it before sealing and the bytes stay compressed
+	format := meta.Encryption
+	meta.Encryption = EncryptionNone
+	codec := ""
+	if meta.Compression == "" {
+		meta.Digest = ""
+		codec = s.Compression
 	}
-	n, err := copyDecrypt(encKey, r, f)
-	return int64(n), err
+
+	// copyOpen authenticates every chunk and still reads the older CTR files
+	info, err := s.put(id, key, meta, codec, func(w io.Writer) (int64, error) {
+		n, err := copyOpen(encKey, format, r, w)
+		return int64(n), err
+	})
+	return info.Size, err
 }
 
 // ------------------------------ XXXXXXXXXXXXXXX----------------------------------------- //
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+/*
+In content-addressed mode (StoreOpts.ContentAddressed) the bytes of a file are stored once,
+under the SHA-256 of the content, and the key only names a small index record:
+
+	<root>/<id>/.blobs/ab/cd/abcd...   the content, named by its content ID (CID)
+	<root>/<id>/.index/<key path>      the CID the key points at, see store_index.go
+
+Writing the same content under two keys stores it once, and Read hashes the content as it
+is read back, so a blob that changed on disk fails with ErrContentCorrupt instead of
+handing out whatever is there now.
+*/
+
+const (
+	blobsDirName = ".blobs"
+	indexDirName = ".index"
+)
+
+var ErrContentCorrupt = errors.New("stored content does not match its content ID")
+
+// ObjectInfo describes an object written with Put
+type ObjectInfo struct {
+	Key     string
+	CID     string    // hex encoded SHA-256 of the stored bytes
+	Size    int64     // of the stored bytes, Meta.PlainSize has what a compressed object reads back as
+	ModTime time.Time // when the key was last written
+	Meta    Metadata
+	Deleted bool // a delete marker, from Versions
+}
+
+// ------------------------------ XXXXXXXXXXXXXXX---------------------------------------- //
+// --------------------------- Content Addressed Methods -------------------------------- //
+
+/* Index
+1. Put: Write the content of r under key and return its content ID
+2. casRead: Look up the CID of key and read the blob, verifying it
+3. casHas: Check if key has an index record
+4. casDelete: Remove the index record and the content once no key points at it
+*/
+
+// 1. Put ---------------------------//
+// Put works in both modes, only content-addressed stores dedup on the CID
+func (s *LocalStore) Put(id string, key string, r io.Reader) (ObjectInfo, error) {
+	return s.PutMeta(id, key, r, Metadata{})
+}
+
+// put hands fill a writer for the content and files what fill wrote under key, along with
+// meta. A codec compresses what fill writes when it pays, see store_compress.go.
+func (s *LocalStore) put(id string, key string, meta Metadata, codec string, fill func(w io.Writer) (int64, error)) (ObjectInfo, error) {
+	// a copy of what was deleted or expired, e.g. from a peer that hasn't caught up, stays gone
+	if err := s.checkTombstone(id, key, meta.Version); err != nil {
+		return ObjectInfo{}, err
+	}
+	if meta.expired(time.Now()) {
+		return ObjectInfo{}, fmt.Errorf("%w: (%s) at %s", ErrExpired, key, meta.Expires.Format(time.RFC3339))
+	}
+
+	pins := s.pins.hold()
+	defer pins.release() // the index record is written by then, so GC sees it, see store_gc.go
+
+	quota, err := s.reserve(id, key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	defer quota.release() // a no-op once committed
+
+	var (
+		head  = &headWriter{}
+		plain = sha256.New() // of what fill writes, the plaintext unless it comes sealed or compressed
+		enc   *compressor
+	)
+	info, err := s.putContent(id, key, pins, func(w io.Writer) (int64, error) {
+		stored := &countingWriter{w: io.MultiWriter(w, quota)} // quota fails the write once it crosses a limit
+		enc = newCompressor(stored, codec)
+		if _, err := fill(io.MultiWriter(enc, head, plain)); err != nil {
+			return stored.n, err
+		}
+		err := enc.Close()
+		return stored.n, err
+	})
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	meta = meta.complete(head.buf, hex.EncodeToString(plain.Sum(nil)))
+	if meta.Version == "" {
+		meta.Version = newVersionID()
+	}
+	if enc.applied != "" {
+		meta.Compression, meta.PlainSize = enc.applied, enc.in
+	}
+	info.Meta = meta
+	if info, err = s.fileRecord(id, info); err != nil {
+		return ObjectInfo{}, err
+	}
+	return info, quota.commit(info.Size)
+}
+
+// putContent stores the content and reports its CID, the index record is left to put
+func (s *LocalStore) putContent(id string, key string, pins *pinHold, fill func(w io.Writer) (int64, error)) (ObjectInfo, error) {
+	hasher := sha256.New()
+	hashing := func(w io.Writer) (int64, error) {
+		return fill(io.MultiWriter(w, hasher))
+	}
+
+	if !s.ContentAddressed {
+		n, err := s.writeAtomic(s.filePath(id, key), hashing)
+		return ObjectInfo{Key: key, CID: hex.EncodeToString(hasher.Sum(nil)), Size: n}, err
+	}
+
+	if s.Chunking {
+		return s.putChunked(id, key, pins, fill)
+	}
+
+	// the CID is only known once everything is written, so the content goes to a temp file first
+	blobsDir := filepath.Join(s.Root, id, blobsDirName)
+	if err := s.FS.MkdirAll(blobsDir); err != nil {
+		return ObjectInfo{}, err
+	}
+
+	tmp, err := s.FS.CreateTemp(blobsDir, tempFilePattern)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	defer s.FS.Remove(tmp.Name()) // a no-op once the temp file became the blob
+
+	n, err := hashing(tmp)
+	if err != nil {
+		tmp.Close()
+		return ObjectInfo{}, err
+	}
+
+	info := ObjectInfo{Key: key, CID: hex.EncodeToString(hasher.Sum(nil)), Size: n}
+
+	pins.add(info.CID)
+	blobPath := s.blobPath(id, info.CID)
+	if _, err := s.FS.Stat(blobPath); errors.Is(err, os.ErrNotExist) {
+		if err := s.FS.MkdirAll(filepath.Dir(blobPath)); err != nil {
+			tmp.Close()
+			return ObjectInfo{}, err
+		}
+		if err := s.commitTemp(tmp, n, blobPath); err != nil {
+			return ObjectInfo{}, err
+		}
+	} else {
+		tmp.Close() // we have this content already
+	}
+
+	return info, nil
+}
+
+// 2. casRead ---------------------------//
+func (s *LocalStore) casRead(id string, key string) (int64, io.ReadCloser, error) {
+	cid, err := s.lookupCID(id, key)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return s.readContent(id, cid)
+}
+
+// 3. casHas ---------------------------//
+func (s *LocalStore) casHas(id string, key string) bool {
+	_, err := s.lookupCID(id, key)
+	return err == nil
+}
+
+// 4. casDelete ---------------------------//
+func (s *LocalStore) casDelete(id string, key string) error {
+	if s.Versioning {
+		return s.deleteVersioned(id, key) // the content stays for the history, see store_versions.go
+	}
+
+	cid, err := s.lookupCID(id, key)
+	if err != nil {
+		return fmt.Errorf("failed to delete file: %w", err)
+	}
+
+	if err := s.removeWithEmptyParents(s.indexPath(id, key)); err != nil {
+		return err
+	}
+
+	s.pins.track()
+	defer s.pins.untrack()
+
+	live, err := s.mark(id)
+	if err != nil || live[cid] {
+		return err
+	}
+
+	return s.deleteContent(id, cid, live)
+}
+
+// ------------------------------ XXXXXXXXXXXXXXX---------------------------------------- //
+// ---------------------------------- Helpers ------------------------------------------- //
+
+// blobPath spreads the blobs over two levels of directories named after the first bytes of the CID
+func (s *LocalStore) blobPath(id string, cid string) string {
+	return filepath.Join(s.Root, id, blobsDirName, cid[:2], cid[2:4], cid)
+}
+
+// readContent reads the object with the given CID, chunked or not, verifying it
+func (s *LocalStore) readContent(id string, cid string) (int64, io.ReadCloser, error) {
+	m, err := s.readManifest(id, cid)
+	if err == nil {
+		return m.Size, newVerifyingReader(s.openChunks(id, m), cid, m.Size), nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return 0, nil, err
+	}
+
+	f, err := s.FS.Open(s.blobPath(id, cid))
+	if err != nil {
+		return 0, nil, err
+	}
+
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return 0, nil, err
+	}
+
+	return stat.Size(), newVerifyingReader(f, cid, stat.Size()), nil
+}
+
+func (s *LocalStore) lookupCID(id string, key string) (string, error) {
+	rec, err := s.readIndex(s.indexPath(id, key))
+	return rec.CID, err
+}
+
+// contentSize is the size of the object with the given CID, chunked or not
+func (s *LocalStore) contentSize(id string, cid string) (int64, error) {
+	m, err := s.readManifest(id, cid)
+	if err == nil {
+		return m.Size, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return 0, err
+	}
+
+	stat, err := s.FS.Stat(s.blobPath(id, cid))
+	if err != nil {
+		return 0, err
+	}
+	return stat.Size(), nil
+}
+
+// verifyingReader hashes the content as it is read and refuses to hand out its last bytes if
+// the hash is not the CID. It checks once size bytes are read rather than at EOF, since
+// readers usually stop at the size (io.LimitReader) and never see the EOF.
+type verifyingReader struct {
+	rc        io.ReadCloser
+	hasher    hash.Hash
+	cid       string
+	remaining int64
+}
+
+func newVerifyingReader(rc io.ReadCloser, cid string, size int64) *verifyingReader {
+	return &verifyingReader{
+		rc:        rc,
+		hasher:    sha256.New(),
+		cid:       cid,
+		remaining: size,
+	}
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	if v.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > v.remaining {
+		p = p[:v.remaining]
+	}
+
+	n, err := v.rc.Read(p)
+	v.hasher.Write(p[:n])
+	v.remaining -= int64(n)
+
+	if v.remaining == 0 {
+		if hex.EncodeToString(v.hasher.Sum(nil)) != v.cid {
+			return 0, fmt.Errorf("%w: %s", ErrContentCorrupt, v.cid)
+		}
+		return n, nil
+	}
+	if err == io.EOF {
+		return n, io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (v *verifyingReader) Close() error {
+	return v.rc.Close()
+}
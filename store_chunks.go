@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+/*
+With StoreOpts.Chunking the content-addressed store cuts every object into content-defined
+chunks (chunker.go) and stores each chunk as a blob of its own, so files that share content
+share the chunks holding it. The object itself becomes a manifest listing its chunks:
+
+	<root>/<id>/.blobs/ab/cd/abcd...       one blob per distinct chunk
+	<root>/<id>/.manifests/ab/cd/abcd...   the chunk list of an object, named by the object's CID
+
+The index record of a key still holds the CID of the whole content, and Read verifies every
+chunk as well as the whole, so nothing changes for callers. Objects written before chunking
+was turned on have no manifest and are read from their single blob as before.
+*/
+
+const manifestsDirName = ".manifests"
+
+type Manifest struct {
+	CID    string     `json:"cid"` // the content ID of the whole object
+	Size   int64      `json:"size"`
+	Chunks []ChunkRef `json:"chunks"`
+}
+
+type ChunkRef struct {
+	CID  string `json:"cid"`
+	Size int64  `json:"size"`
+}
+
+// ------------------------------ XXXXXXXXXXXXXXX---------------------------------------- //
+// ------------------------------ Chunked Methods --------------------------------------- //
+
+/* Index
+1. putChunked: Cut the content into chunks, store the new ones and write the manifest
+2. putChunk: Store a single chunk unless it is already there
+3. readManifest: Load the manifest of an object
+4. openChunks: Read the chunks of a manifest back to back, verifying each
+5. deleteContent: Remove an object's manifest or blob and the chunks nothing else uses
+*/
+
+// 1. putChunked ---------------------------//
+func (s *LocalStore) putChunked(id string, key string, pins *pinHold, fill func(w io.Writer) (int64, error)) (ObjectInfo, error) {
+	var manifest Manifest
+
+	chunks, err := newChunkWriter(s.Chunker, func(chunk []byte) error {
+		ref, err := s.putChunk(id, pins, chunk)
+		manifest.Chunks = append(manifest.Chunks, ref)
+		return err
+	})
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	hasher := sha256.New()
+	n, err := fill(io.MultiWriter(chunks, hasher))
+	if err == nil {
+		err = chunks.Close()
+	}
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	manifest.CID = hex.EncodeToString(hasher.Sum(nil))
+	manifest.Size = n
+
+	pins.add(manifest.CID)
+	manifestPath := s.manifestPath(id, manifest.CID)
+	if _, err := s.FS.Stat(manifestPath); errors.Is(err, os.ErrNotExist) {
+		b, err := json.Marshal(manifest)
+		if err != nil {
+			return ObjectInfo{}, err
+		}
+		if _, err := s.writeAtomic(manifestPath, func(w io.Writer) (int64, error) {
+			return io.Copy(w, bytes.NewReader(b))
+		}); err != nil {
+			return ObjectInfo{}, err
+		}
+	}
+
+	return ObjectInfo{Key: key, CID: manifest.CID, Size: n}, nil
+}
+
+// 2. putChunk ---------------------------//
+func (s *LocalStore) putChunk(id string, pins *pinHold, chunk []byte) (ChunkRef, error) {
+	sum := sha256.Sum256(chunk)
+	ref := ChunkRef{CID: hex.EncodeToString(sum[:]), Size: int64(len(chunk))}
+	pins.add(ref.CID)
+
+	path := s.blobPath(id, ref.CID)
+	if _, err := s.FS.Stat(path); err == nil {
+		return ref, nil // shared with an object we already have
+	}
+
+	_, err := s.writeAtomic(path, func(w io.Writer) (int64, error) {
+		return io.Copy(w, bytes.NewReader(chunk))
+	})
+	return ref, err
+}
+
+// 3. readManifest ---------------------------//
+func (s *LocalStore) readManifest(id string, cid string) (*Manifest, error) {
+	b, err := readFile(s.FS, s.manifestPath(id, cid))
+	if err != nil {
+		return nil, err
+	}
+
+	var m Manifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("manifest of (%s): %w", cid, err)
+	}
+	if m.CID != cid {
+		return nil, fmt.Errorf("%w: manifest of (%s) describes (%s)", ErrContentCorrupt, cid, m.CID)
+	}
+	return &m, nil
+}
+
+// 4. openChunks ---------------------------//
+func (s *LocalStore) openChunks(id string, m *Manifest) io.ReadCloser {
+	return &chunksReader{store: s, id: id, chunks: m.Chunks}
+}
+
+// 5. deleteContent ---------------------------//
+// deleteContent is called once no key points at cid any more. live is what id still uses,
+// from a mark (store_gc.go) taken once for the whole delete, so no chunk walks the store again.
+func (s *LocalStore) deleteContent(id string, cid string, live map[string]bool) error {
+	m, err := s.readManifest(id, cid)
+	if errors.Is(err, os.ErrNotExist) {
+		return s.deleteBlobIfUnused(id, cid, live)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := s.removeWithEmptyParents(s.manifestPath(id, cid)); err != nil {
+		return err
+	}
+
+	for _, chunk := range m.Chunks {
+		if err := s.deleteBlobIfUnused(id, chunk.CID, live); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ------------------------------ XXXXXXXXXXXXXXX---------------------------------------- //
+// ---------------------------------- Helpers ------------------------------------------- //
+
+func (s *LocalStore) manifestPath(id string, cid string) string {
+	return filepath.Join(s.Root, id, manifestsDirName, cid[:2], cid[2:4], cid)
+}
+
+func (s *LocalStore) deleteBlobIfUnused(id string, cid string, live map[string]bool) error {
+	if live[cid] {
+		return nil // a key, a kept version or the manifest of either still points at it
+	}
+
+	// a put that is reusing the blob right now, or finished since the mark, isn't in live
+	_, err := s.pins.removeUnlessPinned(cid, func() error {
+		return s.removeWithEmptyParents(s.blobPath(id, cid))
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return nil // a chunk listed twice in the manifest, or already gone
+	}
+	return err
+}
+
+// chunksReader reads the chunks of an object one after the other, each through a verifyingReader
+type chunksReader struct {
+	store   *LocalStore
+	id      string
+	chunks  []ChunkRef
+	current io.ReadCloser
+}
+
+func (r *chunksReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if len(r.chunks) == 0 {
+				return 0, io.EOF
+			}
+
+			chunk := r.chunks[0]
+			r.chunks = r.chunks[1:]
+
+			f, err := r.store.FS.Open(r.store.blobPath(r.id, chunk.CID))
+			if err != nil {
+				return 0, err
+			}
+			r.current = newVerifyingReader(f, chunk.CID, chunk.Size)
+		}
+
+		n, err := r.current.Read(p)
+		if err == io.EOF {
+			r.current.Close()
+			r.current = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (r *chunksReader) Close() error {
+	if r.current != nil {
+		return r.current.Close()
+	}
+	return nil
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+/*
+With StoreOpts.Compression naming a codec, put compresses the content before it is stored,
+so before it is sealed for the peers too, and records the codec in Metadata.Compression
+along with the size it had before. Read undoes it, ReadStored hands out the bytes as they
+are, which is what replicas are sealed from and what the CID is the hash of.
+
+Compression is decided per object. put holds back the first compressSampleLen bytes and
+only compresses when they don't sniff as an already compressed format and the codec shrinks
+them to maxCompressRatio or less. PutMeta can ask for another codec, or CompressionNone,
+in Metadata.Compression.
+
+Replicas keep the codec in their metadata but never decompress, they can't read through the
+seal. The owner gets the compressed bytes back when it fetches and decrypts them, and Read
+decompresses those like anything it compressed itself.
+*/
+
+// codecs known to every node
+const (
+	CompressionNone  = "none" // asks PutMeta not to compress, an uncompressed object records ""
+	CompressionGzip  = "gzip"
+	CompressionFlate = "flate"
+)
+
+const (
+	compressSampleLen = 64 << 10 // what put looks at before it decides
+	minCompressLen    = 512      // below this the codec's framing eats what it saves
+	maxCompressRatio  = 0.9
+)
+
+// formats that are compressed already, by the prefix of their sniffed content type
+var incompressibleTypes = []string{
+	"image/",
+	"audio/",
+	"video/",
+	"font/woff",
+	"application/zip",
+	"application/x-gzip",
+	"application/x-rar-compressed",
+	"application/pdf",
+}
+
+var ErrUnknownCodec = errors.New("unknown compression codec")
+
+// Codec compresses and decompresses a stream, see RegisterCodec
+type Codec interface {
+	NewWriter(w io.Writer) (io.WriteCloser, error) // Close flushes what is left, it does not close w
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+var codecs = struct {
+	sync.RWMutex
+	byName map[string]Codec
+}{
+	byName: map[string]Codec{
+		CompressionGzip:  gzipCodec{},
+		CompressionFlate: flateCodec{},
+	},
+}
+
+// RegisterCodec makes c available under name. Every node that may read an object back needs
+// its codec registered under the same name.
+func RegisterCodec(name string, c Codec) {
+	if name == "" || name == CompressionNone {
+		panic(fmt.Sprintf("compression codec can't be named %q", name))
+	}
+
+	codecs.Lock()
+	defer codecs.Unlock()
+	codecs.byName[name] = c
+}
+
+func lookupCodec(name string) (Codec, error) {
+	codecs.RLock()
+	defer codecs.RUnlock()
+
+	c, ok := codecs.byName[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownCodec, name)
+	}
+	return c, nil
+}
+
+// ------------------------------ XXXXXXXXXXXXXXX---------------------------------------- //
+// ----------------------------- Compression Methods ------------------------------------ //
+
+/* Index
+1. PutMeta: Put with the metadata to keep, and the codec it asks for
+2. readDecompressed: Read the content a record points at and decompress it
+3. codecFor: The codec put compresses what the caller writes with
+*/
+
+// 1. PutMeta ---------------------------//
+// PutMeta is Put with the metadata to keep for the object. For plaintext, meta.Compression
+// picks the codec, "" the store's; sealed content is stored as it comes, like its metadata.
+func (s *LocalStore) PutMeta(id string, key string, r io.Reader, meta Metadata) (ObjectInfo, error) {
+	codec := ""
+	if meta.Encryption == EncryptionNone {
+		var err error
+		if codec, err = s.codecFor(meta.Compression); err != nil {
+			return ObjectInfo{}, err
+		}
+		meta.Compression = "" // recorded by put, once it knows whether it did
+	}
+
+	return s.put(id, key, meta, codec, func(w io.Writer) (int64, error) {
+		return io.Copy(w, r)
+	})
+}
+
+// 2. readDecompressed ---------------------------//
+func (s *LocalStore) readDecompressed(id string, rec indexRecord) (int64, io.Reader, error) {
+	codec, err := lookupCodec(rec.Meta.Compression)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var rc io.ReadCloser
+	if s.ContentAddressed {
+		_, rc, err = s.readContent(id, rec.CID)
+	} else {
+		_, rc, err = s.readStream(id, rec.Key)
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+
+	dec, err := codec.NewReader(rc)
+	if err != nil {
+		rc.Close()
+		return 0, nil, fmt.Errorf("%w: %s: %v", ErrContentCorrupt, rec.Meta.Compression, err)
+	}
+	return rec.Meta.PlainSize, &decompressingReader{ReadCloser: dec, stored: rc}, nil
+}
+
+// 3. codecFor ---------------------------//
+func (s *LocalStore) codecFor(asked string) (string, error) {
+	switch asked {
+	case CompressionNone:
+		return "", nil
+	case "":
+		asked = s.Compression
+	}
+	if asked == "" {
+		return "", nil
+	}
+
+	if _, err := lookupCodec(asked); err != nil {
+		return "", err
+	}
+	return asked, nil
+}
+
+// ------------------------------ XXXXXXXXXXXXXXX---------------------------------------- //
+// ---------------------------------- Helpers ------------------------------------------- //
+
+// compressor is the writer put fills. It holds back the sample, decides on it and from then
+// on writes through the codec, or straight to dst when it won't compress.
+type compressor struct {
+	dst     io.Writer
+	codec   string // "" writes through from the start
+	sample  []byte
+	decided bool
+	enc     io.WriteCloser
+	applied string // the codec, once it was used
+	in      int64  // bytes written to the compressor, the size before compression
+}
+
+func newCompressor(dst io.Writer, codec string) *compressor {
+	return &compressor{dst: dst, codec: codec, decided: codec == ""}
+}
+
+func (c *compressor) Write(p []byte) (int, error) {
+	c.in += int64(len(p))
+
+	switch {
+	case !c.decided:
+		c.sample = append(c.sample, p...)
+		if len(c.sample) >= compressSampleLen {
+			if err := c.decide(); err != nil {
+				return 0, err
+			}
+		}
+		return len(p), nil
+	case c.enc != nil:
+		return c.enc.Write(p)
+	default:
+		return c.dst.Write(p)
+	}
+}
+
+// Close decides on a sample that never filled up and flushes the codec
+func (c *compressor) Close() error {
+	if !c.decided {
+		if err := c.decide(); err != nil {
+			return err
+		}
+	}
+	if c.enc != nil {
+		return c.enc.Close()
+	}
+	return nil
+}
+
+func (c *compressor) decide() error {
+	sample := c.sample
+	c.sample, c.decided = nil, true
+
+	codec, err := lookupCodec(c.codec)
+	if err != nil {
+		return err
+	}
+
+	if worthCompressing(codec, sample) {
+		if c.enc, err = codec.NewWriter(c.dst); err != nil {
+			return err
+		}
+		c.applied = c.codec
+		_, err = c.enc.Write(sample)
+		return err
+	}
+	_, err = c.dst.Write(sample)
+	return err
+}
+
+// worthCompressing tells from the start of the content whether codec shrinks it enough
+func worthCompressing(codec Codec, sample []byte) bool {
+	if len(sample) < minCompressLen {
+		return false
+	}
+
+	contentType := http.DetectContentType(sample)
+	for _, prefix := range incompressibleTypes {
+		if strings.HasPrefix(contentType, prefix) {
+			return false
+		}
+	}
+
+	out := &countingWriter{w: io.Discard}
+	enc, err := codec.NewWriter(out)
+	if err != nil {
+		return false
+	}
+	if _, err := enc.Write(sample); err != nil {
+		return false
+	}
+	if err := enc.Close(); err != nil {
+		return false
+	}
+	return float64(out.n) <= maxCompressRatio*float64(len(sample))
+}
+
+// decompressingReader closes the stored content along with the codec reading it
+type decompressingReader struct {
+	io.ReadCloser
+	stored io.Closer
+}
+
+func (d *decompressingReader) Close() error {
+	err := d.ReadCloser.Close()
+	if cerr := d.stored.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+type gzipCodec struct{}
+
+func (gzipCodec) NewWriter(w io.Writer) (io.WriteCloser, error) { return gzip.NewWriter(w), nil }
+func (gzipCodec) NewReader(r io.Reader) (io.ReadCloser, error)  { return gzip.NewReader(r) }
+
+type flateCodec struct{}
+
+func (flateCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return flate.NewWriter(w, flate.DefaultCompression)
+}
+func (flateCodec) NewReader(r io.Reader) (io.ReadCloser, error) { return flate.NewReader(r), nil }
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+GC is a mark and sweep over the storage root. The mark reads every index record and takes
+the CIDs they point at as live, along with the chunks their manifests list. Versions kept
+in histories (store_versions.go) are live too, once those past Retention.MaxAge are dropped.
+The sweep then removes, under every id:
+
+  - blobs and manifests nothing live points at
+  - temp files a crashed or abandoned write left behind
+  - directories that ended up empty
+
+Only what is older than the grace period goes, so content a write is still filing is left
+alone. Writes keep running while GC does: a put pins the CIDs it stores or reuses until its
+index record is written, and the sweep skips pinned CIDs as well as those unpinned since
+the mark, which the mark may not have seen a record for.
+*/
+
+const defaultGCGrace = time.Hour
+
+// GCReport is what a GC removed
+type GCReport struct {
+	Blobs     int // blobs and chunks
+	Manifests int
+	TempFiles int
+	Dirs      int
+	Bytes     int64 // reclaimed by the files above
+}
+
+// pinSet tracks the CIDs of the puts in flight
+type pinSet struct {
+	gc sync.Mutex // one GC at a time
+
+	mu       sync.Mutex
+	pinned   map[string]int
+	touched  map[string]bool // unpinned since the oldest running mark started, nil when none runs
+	tracking int             // the GCs and deletes that have a mark running
+}
+
+// pinHold is the pins of one put
+type pinHold struct {
+	set  *pinSet
+	cids []string
+}
+
+// ------------------------------ XXXXXXXXXXXXXXX---------------------------------------- //
+// --------------------------------- GC Methods ----------------------------------------- //
+
+/* Index
+1. GC: Mark what the index uses and sweep what it doesn't, older than grace
+2. mark: Collect the CIDs of an id that are live
+3. sweep: Remove the unused files of an id
+4. pruneDirs: Remove the empty directories under a directory
+*/
+
+// 1. GC ---------------------------//
+// GC collects every id under Root. A grace of 0 uses defaultGCGrace, a negative one removes
+// garbage however young it is.
+func (s *LocalStore) GC(grace time.Duration) (GCReport, error) {
+	if grace == 0 {
+		grace = defaultGCGrace
+	}
+	cutoff := time.Now().Add(-max(grace, 0))
+
+	s.pins.gc.Lock()
+	defer s.pins.gc.Unlock()
+
+	s.pins.track()
+	defer s.pins.untrack()
+
+	ids, err := s.IDs()
+	if err != nil {
+		return GCReport{}, err
+	}
+
+	var report GCReport
+	for _, id := range ids {
+		if err := s.expireVersions(id); err != nil {
+			return report, fmt.Errorf("gc of %s: %w", id, err)
+		}
+		live, err := s.mark(id)
+		if err != nil {
+			return report, fmt.Errorf("gc of %s: %w", id, err)
+		}
+		if err := s.sweep(id, live, cutoff, &report); err != nil {
+			return report, fmt.Errorf("gc of %s: %w", id, err)
+		}
+		if _, err := s.pruneDirs(filepath.Join(s.Root, id), cutoff, &report); err != nil {
+			return report, fmt.Errorf("gc of %s: %w", id, err)
+		}
+	}
+	return report, nil
+}
+
+// 2. mark ---------------------------//
+func (s *LocalStore) mark(id string) (map[string]bool, error) {
+	live := make(map[string]bool)
+	err := walkFiles(s.FS, filepath.Join(s.Root, id, indexDirName), func(path string) error {
+		rec, err := s.readIndex(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil // deleted while we walked
+		}
+		if err != nil {
+			return err // better to collect nothing than what an unreadable record points at
+		}
+		return s.markContent(id, rec.CID, live)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// the versions Versioning keeps, see store_versions.go
+	err = s.walkHistories(id, func(rec indexRecord) error {
+		return s.markContent(id, rec.CID, live)
+	})
+	return live, err
+}
+
+// markContent marks cid live, and the chunks of its manifest
+func (s *LocalStore) markContent(id string, cid string, live map[string]bool) error {
+	if live[cid] {
+		return nil
+	}
+	live[cid] = true
+
+	m, err := s.readManifest(id, cid)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil // a single blob, or a plain file
+	}
+	if err != nil {
+		return err
+	}
+	for _, chunk := range m.Chunks {
+		live[chunk.CID] = true
+	}
+	return nil
+}
+
+// 3. sweep ---------------------------//
+func (s *LocalStore) sweep(id string, live map[string]bool, cutoff time.Time, report *GCReport) error {
+	root := filepath.Join(s.Root, id)
+
+	return walkAllFiles(s.FS, root, func(path string) error {
+		rel, _ := filepath.Rel(root, path)
+		top, _, _ := strings.Cut(rel, string(filepath.Separator))
+		if top == quarantineDirName {
+			return nil // kept for whoever looks into the damage
+		}
+
+		stat, err := s.FS.Stat(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if stat.ModTime().After(cutoff) {
+			return nil
+		}
+
+		switch {
+		case isTempFile(path):
+			if err := s.FS.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+			report.TempFiles++
+
+		case s.ContentAddressed && (top == blobsDirName || top == manifestsDirName):
+			cid := filepath.Base(path)
+			if live[cid] {
+				return nil
+			}
+
+			removed, err := s.pins.removeUnlessPinned(cid, func() error { return s.FS.Remove(path) })
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+			if !removed {
+				return nil
+			}
+			if top == blobsDirName {
+				report.Blobs++
+			} else {
+				report.Manifests++
+			}
+
+		default:
+			return nil // index records, and plain files whose records the index may not have
+		}
+
+		report.Bytes += stat.Size()
+		return nil
+	})
+}
+
+// 4. pruneDirs ---------------------------//
+// pruneDirs reports whether dir is empty once the directories under it are pruned, it does
+// not remove dir itself
+func (s *LocalStore) pruneDirs(dir string, cutoff time.Time, report *GCReport) (bool, error) {
+	entries, err := s.FS.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	left := len(entries)
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		sub := filepath.Join(dir, entry.Name())
+		empty, err := s.pruneDirs(sub, cutoff, report)
+		if err != nil {
+			return false, err
+		}
+		if !empty {
+			continue
+		}
+
+		// a write may have just made it and be about to create its temp file
+		stat, err := s.FS.Stat(sub)
+		if err != nil || stat.ModTime().After(cutoff) {
+			continue
+		}
+		if err := s.FS.Remove(sub); err != nil {
+			continue // not empty any more
+		}
+		report.Dirs++
+		left--
+	}
+	return left == 0, nil
+}
+
+// ------------------------------ XXXXXXXXXXXXXXX---------------------------------------- //
+// ------------------------------- Methods of pinSet ------------------------------------ //
+
+func (p *pinSet) hold() *pinHold {
+	return &pinHold{set: p}
+}
+
+// add pins cid, before the put looks at whether the store already has it
+func (h *pinHold) add(cid string) {
+	h.set.mu.Lock()
+	defer h.set.mu.Unlock()
+
+	if h.set.pinned == nil {
+		h.set.pinned = make(map[string]int)
+	}
+	h.set.pinned[cid]++
+	h.cids = append(h.cids, cid)
+}
+
+// release unpins everything the put held, once its index record is written or it failed
+func (h *pinHold) release() {
+	h.set.mu.Lock()
+	defer h.set.mu.Unlock()
+
+	for _, cid := range h.cids {
+		if h.set.pinned[cid]--; h.set.pinned[cid] <= 0 {
+			delete(h.set.pinned, cid)
+		}
+		if h.set.touched != nil {
+			h.set.touched[cid] = true
+		}
+	}
+	h.cids = nil
+}
+
+// track starts noting the CIDs puts unpin, before a GC or a delete runs its mark
+func (p *pinSet) track() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.tracking++; p.tracking == 1 {
+		p.touched = make(map[string]bool)
+	}
+}
+
+func (p *pinSet) untrack() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.tracking--; p.tracking == 0 {
+		p.touched = nil
+	}
+}
+
+// removeUnlessPinned runs remove unless a put holds cid or held it since the running marks
+// started. The lock keeps a put from finding the file in between the check and the removal.
+func (p *pinSet) removeUnlessPinned(cid string, remove func() error) (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.pinned[cid] > 0 || p.touched[cid] {
+		return false, nil
+	}
+	if err := remove(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+Every Put leaves an index record behind, in every mode, holding the original key, the CID
+of the content, when it was written and its Metadata (store_meta.go):
+
+	<root>/<id>/.index/<key path>   {"key": "photos/a.jpg", "cid": "abcd...", "modified": "...", "meta": {...}}
+
+The path of a record comes from PathTransformFunc, so with CASPathTransformFunc it is a hash
+that can't be turned back into the key. Keeping the key inside the record is what lets List
+and Walk hand out the names the files were stored under. In content-addressed mode the record
+is also what the key resolves through. Plain files written before the index existed have no
+record and are not listed.
+*/
+
+// indexRecord is what the index keeps for a key
+type indexRecord struct {
+	Key      string    `json:"key"`
+	CID      string    `json:"cid"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	Meta     Metadata  `json:"meta"`
+	Deleted  bool      `json:"deleted,omitempty"` // a delete marker, only found in version histories
+}
+
+// ------------------------------ XXXXXXXXXXXXXXX---------------------------------------- //
+// ------------------------------- Index Methods ---------------------------------------- //
+
+/* Index
+1. Stat: Describe the object stored under key
+2. Walk: Call fn for every object of id whose key starts with prefix
+3. List: Collect what Walk finds, sorted by key
+4. IDs: The ids that have anything stored
+*/
+
+// 1. Stat ---------------------------//
+func (s *LocalStore) Stat(id string, key string) (ObjectInfo, error) {
+	path := s.indexPath(id, key)
+	rec, err := s.readIndex(path)
+	if errors.Is(err, fs.ErrNotExist) && !s.ContentAddressed {
+		// a plain file from before the index, all we know is what the filesystem says
+		stat, err := s.FS.Stat(s.filePath(id, key))
+		if err != nil {
+			return ObjectInfo{}, err
+		}
+		return ObjectInfo{Key: key, Size: stat.Size(), ModTime: stat.ModTime()}, nil
+	}
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	if rec.Key == "" {
+		rec.Key = key // a record from before keys were kept
+	}
+	return s.objectInfo(id, path, rec)
+}
+
+// 2. Walk ---------------------------//
+// Walk goes through the index in the order of the record paths, which is not the order of
+// the keys once they are hashed. fn returning filepath.SkipAll ends the walk early.
+func (s *LocalStore) Walk(id string, prefix string, fn func(info ObjectInfo) error) error {
+	return walkFiles(s.FS, filepath.Join(s.Root, id, indexDirName), func(path string) error {
+		rec, err := s.readIndex(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil // deleted while we walked
+		}
+		if err != nil {
+			return err
+		}
+		if rec.Key == "" || !strings.HasPrefix(rec.Key, prefix) {
+			return nil // records from before keys were kept have no name to list
+		}
+
+		info, err := s.objectInfo(id, path, rec)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return fn(info)
+	})
+}
+
+// 3. List ---------------------------//
+func (s *LocalStore) List(id string, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	err := s.Walk(id, prefix, func(info ObjectInfo) error {
+		objects = append(objects, info)
+		return nil
+	})
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, err
+}
+
+// 4. IDs ---------------------------//
+func (s *LocalStore) IDs() ([]string, error) {
+	entries, err := s.FS.ReadDir(s.Root)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil // nothing written yet
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			ids = append(ids, entry.Name())
+		}
+	}
+	return ids, nil
+}
+
+// ------------------------------ XXXXXXXXXXXXXXX---------------------------------------- //
+// ---------------------------------- Helpers ------------------------------------------- //
+
+func (s *LocalStore) indexPath(id string, key string) string {
+	return filepath.Join(s.Root, id, indexDirName, s.PathTransformFunc(key).FullPath())
+}
+
+// writeIndex files the record of info and returns info with the time it was written
+func (s *LocalStore) writeIndex(id string, info ObjectInfo) (ObjectInfo, error) {
+	info.ModTime = time.Now()
+
+	b, err := json.Marshal(indexRecord{Key: info.Key, CID: info.CID, Size: info.Size, Modified: info.ModTime, Meta: info.Meta})
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	_, err = s.writeAtomic(s.indexPath(id, info.Key), func(w io.Writer) (int64, error) {
+		return io.Copy(w, bytes.NewReader(b))
+	})
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return info, nil
+}
+
+func (s *LocalStore) readIndex(path string) (indexRecord, error) {
+	b, err := readFile(s.FS, path)
+	if err != nil {
+		return indexRecord{}, err
+	}
+
+	var rec indexRecord
+	if err := json.Unmarshal(b, &rec); err != nil {
+		rec = indexRecord{CID: strings.TrimSpace(string(b))} // the first records held nothing but the CID
+	}
+
+	if _, err := hex.DecodeString(rec.CID); err != nil || len(rec.CID) != 2*sha256.Size {
+		return indexRecord{}, fmt.Errorf("index record %s holds no content ID: %q", path, b)
+	}
+	return rec, nil
+}
+
+// objectInfo fills in the size of the object a record points at, and its modification time
+// from the record file when the record is too old to carry one
+func (s *LocalStore) objectInfo(id string, path string, rec indexRecord) (ObjectInfo, error) {
+	info := ObjectInfo{Key: rec.Key, CID: rec.CID, ModTime: rec.Modified, Meta: rec.Meta}
+
+	if s.ContentAddressed {
+		size, err := s.contentSize(id, rec.CID)
+		if err != nil {
+			return ObjectInfo{}, err
+		}
+		info.Size = size
+	} else {
+		stat, err := s.FS.Stat(s.filePath(id, rec.Key))
+		if err != nil {
+			return ObjectInfo{}, err
+		}
+		info.Size = stat.Size()
+	}
+
+	if info.ModTime.IsZero() {
+		stat, err := s.FS.Stat(path)
+		if err != nil {
+			return ObjectInfo{}, err
+		}
+		info.ModTime = stat.ModTime()
+	}
+	return info, nil
+}
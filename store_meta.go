@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+)
+
+/*
+Metadata describes an object beyond its bytes. It is kept in the object's index record
+(store_index.go), comes back from Stat, List and Walk, and travels in the messages that
+carry an object to a replica or back, so every node describes the object the same way.
+
+Replicas hold the sealed bytes, so their CID is that of the ciphertext, while Digest stays
+the SHA-256 of the plaintext the owner stored. The same goes for compressed objects, see
+store_compress.go.
+*/
+
+// encryption formats of the stored bytes
+const (
+	EncryptionNone   = ""        // the plaintext, as stored by the owner
+	EncryptionSealed = "nmbe-v1" // chunked AES-GCM from copySeal, see crypto.go
+)
+
+const sniffLen = 512 // what http.DetectContentType looks at
+
+var ErrExpired = errors.New("object expired")
+
+type Metadata struct {
+	ContentType string            `json:"content_type,omitempty"`
+	Digest      string            `json:"digest,omitempty"`      // hex SHA-256 of the plaintext
+	Encryption  string            `json:"encryption,omitempty"`  // format of the stored bytes
+	Compression string            `json:"compression,omitempty"` // codec of the bytes under the encryption
+	PlainSize   int64             `json:"plain_size,omitempty"`  // the size before compression
+	Creator     string            `json:"creator,omitempty"`     // the node that stored the object first
+	Version     string            `json:"version,omitempty"`     // see store_versions.go
+	Created     time.Time         `json:"created"`
+	Expires     time.Time         `json:"expires"`         // when the object goes, never when zero, see reaper.go
+	Attrs       map[string]string `json:"attrs,omitempty"` // set by the user, kept as given
+}
+
+// complete fills in what the caller left out and the store can tell from the content. head
+// holds the first bytes of what was written for sniffing the content type, digest its SHA-256.
+func (m Metadata) complete(head []byte, digest string) Metadata {
+	if m.Encryption == EncryptionNone && m.Compression == "" { // what was written is the plaintext
+		if m.Digest == "" {
+			m.Digest = digest
+		}
+		if m.ContentType == "" {
+			m.ContentType = http.DetectContentType(head)
+		}
+	}
+	if m.Created.IsZero() {
+		m.Created = time.Now()
+	}
+	return m
+}
+
+// expired tells whether the object is past its expiry at now
+func (m Metadata) expired(now time.Time) bool {
+	return !m.Expires.IsZero() && !now.Before(m.Expires)
+}
+
+// compressed tells whether Read has to decompress the stored bytes
+func (m Metadata) compressed() bool {
+	return m.Compression != "" && m.Encryption == EncryptionNone
+}
+
+// headWriter keeps the first sniffLen bytes written to it
+type headWriter struct {
+	buf []byte
+}
+
+func (h *headWriter) Write(p []byte) (int, error) {
+	if room := sniffLen - len(h.buf); room > 0 {
+		h.buf = append(h.buf, p[:min(room, len(p))]...)
+	}
+	return len(p), nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"path/filepath"
+)
+
+/*
+Quarantine is what the scrubber (scrubber.go) does with an object that failed verification.
+The files holding the damage are moved out of the way, to
+
+	<root>/<id>/.quarantine/<file name>
+
+where they can still be looked at, and the key is dropped from the index, so Has reports
+the object missing and a good copy can be written in its place. In content-addressed mode
+only the damaged blob, chunks or manifest move. A blob that other keys share moves too,
+those keys read as missing until the content is written again.
+*/
+
+const quarantineDirName = ".quarantine"
+
+// Quarantine sets the damaged files of the object under key aside and removes the key
+func (s *LocalStore) Quarantine(id string, key string) error {
+	size, counted := s.recordedSize(id, key)
+
+	var damaged []string
+	if s.ContentAddressed {
+		cid, err := s.lookupCID(id, key)
+		if err != nil {
+			return err
+		}
+		if damaged, err = s.damagedContent(id, cid); err != nil {
+			return err
+		}
+	} else {
+		damaged = []string{s.filePath(id, key)}
+	}
+
+	dir := filepath.Join(s.Root, id, quarantineDirName)
+	if err := s.FS.MkdirAll(dir); err != nil {
+		return err
+	}
+
+	for _, path := range damaged {
+		err := s.FS.Rename(path, filepath.Join(dir, filepath.Base(path)))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue // already gone, which is the damage
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	err := s.removeWithEmptyParents(s.indexPath(id, key))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) { // a plain file from before the index has no record
+		return err
+	}
+	if !counted {
+		return nil
+	}
+	return s.unaccount(id, size)
+}
+
+// damagedContent finds the files of the content with the given CID that don't hold what they should
+func (s *LocalStore) damagedContent(id string, cid string) ([]string, error) {
+	m, err := s.readManifest(id, cid)
+	if errors.Is(err, fs.ErrNotExist) {
+		return []string{s.blobPath(id, cid)}, nil // a single blob, and it failed as a whole
+	}
+	if err != nil {
+		return []string{s.manifestPath(id, cid)}, nil
+	}
+
+	var damaged []string
+	for _, chunk := range m.Chunks {
+		ok, err := s.blobIntact(id, chunk.CID)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			damaged = append(damaged, s.blobPath(id, chunk.CID))
+		}
+	}
+	if len(damaged) == 0 {
+		// every chunk is fine, so the manifest lists the wrong ones
+		damaged = append(damaged, s.manifestPath(id, cid))
+	}
+	return damaged, nil
+}
+
+func (s *LocalStore) blobIntact(id string, cid string) (bool, error) {
+	f, err := s.FS.Open(s.blobPath(id, cid))
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return false, err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)) == cid, nil
+}
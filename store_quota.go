@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"sync"
+)
+
+/*
+With StoreOpts.Quota set the store counts the bytes and objects it holds, per id and for the
+whole node, and refuses writes that would go over a limit with ErrQuotaExceeded. Bytes are
+what the keys hold, after compression and before dedup, so a user is charged the same
+whatever else is stored.
+
+A write reserves its bytes as they stream in, so it fails as soon as it crosses the limit
+and concurrent writes can't overshoot it together. Overwriting a key is charged for what it
+adds. The counts live in <root>/.usage and are rebuilt from the index when that file is
+missing, e.g. after an upgrade or to fix counts a crash left behind.
+*/
+
+const usageFileName = ".usage"
+
+var ErrQuotaExceeded = errors.New("storage quota exceeded")
+
+// Quota limits what the store holds, a limit of 0 is no limit
+type Quota struct {
+	BytesPerID   int64
+	ObjectsPerID int64
+	Bytes        int64 // across every id
+	Objects      int64
+}
+
+type Usage struct {
+	Bytes   int64 `json:"bytes"`
+	Objects int64 `json:"objects"`
+}
+
+// usageTable is the accounting of a LocalStore, loaded on first use
+type usageTable struct {
+	mu      sync.Mutex
+	loaded  bool
+	used    map[string]Usage // committed, and persisted
+	pending map[string]Usage // reserved by the writes in flight
+}
+
+// reservation is the share of one write in usageTable.pending
+type reservation struct {
+	store   *LocalStore
+	id      string
+	old     int64 // the size of what the write replaces, it is only charged for growing past it
+	isNew   bool  // the key had nothing, so the write adds an object
+	written int64
+	charged int64 // bytes of pending held for this write
+	done    bool
+}
+
+// ------------------------------ XXXXXXXXXXXXXXX---------------------------------------- //
+// -------------------------------- Quota Methods --------------------------------------- //
+
+/* Index
+1. Usage: What id holds, or the whole node for an empty id
+2. CheckQuota: Tell whether a write of size bytes under key would fit
+3. reserve: Start the accounting of a write to key
+4. unaccount: Give back what a deleted object used
+*/
+
+// 1. Usage ---------------------------//
+func (s *LocalStore) Usage(id string) (Usage, error) {
+	s.usage.mu.Lock()
+	defer s.usage.mu.Unlock()
+
+	if err := s.loadUsage(); err != nil {
+		return Usage{}, err
+	}
+	if id != "" {
+		return s.usage.used[id], nil
+	}
+	return sumUsage(s.usage.used), nil
+}
+
+// 2. CheckQuota ---------------------------//
+// CheckQuota lets a peer refuse a replica before it reads the body
+func (s *LocalStore) CheckQuota(id string, key string, size int64) error {
+	if !s.quotaEnabled() {
+		return nil
+	}
+
+	res, err := s.reserve(id, key)
+	if err != nil {
+		return err
+	}
+	defer res.release()
+	return res.charge(size)
+}
+
+// 3. reserve ---------------------------//
+// reserve returns nil when there are no quotas, the methods of a nil reservation do nothing
+func (s *LocalStore) reserve(id string, key string) (*reservation, error) {
+	if !s.quotaEnabled() {
+		return nil, nil
+	}
+
+	res := &reservation{store: s, id: id, isNew: true}
+	if size, ok := s.recordedSize(id, key); ok {
+		res.old, res.isNew = size, false
+	}
+
+	t := &s.usage
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err := s.loadUsage(); err != nil {
+		return nil, err
+	}
+	if res.isNew {
+		if err := s.checkQuota(id, 0, 1); err != nil {
+			return nil, err
+		}
+		t.pending[id] = addUsage(t.pending[id], 0, 1)
+	}
+	return res, nil
+}
+
+// 4. unaccount ---------------------------//
+func (s *LocalStore) unaccount(id string, size int64) error {
+	if !s.quotaEnabled() {
+		return nil
+	}
+
+	s.usage.mu.Lock()
+	defer s.usage.mu.Unlock()
+
+	if err := s.loadUsage(); err != nil {
+		return err
+	}
+	s.usage.used[id] = addUsage(s.usage.used[id], -size, -1)
+	return s.saveUsage()
+}
+
+// ------------------------------ XXXXXXXXXXXXXXX---------------------------------------- //
+// ---------------------------- Methods of reservation ---------------------------------- //
+
+// Write charges what passes through it, put tees the content into it
+func (r *reservation) Write(p []byte) (int, error) {
+	if r == nil {
+		return len(p), nil
+	}
+	if err := r.charge(r.written + int64(len(p))); err != nil {
+		return 0, err
+	}
+	r.written += int64(len(p))
+	return len(p), nil
+}
+
+// charge makes the write hold what size bytes add over the old content
+func (r *reservation) charge(size int64) error {
+	if r == nil {
+		return nil
+	}
+
+	t := &r.store.usage
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delta := max(size-r.old, 0) - r.charged
+	if delta <= 0 {
+		return nil
+	}
+	if err := r.store.checkQuota(r.id, delta, 0); err != nil {
+		return err
+	}
+	t.pending[r.id] = addUsage(t.pending[r.id], delta, 0)
+	r.charged += delta
+	return nil
+}
+
+// commit turns the reservation into usage once the object of size bytes is filed
+func (r *reservation) commit(size int64) error {
+	if r == nil || r.done {
+		return nil
+	}
+
+	t := &r.store.usage
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	r.unpend()
+	objects := int64(0)
+	if r.isNew {
+		objects = 1
+	}
+	t.used[r.id] = addUsage(t.used[r.id], size-r.old, objects)
+	return r.store.saveUsage()
+}
+
+// release gives back what a write that failed had reserved
+func (r *reservation) release() {
+	if r == nil || r.done {
+		return
+	}
+
+	r.store.usage.mu.Lock()
+	defer r.store.usage.mu.Unlock()
+	r.unpend()
+}
+
+// unpend drops the reservation from pending, the caller holds the lock
+func (r *reservation) unpend() {
+	objects := int64(0)
+	if r.isNew {
+		objects = 1
+	}
+	r.store.usage.pending[r.id] = addUsage(r.store.usage.pending[r.id], -r.charged, -objects)
+	r.done = true
+}
+
+// ------------------------------ XXXXXXXXXXXXXXX---------------------------------------- //
+// ---------------------------------- Helpers ------------------------------------------- //
+
+// recordedSize is the size the index record of key was written with, what the usage holds for it
+func (s *LocalStore) recordedSize(id string, key string) (int64, bool) {
+	rec, err := s.readIndex(s.indexPath(id, key))
+	return rec.Size, err == nil
+}
+
+func (s *LocalStore) quotaEnabled() bool {
+	return s.Quota != Quota{}
+}
+
+// checkQuota tells whether id can take size bytes and objects more, the caller holds the lock
+func (s *LocalStore) checkQuota(id string, size int64, objects int64) error {
+	t := &s.usage
+	held := addUsage(t.used[id], t.pending[id].Bytes, t.pending[id].Objects)
+	total := addUsage(sumUsage(t.used), sumUsage(t.pending).Bytes, sumUsage(t.pending).Objects)
+
+	switch {
+	case exceeds(held.Bytes+size, s.Quota.BytesPerID):
+		return fmt.Errorf("%w: %s holds %d of its %d bytes", ErrQuotaExceeded, id, held.Bytes, s.Quota.BytesPerID)
+	case exceeds(held.Objects+objects, s.Quota.ObjectsPerID):
+		return fmt.Errorf("%w: %s holds %d of its %d objects", ErrQuotaExceeded, id, held.Objects, s.Quota.ObjectsPerID)
+	case exceeds(total.Bytes+size, s.Quota.Bytes):
+		return fmt.Errorf("%w: the node holds %d of its %d bytes", ErrQuotaExceeded, total.Bytes, s.Quota.Bytes)
+	case exceeds(total.Objects+objects, s.Quota.Objects):
+		return fmt.Errorf("%w: the node holds %d of its %d objects", ErrQuotaExceeded, total.Objects, s.Quota.Objects)
+	}
+	return nil
+}
+
+func exceeds(n int64, limit int64) bool {
+	return limit > 0 && n > limit
+}
+
+func addUsage(u Usage, size int64, objects int64) Usage {
+	return Usage{Bytes: u.Bytes + size, Objects: u.Objects + objects}
+}
+
+func sumUsage(m map[string]Usage) Usage {
+	var total Usage
+	for _, u := range m {
+		total = addUsage(total, u.Bytes, u.Objects)
+	}
+	return total
+}
+
+// loadUsage reads the usage file, or counts the index when there is none, the caller holds the lock
+func (s *LocalStore) loadUsage() error {
+	t := &s.usage
+	if t.loaded {
+		return nil
+	}
+
+	used := make(map[string]Usage)
+	b, err := readFile(s.FS, filepath.Join(s.Root, usageFileName))
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(b, &used); err != nil {
+			return fmt.Errorf("usage file: %w", err)
+		}
+
+	case errors.Is(err, fs.ErrNotExist):
+		ids, err := s.IDs()
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			err := s.Walk(id, "", func(info ObjectInfo) error {
+				used[id] = addUsage(used[id], info.Size, 1)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+	default:
+		return err
+	}
+
+	t.used, t.pending, t.loaded = used, make(map[string]Usage), true
+	return nil
+}
+
+// saveUsage persists the committed usage, the caller holds the lock
+func (s *LocalStore) saveUsage() error {
+	b, err := json.Marshal(s.usage.used)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.writeAtomic(filepath.Join(s.Root, usageFileName), func(w io.Writer) (int64, error) {
+		return io.Copy(w, bytes.NewReader(b))
+	})
+	return err
+}
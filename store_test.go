@@ -3,20 +3,27 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	mrand "math/rand"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 // ------------------------ Utility func ------------------------ //
-func newStore() *Store {
+func newStore() *LocalStore {
 	opts := StoreOpts{
 		PathTransformFunc: CASPathTransformFunc,
 	}
-	return NewStore(opts)
+	return NewLocalStore(opts)
 }
 
-func cleanupTest(t *testing.T, s *Store) {
+func cleanupTest(t *testing.T, s *LocalStore) {
 	if err := s.Clear(); err != nil {
 		t.Error(err)
 	}
@@ -81,6 +88,783 @@ func TestStore(t *testing.T) {
 	}
 }
 
+// ------------------------------ Store backends test ------------------------------ //
+
+func TestStoreBackends(t *testing.T) {
+	backends := map[string]func(opts StoreOpts) Store{
+		"disk": func(opts StoreOpts) Store {
+			opts.Root = t.TempDir()
+			return NewLocalStore(opts)
+		},
+		"memory": func(opts StoreOpts) Store {
+			return NewMemoryStore(opts)
+		},
+	}
+	modes := map[string]StoreOpts{
+		"plain":   {},
+		"cas":     {ContentAddressed: true},
+		"chunked": {Chunking: true},
+	}
+
+	for backend, newBackend := range backends {
+		for mode, opts := range modes {
+			s := newBackend(opts)
+			id := generateID()
+			data := []byte("the same bytes in every backend")
+
+			for _, key := range []string{"a.txt", "b.txt"} {
+				if _, err := s.Write(id, key, bytes.NewReader(data)); err != nil {
+					t.Fatalf("%s/%s: %v", backend, mode, err)
+				}
+			}
+
+			info, err := s.Stat(id, "a.txt")
+			if err != nil || info.Size != int64(len(data)) {
+				t.Errorf("%s/%s: stat gave %+v, %v", backend, mode, info, err)
+			}
+
+			list, err := s.List(id, "")
+			if err != nil || len(list) != 2 {
+				t.Errorf("%s/%s: listed %+v, %v", backend, mode, list, err)
+			}
+
+			_, r, err := s.Read(id, "b.txt")
+			if err != nil {
+				t.Fatalf("%s/%s: %v", backend, mode, err)
+			}
+			got, _ := io.ReadAll(r)
+			r.(io.Closer).Close()
+			if !bytes.Equal(got, data) {
+				t.Errorf("%s/%s: read back %q", backend, mode, got)
+			}
+
+			if err := s.Delete(id, "a.txt"); err != nil {
+				t.Fatalf("%s/%s: %v", backend, mode, err)
+			}
+			if s.Has(id, "a.txt") || !s.Has(id, "b.txt") {
+				t.Errorf("%s/%s: delete removed the wrong keys", backend, mode)
+			}
+		}
+	}
+}
+
+// ------------------------------ Key listing test -------------------------------- //
+
+func TestListKeepsOriginalKeys(t *testing.T) {
+	for _, cas := range []bool{false, true} {
+		s := NewMemoryStore(StoreOpts{PathTransformFunc: CASPathTransformFunc, ContentAddressed: cas})
+		id := generateID()
+
+		keys := []string{"photos/b.jpg", "docs/c.txt", "photos/a.jpg"}
+		for i, key := range keys {
+			if _, err := s.Write(id, key, bytes.NewReader(bytes.Repeat([]byte("x"), i+1))); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		list, err := s.List(id, "photos/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(list) != 2 || list[0].Key != "photos/a.jpg" || list[1].Key != "photos/b.jpg" {
+			t.Fatalf("cas %v: listed %+v", cas, list)
+		}
+		if list[0].Size != 3 || list[0].ModTime.IsZero() {
+			t.Errorf("cas %v: photos/a.jpg listed as %+v", cas, list[0])
+		}
+
+		walked := 0
+		err = s.Walk(id, "", func(info ObjectInfo) error {
+			walked++
+			return filepath.SkipAll
+		})
+		if err != nil || walked != 1 {
+			t.Errorf("cas %v: walk stopped after %d objects, %v", cas, walked, err)
+		}
+
+		if err := s.Delete(id, "photos/a.jpg"); err != nil {
+			t.Fatal(err)
+		}
+		if list, _ := s.List(id, ""); len(list) != 2 {
+			t.Errorf("cas %v: listed %+v after a delete", cas, list)
+		}
+	}
+}
+
+func TestStatReturnsMetadata(t *testing.T) {
+	for _, cas := range []bool{false, true} {
+		s := NewMemoryStore(StoreOpts{PathTransformFunc: CASPathTransformFunc, ContentAddressed: cas})
+		id := generateID()
+
+		meta := Metadata{Creator: "node-a", Attrs: map[string]string{"camera": "x100"}}
+		put, err := s.PutMeta(id, "a.png", bytes.NewReader([]byte("\x89PNG\r\n\x1a\nrest of the image")), meta)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		info, err := s.Stat(id, "a.png")
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := info.Meta
+		if m.ContentType != "image/png" || m.Digest != put.CID || m.Creator != "node-a" || m.Created.IsZero() || m.Attrs["camera"] != "x100" {
+			t.Errorf("cas %v: stat gave %+v", cas, m)
+		}
+
+		// metadata belongs to a write, overwriting the key replaces it
+		if _, err := s.Put(id, "a.png", bytes.NewReader([]byte("plain text now"))); err != nil {
+			t.Fatal(err)
+		}
+		if info, _ := s.Stat(id, "a.png"); info.Meta.Attrs != nil || info.Meta.ContentType != "text/plain; charset=utf-8" {
+			t.Errorf("cas %v: overwritten object still described as %+v", cas, info.Meta)
+		}
+	}
+}
+
+func TestCompressionIsTransparent(t *testing.T) {
+	text := bytes.Repeat([]byte("2024-05-01 12:00:00 INFO request served in 3ms\n"), 4000)
+	random := make([]byte, 100<<10)
+	mrand.New(mrand.NewSource(1)).Read(random)
+	png := append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, 4096)...) // compresses, but is an image
+
+	for _, chunking := range []bool{false, true} {
+		s := NewMemoryStore(StoreOpts{PathTransformFunc: CASPathTransformFunc, Chunking: chunking, Compression: CompressionGzip})
+		id := generateID()
+
+		for _, tc := range []struct {
+			key   string
+			data  []byte
+			codec string
+		}{
+			{"app.log", text, CompressionGzip},
+			{"noise.bin", random, ""},
+			{"a.png", png, ""},
+		} {
+			info, err := s.Put(id, tc.key, bytes.NewReader(tc.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			sum := sha256.Sum256(tc.data)
+			if m := info.Meta; m.Compression != tc.codec || m.Digest != hex.EncodeToString(sum[:]) {
+				t.Errorf("chunking %v: %s stored as %+v", chunking, tc.key, m)
+			}
+
+			size, r, err := s.Read(id, tc.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := io.ReadAll(io.LimitReader(r, size))
+			r.(io.Closer).Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(b, tc.data) || size != int64(len(tc.data)) {
+				t.Errorf("chunking %v: %s read back as %d bytes, reported %d", chunking, tc.key, len(b), size)
+			}
+		}
+
+		// what is stored is the gzip stream, and the CID is its hash
+		info, _ := s.Stat(id, "app.log")
+		if info.Size >= int64(len(text))/10 || info.Meta.PlainSize != int64(len(text)) {
+			t.Errorf("chunking %v: %d bytes stored as %d", chunking, len(text), info.Size)
+		}
+		size, r, err := s.ReadStored(id, "app.log")
+		if err != nil {
+			t.Fatal(err)
+		}
+		stored, _ := io.ReadAll(io.LimitReader(r, size))
+		r.(io.Closer).Close()
+		if sum := sha256.Sum256(stored); hex.EncodeToString(sum[:]) != info.CID || !bytes.HasPrefix(stored, []byte{0x1f, 0x8b}) {
+			t.Errorf("chunking %v: stored bytes are not the gzip stream the CID names", chunking)
+		}
+
+		// the caller can pick the codec, or none, per object
+		info, err = s.PutMeta(id, "raw.log", bytes.NewReader(text), Metadata{Compression: CompressionNone})
+		if err != nil || info.Meta.Compression != "" || info.Size != int64(len(text)) {
+			t.Errorf("chunking %v: asked for no compression, got %+v, %v", chunking, info, err)
+		}
+		info, err = s.PutMeta(id, "flat.log", bytes.NewReader(text), Metadata{Compression: CompressionFlate})
+		if err != nil || info.Meta.Compression != CompressionFlate {
+			t.Errorf("chunking %v: asked for flate, got %+v, %v", chunking, info.Meta, err)
+		}
+		if _, err := s.PutMeta(id, "x", bytes.NewReader(text), Metadata{Compression: "lz9"}); !errors.Is(err, ErrUnknownCodec) {
+			t.Errorf("chunking %v: unknown codec gave %v", chunking, err)
+		}
+	}
+}
+
+func TestReadRange(t *testing.T) {
+	data := make([]byte, 300<<10)
+	mrand.New(mrand.NewSource(2)).Read(data)
+	text := bytes.Repeat([]byte("a line that compresses well\n"), 10000)
+
+	stores := map[string]*LocalStore{
+		"plain":      NewMemoryStore(StoreOpts{PathTransformFunc: CASPathTransformFunc}),
+		"cas":        NewMemoryStore(StoreOpts{PathTransformFunc: CASPathTransformFunc, ContentAddressed: true}),
+		"chunked":    NewMemoryStore(StoreOpts{PathTransformFunc: CASPathTransformFunc, Chunking: true}),
+		"compressed": NewMemoryStore(StoreOpts{PathTransformFunc: CASPathTransformFunc, Chunking: true, Compression: CompressionGzip}),
+	}
+	for name, s := range stores {
+		id := generateID()
+		for key, content := range map[string][]byte{"data": data, "text": text} {
+			if _, err := s.Put(id, key, bytes.NewReader(content)); err != nil {
+				t.Fatal(err)
+			}
+
+			size := int64(len(content))
+			for _, r := range [][2]int64{{0, 10}, {1000, 70000}, {size - 100, -1}, {size - 100, 500}, {size, 10}, {12345, 0}} {
+				n, rd, err := s.ReadRange(id, key, r[0], r[1])
+				if err != nil {
+					t.Fatalf("%s %s %v: %v", name, key, r, err)
+				}
+				got, err := io.ReadAll(rd)
+				rd.(io.Closer).Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				end := size
+				if r[1] >= 0 {
+					end = min(r[0]+r[1], size)
+				}
+				if want := content[r[0]:end]; !bytes.Equal(got, want) || n != int64(len(want)) {
+					t.Errorf("%s %s %v: got %d bytes, reported %d, want %d", name, key, r, len(got), n, len(want))
+				}
+			}
+
+			if _, _, err := s.ReadRange(id, key, size+1, 1); !errors.Is(err, ErrInvalidRange) {
+				t.Errorf("%s %s: range past the end gave %v", name, key, err)
+			}
+		}
+	}
+}
+
+func TestVersioningKeepsHistory(t *testing.T) {
+	s := NewMemoryStore(StoreOpts{PathTransformFunc: CASPathTransformFunc, Versioning: true, Retention: Retention{Versions: 2}})
+	id := generateID()
+
+	var written []ObjectInfo
+	for i := 1; i <= 4; i++ {
+		info, err := s.Put(id, "doc", bytes.NewReader([]byte(fmt.Sprintf("version %d", i))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		written = append(written, info)
+	}
+
+	// the current version and the two before it, newest first
+	versions, err := s.Versions(id, "doc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 3 || versions[0].Meta.Version != written[3].Meta.Version || versions[2].Meta.Version != written[1].Meta.Version {
+		t.Fatalf("kept %+v", versions)
+	}
+
+	readVersion := func(version string) (string, error) {
+		size, r, err := s.ReadVersion(id, "doc", version)
+		if err != nil {
+			return "", err
+		}
+		defer r.(io.Closer).Close()
+		b, err := io.ReadAll(io.LimitReader(r, size))
+		return string(b), err
+	}
+	if got, err := readVersion(written[1].Meta.Version); err != nil || got != "version 2" {
+		t.Errorf("version 2 read back as %q, %v", got, err)
+	}
+	if _, err := readVersion(written[0].Meta.Version); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("the version past the retention gave %v", err)
+	}
+	if _, err := s.FS.Stat(s.blobPath(id, written[0].CID)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("the content of the dropped version is still there: %v", err)
+	}
+
+	// a delete is a marker, the versions under it stay readable
+	if err := s.Delete(id, "doc"); err != nil {
+		t.Fatal(err)
+	}
+	if s.Has(id, "doc") {
+		t.Error("deleted key still there")
+	}
+	versions, _ = s.Versions(id, "doc")
+	if len(versions) != 2 || !versions[0].Deleted {
+		t.Errorf("after the delete the history is %+v", versions)
+	}
+	if got, err := readVersion(written[3].Meta.Version); err != nil || got != "version 4" {
+		t.Errorf("version 4 read back as %q, %v", got, err)
+	}
+
+	// GC keeps what the history points at
+	if _, err := s.GC(-1); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := readVersion(written[3].Meta.Version); err != nil || got != "version 4" {
+		t.Errorf("after GC version 4 read back as %q, %v", got, err)
+	}
+}
+
+func TestVersionsExpireWithAge(t *testing.T) {
+	s := NewMemoryStore(StoreOpts{PathTransformFunc: CASPathTransformFunc, Versioning: true, Retention: Retention{MaxAge: 20 * time.Millisecond}})
+	id := generateID()
+
+	old, err := s.Put(id, "doc", bytes.NewReader([]byte("old")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Put(id, "doc", bytes.NewReader([]byte("new"))); err != nil {
+		t.Fatal(err)
+	}
+	if versions, _ := s.Versions(id, "doc"); len(versions) != 2 {
+		t.Fatalf("kept %d versions", len(versions))
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if _, err := s.GC(-1); err != nil {
+		t.Fatal(err)
+	}
+	if versions, _ := s.Versions(id, "doc"); len(versions) != 1 {
+		t.Errorf("kept %d versions past their age", len(versions))
+	}
+	if _, err := s.FS.Stat(s.blobPath(id, old.CID)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("the content of the expired version is still there: %v", err)
+	}
+}
+
+func TestTombstonesKeepVersionsBuried(t *testing.T) {
+	s := NewMemoryStore(StoreOpts{PathTransformFunc: CASPathTransformFunc, ContentAddressed: true})
+	id := generateID()
+
+	info, err := s.Put(id, "doc", bytes.NewReader([]byte("short lived")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Bury(id, "doc", info.Meta.Version); err != nil {
+		t.Fatal(err)
+	}
+	if s.Has(id, "doc") {
+		t.Fatal("buried key is still there")
+	}
+
+	// a stale copy of the buried version is refused, a new write is not
+	stale := Metadata{Version: info.Meta.Version}
+	if _, err := s.PutMeta(id, "doc", bytes.NewReader([]byte("short lived")), stale); !errors.Is(err, ErrTombstoned) {
+		t.Errorf("buried version written back: %v", err)
+	}
+	past := Metadata{Expires: time.Now().Add(-time.Second)}
+	if _, err := s.PutMeta(id, "doc", bytes.NewReader([]byte("expired")), past); !errors.Is(err, ErrExpired) {
+		t.Errorf("expired copy written: %v", err)
+	}
+	if _, err := s.Put(id, "doc", bytes.NewReader([]byte("back again"))); err != nil {
+		t.Fatal(err)
+	}
+
+	// burying a version that was replaced leaves the current one alone
+	if err := s.Bury(id, "doc", info.Meta.Version); err != nil || !s.Has(id, "doc") {
+		t.Errorf("burying an old version took the new one: %v", err)
+	}
+
+	// a tombstone covers the versions before its own
+	if err := s.Bury(id, "doc", newVersionID()); err != nil || s.Has(id, "doc") {
+		t.Fatalf("burying a later version left the key: %v", err)
+	}
+	if _, err := s.PutMeta(id, "doc", bytes.NewReader([]byte("short lived")), stale); !errors.Is(err, ErrTombstoned) {
+		t.Errorf("older version written back: %v", err)
+	}
+
+	if n, err := s.PurgeTombstones(time.Now().Add(time.Second)); err != nil || n != 3 {
+		t.Errorf("purged %d tombstones, %v", n, err)
+	}
+	if _, err := s.PutMeta(id, "doc", bytes.NewReader([]byte("short lived")), stale); err != nil {
+		t.Errorf("version refused after its tombstone was purged: %v", err)
+	}
+}
+
+func TestBuriedVersionsLeaveTheHistory(t *testing.T) {
+	s := NewMemoryStore(StoreOpts{PathTransformFunc: CASPathTransformFunc, Versioning: true})
+	id := generateID()
+
+	first, err := s.Put(id, "doc", bytes.NewReader([]byte("first draft")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := s.Put(id, "doc", bytes.NewReader([]byte("second draft")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Bury(id, "doc", second.Meta.Version); err != nil {
+		t.Fatal(err)
+	}
+
+	// neither the buried version nor the one it replaced reads back by its ID
+	for _, version := range []string{first.Meta.Version, second.Meta.Version} {
+		if _, _, err := s.ReadVersion(id, "doc", version); err == nil {
+			t.Errorf("buried version %s still reads", version)
+		}
+	}
+	versions, err := s.Versions(id, "doc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range versions {
+		if !v.Deleted {
+			t.Errorf("buried version %s still in the history", v.Meta.Version)
+		}
+	}
+	for _, cid := range []string{first.CID, second.CID} {
+		if _, r, err := s.readContent(id, cid); err == nil {
+			r.Close()
+			t.Errorf("the content %s of a buried version is still stored", cid)
+		}
+	}
+}
+
+// ------------------------------ Atomic write test ------------------------------- //
+
+type failingReader struct{ after []byte }
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if len(r.after) == 0 {
+		return 0, errors.New("connection lost")
+	}
+	n := copy(p, r.after)
+	r.after = r.after[n:]
+	return n, nil
+}
+
+func TestFailedWriteKeepsPreviousContent(t *testing.T) {
+	for _, durability := range []Durability{DurabilityNone, DurabilityFsyncFile, DurabilityFsyncDir} {
+		for _, cas := range []bool{false, true} {
+			s := NewLocalStore(StoreOpts{
+				Root:              t.TempDir(),
+				PathTransformFunc: CASPathTransformFunc,
+				ContentAddressed:  cas,
+				Durability:        durability,
+			})
+			id := generateID()
+
+			if _, err := s.Write(id, "a.txt", bytes.NewReader([]byte("complete old content"))); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := s.Write(id, "a.txt", &failingReader{after: []byte("half of the new")}); err == nil {
+				t.Fatal("expected the write to fail")
+			}
+
+			_, r, err := s.Read(id, "a.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, _ := io.ReadAll(r)
+			r.(io.Closer).Close()
+			if string(got) != "complete old content" {
+				t.Errorf("%s, cas %v: read %q after a failed write", durability, cas, got)
+			}
+
+			var temps []string
+			filepath.WalkDir(s.Root, func(path string, d os.DirEntry, err error) error {
+				if matched, _ := filepath.Match(tempFilePattern, filepath.Base(path)); matched {
+					temps = append(temps, path)
+				}
+				return nil
+			})
+			if len(temps) != 0 {
+				t.Errorf("%s, cas %v: temp files left behind: %v", durability, cas, temps)
+			}
+		}
+	}
+}
+
+// ------------------------- Content addressed store test -------------------------- //
+
+func newCASStore(t *testing.T) *LocalStore {
+	return NewLocalStore(StoreOpts{
+		Root:              t.TempDir(),
+		PathTransformFunc: CASPathTransformFunc,
+		ContentAddressed:  true,
+	})
+}
+
+func TestContentAddressedDedup(t *testing.T) {
+	s := newCASStore(t)
+	id := generateID()
+	data := []byte("the same bytes under two names")
+
+	a, err := s.Put(id, "a.txt", bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := s.Put(id, "b.txt", bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sum := sha256.Sum256(data)
+	if a.CID != hex.EncodeToString(sum[:]) || b.CID != a.CID {
+		t.Fatalf("content IDs %s and %s, want the SHA-256 of the content", a.CID, b.CID)
+	}
+
+	blobs, _ := filepath.Glob(filepath.Join(s.Root, id, blobsDirName, "*", "*", "*"))
+	if len(blobs) != 1 {
+		t.Fatalf("want the content stored once, found %d blobs", len(blobs))
+	}
+
+	// the blob stays as long as a name points at it
+	if err := s.Delete(id, "a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if s.Has(id, "a.txt") || !s.Has(id, "b.txt") {
+		t.Fatal("deleting a.txt should only drop a.txt")
+	}
+
+	_, r, err := s.Read(id, "b.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(r)
+	r.(io.Closer).Close()
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("read back %q, %v", got, err)
+	}
+
+	if err := s.Delete(id, "b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(s.blobPath(id, a.CID)); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("blob should be gone with its last name, stat says %v", err)
+	}
+}
+
+func TestContentAddressedDetectsTampering(t *testing.T) {
+	s := newCASStore(t)
+	id := generateID()
+
+	info, err := s.Put(id, "a.txt", bytes.NewReader([]byte("original content")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(s.blobPath(id, info.CID), []byte("modified content"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	size, r, err := s.Read(id, "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.(io.Closer).Close()
+
+	// readers that stop at the size must still see the error
+	_, err = io.ReadAll(io.LimitReader(r, size))
+	if !errors.Is(err, ErrContentCorrupt) {
+		t.Fatalf("want ErrContentCorrupt, got %v", err)
+	}
+}
+
+// ------------------------------ Chunked store test ------------------------------- //
+
+func TestChunkedStoreSharesChunks(t *testing.T) {
+	s := NewLocalStore(StoreOpts{
+		Root:              t.TempDir(),
+		PathTransformFunc: CASPathTransformFunc,
+		Chunking:          true,
+	})
+	id := generateID()
+
+	data := make([]byte, 1<<20)
+	mrand.New(mrand.NewSource(3)).Read(data)
+	edited := append(bytes.Clone(data), []byte("an appended line")...)
+
+	a, err := s.Put(id, "a.bin", bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobsBefore := countFiles(t, filepath.Join(s.Root, id, blobsDirName))
+
+	if _, err := s.Put(id, "b.bin", bytes.NewReader(edited)); err != nil {
+		t.Fatal(err)
+	}
+	added := countFiles(t, filepath.Join(s.Root, id, blobsDirName)) - blobsBefore
+	if added > 2 {
+		t.Errorf("a file that only grew at the end added %d new chunks", added)
+	}
+
+	size, r, err := s.Read(id, "b.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(io.LimitReader(r, size))
+	r.(io.Closer).Close()
+	if err != nil || !bytes.Equal(got, edited) {
+		t.Fatalf("read back %d bytes, %v", len(got), err)
+	}
+
+	// deleting one file keeps the chunks the other still uses
+	if err := s.Delete(id, "b.bin"); err != nil {
+		t.Fatal(err)
+	}
+	if n := countFiles(t, filepath.Join(s.Root, id, blobsDirName)); n != blobsBefore {
+		t.Errorf("%d chunks left, want the %d of a.bin", n, blobsBefore)
+	}
+
+	// and a modified chunk shows up on read
+	m, err := s.readManifest(id, a.CID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunk := s.blobPath(id, m.Chunks[len(m.Chunks)/2].CID)
+	b, _ := os.ReadFile(chunk)
+	b[0] ^= 1
+	os.WriteFile(chunk, b, 0o644)
+
+	_, r, err = s.Read(id, "a.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.(io.Closer).Close()
+	if _, err := io.ReadAll(r); !errors.Is(err, ErrContentCorrupt) {
+		t.Fatalf("want ErrContentCorrupt, got %v", err)
+	}
+}
+
+// ------------------------------ Quota test ------------------------------------- //
+
+func TestQuotaLimitsWrites(t *testing.T) {
+	quota := Quota{BytesPerID: 100, ObjectsPerID: 2}
+	s := NewMemoryStore(StoreOpts{PathTransformFunc: CASPathTransformFunc, Quota: quota})
+	id := generateID()
+
+	write := func(key string, size int) error {
+		_, err := s.Write(id, key, bytes.NewReader(make([]byte, size)))
+		return err
+	}
+
+	if err := write("a", 60); err != nil {
+		t.Fatal(err)
+	}
+	if err := write("b", 50); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("want ErrQuotaExceeded for 110 bytes, have %v", err)
+	}
+	if s.Has(id, "b") {
+		t.Error("a write over the quota was kept")
+	}
+
+	// an overwrite is charged for what it adds
+	if err := write("a", 90); err != nil {
+		t.Fatal(err)
+	}
+	if err := write("c", 5); err != nil {
+		t.Fatal(err)
+	}
+	if err := write("d", 1); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("want ErrQuotaExceeded for a third object, have %v", err)
+	}
+	if err := s.Delete(id, "c"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := Usage{Bytes: 90, Objects: 1}
+	if u, err := s.Usage(id); err != nil || u != want {
+		t.Fatalf("usage %+v, %v, want %+v", u, err, want)
+	}
+
+	// the usage survives a restart, and is counted again without its file
+	restarted := NewLocalStore(StoreOpts{Root: s.Root, FS: s.FS, PathTransformFunc: CASPathTransformFunc, Quota: Quota{Bytes: 100}})
+	if u, err := restarted.Usage(id); err != nil || u != want {
+		t.Errorf("usage after a restart %+v, %v", u, err)
+	}
+	if _, err := restarted.Write(generateID(), "e", bytes.NewReader(make([]byte, 20))); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("want the node quota to refuse 20 more bytes, have %v", err)
+	}
+
+	s.FS.Remove(filepath.Join(s.Root, usageFileName))
+	recounted := NewLocalStore(StoreOpts{Root: s.Root, FS: s.FS, PathTransformFunc: CASPathTransformFunc, Quota: quota})
+	if u, err := recounted.Usage(id); err != nil || u != want {
+		t.Errorf("usage counted from the index %+v, %v", u, err)
+	}
+}
+
+// ------------------------------ Garbage collection test --------------------------- //
+
+func TestGCRemovesOrphans(t *testing.T) {
+	s := NewLocalStore(StoreOpts{
+		Root:              t.TempDir(),
+		PathTransformFunc: CASPathTransformFunc,
+		Chunking:          true,
+	})
+	id := generateID()
+
+	data := make([]byte, 512*1024)
+	mrand.New(mrand.NewSource(4)).Read(data)
+	if _, err := s.Put(id, "a.bin", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Put(id, "b.bin", bytes.NewReader([]byte("written, but the index record never made it"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(s.indexPath(id, "b.bin")); err != nil {
+		t.Fatal(err)
+	}
+
+	// what a crashed write leaves behind
+	sum := sha256.Sum256([]byte("orphan"))
+	orphan := hex.EncodeToString(sum[:])
+	if _, err := s.writeAtomic(s.blobPath(id, orphan), func(w io.Writer) (int64, error) {
+		return io.Copy(w, bytes.NewReader([]byte("orphan")))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	tmp, err := s.FS.CreateTemp(filepath.Join(s.Root, id, blobsDirName), tempFilePattern)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp.Write([]byte("half a blob"))
+	tmp.Close()
+
+	if report, err := s.GC(time.Hour); err != nil || report != (GCReport{}) {
+		t.Fatalf("nothing is old enough to collect yet, removed %+v, %v", report, err)
+	}
+
+	// a put that is reusing the orphan keeps it alive
+	pins := s.pins.hold()
+	pins.add(orphan)
+	report, err := s.GC(-1)
+	pins.release()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.TempFiles != 1 || report.Manifests != 1 || report.Blobs != 1 || report.Bytes == 0 {
+		t.Errorf("first collection removed %+v", report)
+	}
+	if _, err := os.Stat(s.blobPath(id, orphan)); err != nil {
+		t.Errorf("a pinned blob was collected: %v", err)
+	}
+
+	report, err = s.GC(-1)
+	if err != nil || report.Blobs != 1 || report.Dirs == 0 {
+		t.Errorf("second collection removed %+v, %v", report, err)
+	}
+
+	size, r, err := s.Read(id, "a.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(io.LimitReader(r, size))
+	r.(io.Closer).Close()
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("a.bin after GC: %d bytes, %v", len(got), err)
+	}
+}
+
+func countFiles(t *testing.T, dir string) int {
+	n := 0
+	filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			n++
+		}
+		return nil
+	})
+	return n
+}
+
 /*
 // -------------------- Write Test ------------------------ //
 
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"time"
+)
+
+/*
+A tombstone says a version of a key, and every version before it, is gone for good. Bury
+leaves one when it deletes the key, and put refuses to write a buried version again, whoever
+sends it: a peer that still holds a replica, a repair, or a fetch from a node that hasn't
+caught up. Version IDs sort by the time they were made (store_versions.go), so a tombstone
+also covers the older versions a replica that missed some writes may still hold. Writing the
+key anew is a newer version and isn't affected. With Versioning the buried versions leave the
+history too, and ReadVersion refuses them, so no version ID reads them back either.
+
+The tombstones of a key live in one file, next to its index record:
+
+	<root>/<id>/.tombstones/<key path>   [{"key": ..., "version": ..., "buried": "..."}, ...]
+
+They only have to outlive the copies that could come back, PurgeTombstones drops the older ones.
+*/
+
+const tombstonesDirName = ".tombstones"
+
+var ErrTombstoned = errors.New("version was deleted")
+
+type tombstone struct {
+	Key     string    `json:"key"`
+	Version string    `json:"version"`
+	Buried  time.Time `json:"buried"`
+}
+
+// ------------------------------ XXXXXXXXXXXXXXX---------------------------------------- //
+// ------------------------------ Tombstone Methods ------------------------------------- //
+
+/* Index
+1. Bury: Delete key unless it was written since version, and keep version and older from coming back
+2. PurgeTombstones: Drop the tombstones buried before a time
+3. checkTombstone: Fail a write of a buried version
+*/
+
+// 1. Bury ---------------------------//
+// Bury leaves the key alone when it was written again since version, the tombstone goes in
+// either way so no copy of version or older is taken back. Versions from before they were
+// recorded count as older than any.
+func (s *LocalStore) Bury(id string, key string, version string) error {
+	s.tombstonesMu.Lock()
+	defer s.tombstonesMu.Unlock()
+
+	stones, err := s.tombstones(s.tombstonePath(id, key))
+	if err != nil {
+		return err
+	}
+	stones = append(stones, tombstone{Key: key, Version: version, Buried: time.Now()})
+	if err := s.saveTombstones(s.tombstonePath(id, key), stones); err != nil {
+		return err
+	}
+
+	if err := s.deleteBuried(id, key, version); err != nil {
+		return err
+	}
+	return s.buryVersions(id, key, version) // the history would still serve them by their IDs
+}
+
+// 2. PurgeTombstones ---------------------------//
+func (s *LocalStore) PurgeTombstones(before time.Time) (int, error) {
+	ids, err := s.IDs()
+	if err != nil {
+		return 0, err
+	}
+
+	s.tombstonesMu.Lock()
+	defer s.tombstonesMu.Unlock()
+
+	purged := 0
+	for _, id := range ids {
+		err := walkFiles(s.FS, filepath.Join(s.Root, id, tombstonesDirName), func(path string) error {
+			stones, err := s.tombstones(path)
+			if err != nil {
+				return err
+			}
+
+			var keep []tombstone
+			for _, stone := range stones {
+				if stone.Buried.Before(before) {
+					purged++
+					continue
+				}
+				keep = append(keep, stone)
+			}
+			if len(keep) == len(stones) {
+				return nil
+			}
+			return s.saveTombstones(path, keep)
+		})
+		if err != nil {
+			return purged, fmt.Errorf("tombstones of %s: %w", id, err)
+		}
+	}
+	return purged, nil
+}
+
+// 3. checkTombstone ---------------------------//
+func (s *LocalStore) checkTombstone(id string, key string, version string) error {
+	if version == "" {
+		return nil // a new version, named once it is written, or one from before versions
+	}
+
+	s.tombstonesMu.Lock()
+	defer s.tombstonesMu.Unlock()
+
+	stones, err := s.tombstones(s.tombstonePath(id, key))
+	if err != nil {
+		return err
+	}
+	for _, stone := range stones {
+		if version <= stone.Version {
+			return fmt.Errorf("%w: version %s of (%s), at %s", ErrTombstoned, version, key, stone.Buried.Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+// ------------------------------ XXXXXXXXXXXXXXX---------------------------------------- //
+// ---------------------------------- Helpers ------------------------------------------- //
+
+// deleteBuried deletes the current version of key when it is version or older
+func (s *LocalStore) deleteBuried(id string, key string, version string) error {
+	rec, err := s.readIndex(s.indexPath(id, key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if rec.Meta.Version > version {
+		return nil
+	}
+
+	err = s.Delete(id, key)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil // deleted meanwhile
+	}
+	return err
+}
+
+func (s *LocalStore) tombstonePath(id string, key string) string {
+	return filepath.Join(s.Root, id, tombstonesDirName, s.PathTransformFunc(key).FullPath())
+}
+
+// tombstones reads a tombstone file, a missing one holds none
+func (s *LocalStore) tombstones(path string) ([]tombstone, error) {
+	b, err := readFile(s.FS, path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var stones []tombstone
+	if err := json.Unmarshal(b, &stones); err != nil {
+		return nil, fmt.Errorf("tombstones %s: %w", path, err)
+	}
+	return stones, nil
+}
+
+func (s *LocalStore) saveTombstones(path string, stones []tombstone) error {
+	if len(stones) == 0 {
+		err := s.removeWithEmptyParents(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	b, err := json.Marshal(stones)
+	if err != nil {
+		return err
+	}
+	_, err = s.writeAtomic(path, func(w io.Writer) (int64, error) {
+		return io.Copy(w, bytes.NewReader(b))
+	})
+	return err
+}
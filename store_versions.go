@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"time"
+)
+
+/*
+Every write is a version, named by Metadata.Version: an ID the first store to write it makes
+up, ordered by time, which replicas keep so every node names it the same. Without
+StoreOpts.Versioning only the latest version of a key is kept.
+
+With Versioning the store keeps the history of every key. The index record stays the
+current version, so Read, Stat and List see nothing different, and the versions it replaced
+go to a history file next to it, newest first:
+
+	<root>/<id>/.versions/<key path>   [{"key": ..., "cid": ..., "meta": {"version": ...}}, ...]
+
+Content is immutable under content addressing, so an old version is just a record pointing
+at the blob it always had, and Versioning implies ContentAddressed. Delete leaves a delete
+marker at the top of the history instead of dropping the content, the key reads as missing
+until it is written again.
+
+StoreOpts.Retention limits the history. What it drops goes on every write of the key and on
+every GC, along with the content no other record points at. Only the current version counts
+against the quota.
+*/
+
+const versionsDirName = ".versions"
+
+// Retention limits the noncurrent versions kept per key, 0 keeps them all
+type Retention struct {
+	Versions int           // the newest ones to keep
+	MaxAge   time.Duration // how long after it was written a version is kept
+}
+
+// ------------------------------ XXXXXXXXXXXXXXX---------------------------------------- //
+// ------------------------------- Version Methods -------------------------------------- //
+
+/* Index
+1. Versions: Every version of key, newest first, delete markers included
+2. ReadVersion: Read a given version of key, like Read does the current one
+3. fileRecord: Write the index record of a put, moving the version it replaces into the history
+4. deleteVersioned: Put a delete marker on top of the history of key, buryVersions drop what Bury buried
+5. expireVersions: Apply the retention to every history of id
+*/
+
+// 1. Versions ---------------------------//
+func (s *LocalStore) Versions(id string, key string) ([]ObjectInfo, error) {
+	records, err := s.history(id, key)
+	if err != nil {
+		return nil, err
+	}
+
+	current, err := s.readIndex(s.indexPath(id, key))
+	if err == nil {
+		records = append([]indexRecord{current}, records...)
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	versions := make([]ObjectInfo, 0, len(records))
+	for _, rec := range records {
+		if rec.Deleted {
+			versions = append(versions, ObjectInfo{Key: key, ModTime: rec.Modified, Meta: rec.Meta, Deleted: true})
+			continue
+		}
+		rec.Key = key
+		info, err := s.objectInfo(id, s.indexPath(id, key), rec)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, info)
+	}
+	return versions, nil
+}
+
+// 2. ReadVersion ---------------------------//
+// ReadVersion reads the current version for an empty version
+func (s *LocalStore) ReadVersion(id string, key string, version string) (int64, io.Reader, error) {
+	if version == "" {
+		return s.Read(id, key)
+	}
+	if err := s.checkTombstone(id, key, version); err != nil {
+		return 0, nil, err
+	}
+
+	rec, err := s.findVersion(id, key, version)
+	if err != nil {
+		return 0, nil, err
+	}
+	if rec.Deleted {
+		return 0, nil, fmt.Errorf("version %s of (%s) is a delete marker: %w", version, key, fs.ErrNotExist)
+	}
+
+	rec.Key = key
+	if rec.Meta.compressed() {
+		return s.readDecompressed(id, rec)
+	}
+	return s.readContent(id, rec.CID)
+}
+
+// 3. fileRecord ---------------------------//
+func (s *LocalStore) fileRecord(id string, info ObjectInfo) (ObjectInfo, error) {
+	if !s.Versioning {
+		return s.writeIndex(id, info)
+	}
+
+	s.versionsMu.Lock()
+	defer s.versionsMu.Unlock()
+
+	records, err := s.history(id, info.Key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	// a write of the version that is current already, e.g. a repair, replaces nothing
+	prev, err := s.readIndex(s.indexPath(id, info.Key))
+	switch {
+	case err == nil && prev.Meta.Version != info.Meta.Version:
+		prev.Key = info.Key
+		records = append([]indexRecord{prev}, records...)
+	case err != nil && !errors.Is(err, fs.ErrNotExist):
+		return ObjectInfo{}, err
+	}
+
+	// the history first, a crash in between leaves the old version in both, never in neither
+	dropped, err := s.saveHistory(id, info.Key, records)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	if info, err = s.writeIndex(id, info); err != nil {
+		return ObjectInfo{}, err
+	}
+	return info, s.releaseVersions(id, dropped)
+}
+
+// 4. deleteVersioned ---------------------------//
+func (s *LocalStore) deleteVersioned(id string, key string) error {
+	s.versionsMu.Lock()
+	defer s.versionsMu.Unlock()
+
+	current, err := s.readIndex(s.indexPath(id, key))
+	if err != nil {
+		return fmt.Errorf("failed to delete file: %w", err)
+	}
+	records, err := s.history(id, key)
+	if err != nil {
+		return err
+	}
+
+	current.Key = key
+	marker := indexRecord{Key: key, Modified: time.Now(), Meta: Metadata{Version: newVersionID()}, Deleted: true}
+	records = append([]indexRecord{marker, current}, records...)
+
+	dropped, err := s.saveHistory(id, key, records)
+	if err != nil {
+		return err
+	}
+	if err := s.removeWithEmptyParents(s.indexPath(id, key)); err != nil {
+		return err
+	}
+	return s.releaseVersions(id, dropped)
+}
+
+// buryVersions drops version and the versions older than it from the history of key, for Bury
+func (s *LocalStore) buryVersions(id string, key string, version string) error {
+	s.versionsMu.Lock()
+	defer s.versionsMu.Unlock()
+
+	records, err := s.history(id, key)
+	if err != nil || len(records) == 0 {
+		return err
+	}
+
+	var keep, buried []indexRecord
+	for _, rec := range records {
+		if rec.Meta.Version <= version {
+			buried = append(buried, rec)
+		} else {
+			keep = append(keep, rec)
+		}
+	}
+	if len(buried) == 0 {
+		return nil
+	}
+
+	dropped, err := s.saveHistory(id, key, keep)
+	if err != nil {
+		return err
+	}
+	return s.releaseVersions(id, append(buried, dropped...))
+}
+
+// 5. expireVersions ---------------------------//
+// expireVersions lets GC drop what got too old since the keys were last written
+func (s *LocalStore) expireVersions(id string) error {
+	if s.Retention.MaxAge <= 0 {
+		return nil
+	}
+
+	return walkFiles(s.FS, filepath.Join(s.Root, id, versionsDirName), func(path string) error {
+		s.versionsMu.Lock()
+		defer s.versionsMu.Unlock()
+
+		records, err := s.readHistory(path)
+		if errors.Is(err, fs.ErrNotExist) || len(records) == 0 {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		dropped, err := s.saveHistory(id, records[0].Key, records)
+		if err != nil {
+			return err
+		}
+		return s.releaseVersions(id, dropped)
+	})
+}
+
+// ------------------------------ XXXXXXXXXXXXXXX---------------------------------------- //
+// ---------------------------------- Helpers ------------------------------------------- //
+
+// newVersionID sorts by the time it was made, the random part keeps IDs made at once apart
+func newVersionID() string {
+	return fmt.Sprintf("%016x%s", time.Now().UnixNano(), generateID()[:8])
+}
+
+func (s *LocalStore) historyPath(id string, key string) string {
+	return filepath.Join(s.Root, id, versionsDirName, s.PathTransformFunc(key).FullPath())
+}
+
+func (s *LocalStore) history(id string, key string) ([]indexRecord, error) {
+	records, err := s.readHistory(s.historyPath(id, key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	return records, err
+}
+
+func (s *LocalStore) readHistory(path string) ([]indexRecord, error) {
+	b, err := readFile(s.FS, path)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []indexRecord
+	if err := json.Unmarshal(b, &records); err != nil {
+		return nil, fmt.Errorf("version history %s: %w", path, err)
+	}
+	return records, nil
+}
+
+// saveHistory applies the retention to records and writes what is kept, it returns what isn't
+func (s *LocalStore) saveHistory(id string, key string, records []indexRecord) ([]indexRecord, error) {
+	keep, dropped := s.retain(records)
+
+	path := s.historyPath(id, key)
+	if len(keep) == 0 {
+		err := s.removeWithEmptyParents(path)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		return dropped, nil
+	}
+
+	b, err := json.Marshal(keep)
+	if err != nil {
+		return nil, err
+	}
+	_, err = s.writeAtomic(path, func(w io.Writer) (int64, error) {
+		return io.Copy(w, bytes.NewReader(b))
+	})
+	return dropped, err
+}
+
+// retain splits a history, newest first, into what the retention keeps and what it drops. A
+// delete marker with nothing left under it is dropped too.
+func (s *LocalStore) retain(records []indexRecord) ([]indexRecord, []indexRecord) {
+	var keep, dropped []indexRecord
+	cutoff := time.Now().Add(-s.Retention.MaxAge)
+
+	for _, rec := range records {
+		switch {
+		case s.Retention.Versions > 0 && len(keep) >= s.Retention.Versions:
+			dropped = append(dropped, rec)
+		case s.Retention.MaxAge > 0 && rec.Modified.Before(cutoff):
+			dropped = append(dropped, rec)
+		default:
+			keep = append(keep, rec)
+		}
+	}
+
+	for len(keep) > 0 && keep[len(keep)-1].Deleted {
+		dropped = append(dropped, keep[len(keep)-1])
+		keep = keep[:len(keep)-1]
+	}
+	return keep, dropped
+}
+
+// releaseVersions removes the content of dropped versions that nothing else points at
+func (s *LocalStore) releaseVersions(id string, dropped []indexRecord) error {
+	if len(dropped) == 0 {
+		return nil
+	}
+
+	s.pins.track()
+	defer s.pins.untrack()
+
+	live, err := s.mark(id) // once for all of them, see deleteContent
+	if err != nil {
+		return err
+	}
+
+	for _, rec := range dropped {
+		if rec.Deleted || live[rec.CID] {
+			continue
+		}
+		if err := s.deleteContent(id, rec.CID, live); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *LocalStore) findVersion(id string, key string, version string) (indexRecord, error) {
+	current, err := s.readIndex(s.indexPath(id, key))
+	if err == nil && current.Meta.Version == version {
+		return current, nil
+	}
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return indexRecord{}, err
+	}
+
+	records, err := s.history(id, key)
+	if err != nil {
+		return indexRecord{}, err
+	}
+	for _, rec := range records {
+		if rec.Meta.Version == version {
+			return rec, nil
+		}
+	}
+	return indexRecord{}, fmt.Errorf("version %s of (%s): %w", version, key, fs.ErrNotExist)
+}
+
+// walkHistories calls fn for every version kept in the histories of id, delete markers left out
+func (s *LocalStore) walkHistories(id string, fn func(rec indexRecord) error) error {
+	return walkFiles(s.FS, filepath.Join(s.Root, id, versionsDirName), func(path string) error {
+		records, err := s.readHistory(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil // dropped while we walked
+		}
+		if err != nil {
+			return err
+		}
+		for _, rec := range records {
+			if rec.Deleted {
+				continue
+			}
+			if err := fn(rec); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}